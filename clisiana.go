@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/casimir/xdg-go"
-	"github.com/mjec/clisiana/lib/notifications"
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/messagelog"
 	"github.com/mjec/clisiana/lib/zulip"
 )
 
@@ -21,12 +24,16 @@ func main() {
 	if !DEBUG {
 		log.SetOutput(ioutil.Discard)
 	}
+	rand.Seed(time.Now().UnixNano())
 	config = &Config{}
 	config.xdgApp = xdg.App{Name: "clisiana"}
 
 	config.mainTextChannel = make(chan WindowMessage, 5)
 	config.outgoingStreamMessagesChannel = make(chan zulip.OutgoingStreamMessage, 10)
 	config.outgoingPrivateMessagesChannel = make(chan zulip.OutgoingPrivateMessage, 10)
+	config.feed = newMainFeed()
+	config.roster = newRoster()
+	config.unread = newUnreadMessages()
 
 	config.cliApp = commandLineSetup()
 
@@ -35,110 +42,258 @@ func main() {
 	config.cliApp.Run(os.Args)
 }
 
-func startReceivingMessages() chan bool {
-	restartConnection := make(chan bool)
-	closeConnection := make(chan bool)
-	go func(restartConnection chan bool, closeConnection chan bool, zulipContext *zulip.Context) {
-		stopGettingEvents := make(chan bool)
-		for {
-			select {
-			case <-closeConnection:
-				config.mainTextChannel <- WindowMessage{
-					Type:    DebugMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Closing connection...")},
-				}
-				close(closeConnection)
-				stopGettingEvents <- true
-				close(stopGettingEvents)
+// syncPageSize is the number of messages to request at once when catching up on
+// messages which arrived since those in the cache
+const syncPageSize = 1000
+
+// fetchHistory retrieves a page of messages matching n from before anchor and inserts
+// them into the main view. The page comes from the cache if it holds every message
+// from the start of the page to anchor, otherwise from the server.
+func fetchHistory(anchor int64, n narrowing) {
+	var cached []zulip.Message
+	if n.cached() {
+		var err error
+		cached, err = config.cache.BeforeMatching(anchor, config.Backfill, n.cacheFilter())
+		if err == nil && len(cached) == config.Backfill {
+			if covered, err := config.cache.Covers(cached[0].ID, anchor); err == nil && covered {
+				config.ui.Execute(makeMainViewHistoryInserter(windowMessagesFromZulipMessages(cached), n, false))
 				return
-			case <-restartConnection:
-				// no-op i.e. loop again
 			}
-			queueID, lastEventID, err := zulip.Register(zulipContext, zulip.MessageEvent, false)
-			if err != nil {
-				config.mainTextChannel <- WindowMessage{
-					Type:    ErrorMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Cannot register: %v", err)},
-				}
-				break
-			} else {
-				config.mainTextChannel <- WindowMessage{
-					Type:    DebugMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Queue %s obtained, waiting for messages...", queueID)},
-				}
+		}
+	}
+	messages, foundOldest, _, err := config.zulipClient.GetMessages(context.Background(), n.zulipNarrow(), anchor, config.Backfill, 0, requestHTML())
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot load message history: %v", err)},
+		}
+		// Show whatever the cache had
+		config.ui.Execute(makeMainViewHistoryInserter(windowMessagesFromZulipMessages(cached), n, false))
+		return
+	}
+	storeMessages(messages...)
+	if n.isAll() && len(messages) > 0 {
+		// The page is every message before anchor, so there is no gap up to it
+		last := anchor
+		if last == zulip.AnchorNewest {
+			last = messages[len(messages)-1].ID
+		}
+		recordContiguous(messages[0].ID, last, foundOldest)
+	}
+	config.ui.Execute(makeMainViewHistoryInserter(windowMessagesFromZulipMessages(messages), n, foundOldest))
+}
+
+// syncHistory retrieves every message which is newer than the message with ID since
+// (or the newest message in the cache, if since is 0) and inserts them into the main
+// view. If there is no such message, the newest page of history is retrieved instead.
+// Returns the ID of the newest message retrieved, or since if there were none.
+func syncHistory(ctx context.Context, client *zulip.Client, since int64) int64 {
+	if since == 0 && config.cache != nil {
+		since, _ = config.cache.NewestID()
+	}
+	if since == 0 {
+		messages, foundOldest, _, err := client.GetMessages(ctx, zulip.Narrow{}, zulip.AnchorNewest, config.Backfill, 0, requestHTML())
+		if err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot load message history: %v", err)},
+			}
+			return 0
+		}
+		storeMessages(messages...)
+		config.ui.Execute(makeMainViewHistoryInserter(windowMessagesFromZulipMessages(messages), narrowing{}, foundOldest))
+		if len(messages) == 0 {
+			return 0
+		}
+		recordContiguous(messages[0].ID, messages[len(messages)-1].ID, foundOldest)
+		return messages[len(messages)-1].ID
+	}
+	for {
+		// Not narrowed, because we want everything the event queue would have given us
+		messages, _, foundNewest, err := client.GetMessages(ctx, zulip.Narrow{}, since, 0, syncPageSize, requestHTML())
+		if err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot load new messages: %v", err)},
+			}
+			return since
+		}
+		storeMessages(messages...)
+		if len(messages) > 0 {
+			recordContiguous(since, messages[len(messages)-1].ID, false)
+		}
+		config.ui.Execute(makeMainViewHistoryInserter(windowMessagesFromZulipMessages(messages), narrowing{}, false))
+		if len(messages) == 0 || messages[len(messages)-1].ID <= since {
+			return since
+		}
+		since = messages[len(messages)-1].ID
+		if foundNewest {
+			return since
+		}
+	}
+}
+
+// loadCachedHistory displays the newest page of messages in the cache
+func loadCachedHistory() {
+	if config.cache == nil {
+		return
+	}
+	cached, err := config.cache.Latest(config.Backfill)
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot read message cache: %v", err)},
+		}
+		return
+	}
+	config.ui.Execute(makeMainViewHistoryInserter(windowMessagesFromZulipMessages(cached), narrowing{}, false))
+}
+
+// storeMessages stores messages received from the server in the cache and the
+// message log, if they are enabled
+func storeMessages(messages ...zulip.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	if config.cache != nil {
+		if err := config.cache.Store(messages...); err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot write to message cache: %v", err)},
 			}
-			go func(queue string,
-				lastEventID int64,
-				restartConnection chan<- bool,
-				stopGettingEvents <-chan bool,
-				zulipContext *zulip.Context) {
-				var err error
-				for {
-					select {
-					case <-stopGettingEvents:
-						// We need to do this in case we are not in the middle of a GetEvents request
-						// when things are stopped
-						break
-					default:
-						// no-op i.e. loop again
-					}
-					var events = []zulip.Event{}
-					events, err = zulip.GetEvents(zulipContext, queue, lastEventID, false)
-					if err != nil {
-						// Normally this will be because of a cancellation, in which case we just break
-						if !strings.HasSuffix(err.Error(), "request canceled") {
-							// If it isn't a cancellation, show the error message...
-							config.mainTextChannel <- WindowMessage{
-								Type:    ErrorMessage,
-								Message: zulip.Message{Content: fmt.Sprintf("%v", err)},
-							}
-							// ...and ask for a new queue, Just In Case
-							restartConnection <- true
-						}
-						break
-					}
-					for i := range events {
-						if events[i].ID > lastEventID {
-							lastEventID = events[i].ID
-						}
-						switch events[i].Type {
-						case zulip.HeartbeatEvent:
-							break
-						case zulip.MessageEvent:
-							switch events[i].Message.Type {
-							case zulip.StreamMessage:
-								config.notifications.Push(notifications.Notification{
-									Title: fmt.Sprintf(
-										"%s in %s > %s",
-										events[i].Message.SenderFullName,
-										events[i].Message.DisplayRecipient.Stream,
-										events[i].Message.Subject),
-									Content: events[i].Message.Content,
-								})
-								config.mainTextChannel <- WindowMessage{
-									Type:    StreamMessage,
-									Message: events[i].Message,
-								}
-							case zulip.PrivateMessage:
-								config.notifications.Push(notifications.Notification{
-									Title:   fmt.Sprintf("Private message from %s", events[i].Message.SenderFullName),
-									Content: events[i].Message.Content,
-								})
-								config.mainTextChannel <- WindowMessage{
-									Type:    PrivateMessage,
-									Message: events[i].Message,
-								}
-							default:
-								log.Panic("Unsupported message type: ", events[i].Message.Type)
-							}
-						default:
-							log.Panic("Unsupported event type: ", events[i].Type)
-						}
-					}
-				}
-			}(queueID, lastEventID, restartConnection, stopGettingEvents, zulipContext)
-		}
-	}(restartConnection, closeConnection, config.zulipContext)
-	restartConnection <- true
-	return closeConnection
+		}
+	}
+	if config.messageLog != nil {
+		entries := make([]messagelog.Entry, len(messages))
+		for i := range messages {
+			entries[i] = messagelog.IncomingEntry(messages[i])
+		}
+		logMessages(entries...)
+	}
+}
+
+// recordContiguous notes that the cache holds every message with an ID from first to
+// last (or from the very first message, if foundOldest), so that pages of history in
+// that range can be read from it rather than the server. Only unnarrowed pages are
+// contiguous: the cache holds messages from every narrow.
+func recordContiguous(first int64, last int64, foundOldest bool) {
+	if config.cache == nil {
+		return
+	}
+	if foundOldest {
+		first = 0
+	}
+	if err := config.cache.AddRange(first, last); err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot write to message cache: %v", err)},
+		}
+	}
+}
+
+// changeMessages calls change on each of the messages with the given IDs in the
+// cache and the main view. If changed is not nil, it is then called from the gocui
+// main loop with the messages which were changed in the main view.
+func changeMessages(ids []int64, change func(*zulip.Message), changed func([]zulip.Message)) {
+	if config.cache != nil {
+		cached, err := config.cache.Get(ids...)
+		if err == nil {
+			for i := range cached {
+				change(&cached[i])
+			}
+			err = config.cache.Store(cached...)
+		}
+		if err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot update message cache: %v", err)},
+			}
+		}
+	}
+	config.ui.Execute(func(g *gocui.Gui) error {
+		main, err := g.View("main")
+		if err != nil {
+			return err
+		}
+		ms := config.feed.update(main, ids, change)
+		if changed != nil {
+			changed(ms)
+		}
+		return nil
+	})
+}
+
+// applyMessageUpdate makes an edit to one or more messages in the cache and the main
+// view, and notifies the user if someone else changed a message's content
+func applyMessageUpdate(u *zulip.MessageUpdate) {
+	if u.Subject != "" {
+		config.unread.moveToTopic(u.AffectedIDs(), u.Subject)
+	}
+	changeMessages(u.AffectedIDs(), u.Apply, func(changed []zulip.Message) {
+		for _, m := range changed {
+			if u.Content != "" && !u.RenderingOnly && m.ID == u.MessageID && m.SenderEmail != config.Email {
+				n := notificationForMessage(m)
+				n.Title += " (edited)"
+				go config.notifications.Push(n)
+			}
+		}
+	})
+}
+
+// applyReaction adds or removes a reaction to a message in the cache and the main view
+func applyReaction(r *zulip.ReactionUpdate) {
+	changeMessages([]int64{r.MessageID}, r.Apply, nil)
+}
+
+// applyMessageDeletion removes deleted messages from the cache and the main view.
+// They stay in the message log, which is append-only.
+func applyMessageDeletion(d *zulip.MessageDeletion) {
+	ids := d.AffectedIDs()
+	config.unread.remove(ids...)
+	if config.cache != nil {
+		if err := config.cache.Delete(ids...); err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot update message cache: %v", err)},
+			}
+		}
+	}
+	config.ui.Execute(func(g *gocui.Gui) error {
+		main, err := g.View("main")
+		if err != nil {
+			return err
+		}
+		config.feed.remove(main, ids)
+		return nil
+	})
+}
+
+// logMessages appends entries to the message log, if it is enabled
+func logMessages(entries ...messagelog.Entry) {
+	if config.messageLog == nil {
+		return
+	}
+	if err := config.messageLog.Append(entries...); err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot write to message log: %v", err)},
+		}
+	}
+}
+
+// windowMessagesFromZulipMessages returns WindowMessages to display zulip.Messages
+func windowMessagesFromZulipMessages(ms []zulip.Message) []WindowMessage {
+	windowMessages := make([]WindowMessage, len(ms))
+	for i := range ms {
+		windowMessages[i] = windowMessageFromZulipMessage(ms[i])
+	}
+	return windowMessages
+}
+
+// windowMessageFromZulipMessage returns a WindowMessage to display a zulip.Message
+func windowMessageFromZulipMessage(m zulip.Message) WindowMessage {
+	if m.Type == zulip.PrivateMessage {
+		return WindowMessage{Type: PrivateMessage, Message: m}
+	}
+	return WindowMessage{Type: StreamMessage, Message: m}
 }
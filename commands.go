@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/emoji"
+	"github.com/mjec/clisiana/lib/messagelog"
 	"github.com/mjec/clisiana/lib/zulip"
 
 	"gopkg.in/yaml.v2"
@@ -40,94 +45,129 @@ func parseCmdLine(line string) {
 			log.Panic("Cannot clear: " + err.Error())
 		}
 		mainView.Clear()
+		config.feed.reset()
 	case "disconnect":
-		config.closeConnection <- true // this channel will be closed by its receiver
-		zulip.CancelAllRequests()
+		if config.closeConnection == nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: "Not connected"},
+			}
+			break
+		}
+		config.closeConnection()
 		config.closeConnection = nil
 		config.mainTextChannel <- WindowMessage{
 			Type:    CommandFeedbackMessage,
-			Message: zulip.Message{Content: fmt.Sprintf("Disconnected from %s", config.zulipContext.APIBase)},
+			Message: zulip.Message{Content: fmt.Sprintf("Disconnected from %s", config.zulipClient.APIBase())},
 		}
 	case "config":
 		handleCommandConfig(cmd)
-	case "private":
-		results := showNewPrivateMessagePrompt(config.ui, zulip.OutgoingPrivateMessage{})
-		go func(channel chan<- WindowMessage, result <-chan struct {
-			zulip.OutgoingPrivateMessage
-			error
-		}) {
-			r := <-result
-			if r.error != nil {
-				channel <- WindowMessage{
-					Type:    ErrorMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Unable to get a new private message: %v.", r.error)},
-				}
-				return
+	case "log":
+		handleCommandLog(cmd)
+	case "history":
+		handleCommandHistory(cmd)
+	case "edit":
+		handleCommandEdit(cmd)
+	case "delete":
+		handleCommandDelete(cmd)
+	case "react":
+		handleCommandReact(cmd)
+	case "streams":
+		go showStreamList()
+	case "who":
+		handleCommandWho(cmd)
+	case "whois":
+		handleCommandWhois(cmd)
+	case "away", "back":
+		handleCommandAway(cmd)
+	case "narrow":
+		handleCommandNarrow(cmd)
+	case "reply", "quote", "link":
+		if len(cmd) > 2 {
+			config.mainTextChannel <- WindowMessage{
+				Type:    CommandFeedbackMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Usage: %s [<message id>]\nWithout a message ID, uses the selected message or else the newest message.", cmd[0])},
 			}
-			msgid, err := zulip.SendPrivateMessage(config.zulipContext, r.OutgoingPrivateMessage)
-			if err != nil {
-				channel <- WindowMessage{
-					Type:    ErrorMessage,
-					Message: zulip.Message{Content: err.Error()},
-				}
-			} else {
-				channel <- WindowMessage{
-					Type:    DebugMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Private message sent: got message ID %d", msgid)},
-				}
+			break
+		}
+		switch strings.ToLower(cmd[0]) {
+		case "reply":
+			handleCommandReply(cmd)
+		case "quote":
+			handleCommandQuote(cmd)
+		case "link":
+			handleCommandLink(cmd)
+		}
+	case "subscribe", "unsubscribe", "members":
+		name := strings.TrimSpace(strings.Join(cmd[1:], " "))
+		if name == "" {
+			config.mainTextChannel <- WindowMessage{
+				Type:    CommandFeedbackMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Usage: %s <stream>", cmd[0])},
 			}
-		}(config.mainTextChannel, results)
+			break
+		}
+		switch strings.ToLower(cmd[0]) {
+		case "subscribe":
+			go subscribeToStream(name)
+		case "unsubscribe":
+			go unsubscribeFromStream(name)
+		case "members":
+			go showStreamMembers(name, 0)
+		}
+	case "private":
+		showNewPrivateMessagePrompt(config.ui, zulip.OutgoingPrivateMessage{})
 	case "stream":
-		results := showNewStreamMessagePrompt(config.ui, zulip.OutgoingStreamMessage{
+		showNewStreamMessagePrompt(config.ui, zulip.OutgoingStreamMessage{
 			Stream: "test-stream",
 			Topic:  "Testing clisiana",
 		})
-		go func(channel chan<- WindowMessage, result <-chan struct {
-			zulip.OutgoingStreamMessage
-			error
-		}) {
-			r := <-result
-			if r.error != nil {
-				channel <- WindowMessage{
-					Type:    ErrorMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Unable to get a new stream message: %v.", r.error)},
-				}
-				return
-			}
-			msgid, err := zulip.SendStreamMessage(config.zulipContext, r.OutgoingStreamMessage)
-			if err != nil {
-				channel <- WindowMessage{
+	case "connect":
+		if config.closeConnection != nil {
+			if state, _, _, _ := currentConnectionState(); state != Closed {
+				config.mainTextChannel <- WindowMessage{
 					Type:    ErrorMessage,
-					Message: zulip.Message{Content: err.Error()},
-				}
-			} else {
-				channel <- WindowMessage{
-					Type:    DebugMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Stream message sent: got message ID %d", msgid)},
+					Message: zulip.Message{Content: fmt.Sprintf("Already connected (%s); use 'disconnect' first", connectionStateDescription())},
 				}
+				break
 			}
-		}(config.mainTextChannel, results)
-	case "connect":
+			config.closeConnection()
+		}
 		config.closeConnection = startReceivingMessages()
 		config.mainTextChannel <- WindowMessage{
 			Type:    CommandFeedbackMessage,
-			Message: zulip.Message{Content: fmt.Sprintf("Okay, waiting for messages from %s", config.zulipContext.APIBase)},
+			Message: zulip.Message{Content: fmt.Sprintf("Okay, waiting for messages from %s", config.zulipClient.APIBase())},
 		}
 	case "ping":
+		state, since, _, lastErr := currentConnectionState()
+		ret = fmt.Sprintf("Connection is %s (since %s)", connectionStateDescription(), since.Format("15:04:05"))
+		if state == Disconnected {
+			ret = "Connection is disconnected"
+		}
+		if state == BackingOff && lastErr != nil {
+			ret += fmt.Sprintf(" after: %v", lastErr)
+		}
+		if limit := config.zulipClient.RateLimit(); limit.Known && time.Now().Before(limit.Reset) {
+			ret += fmt.Sprintf("\nRate limit: %d of %d requests left until %s", limit.Remaining, limit.Limit, limit.Reset.Format("15:04:05"))
+		}
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: ret},
+		}
 		config.mainTextChannel <- WindowMessage{
 			Type:    CommandFeedbackMessage,
 			Message: zulip.Message{Content: fmt.Sprintf("Attempting to ping %s", config.APIBase)},
 		}
 		go func(channel chan<- WindowMessage) {
-			if err := zulip.CanReachServer(config.zulipContext); err == nil {
+			if err := config.zulipClient.CanReachServer(context.Background()); err == nil {
 				channel <- WindowMessage{
 					Type:    CommandFeedbackMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Connection to %s is working properly.", config.zulipContext.APIBase)},
+					Message: zulip.Message{Content: fmt.Sprintf("Connection to %s is working properly.", config.zulipClient.APIBase())},
 				}
 			} else {
 				channel <- WindowMessage{
 					Type:    ErrorMessage,
-					Message: zulip.Message{Content: fmt.Sprintf("Connection to %s/generate_204 failed: %v.", config.zulipContext.APIBase, err)},
+					Message: zulip.Message{Content: fmt.Sprintf("Connection to %s/generate_204 failed: %v.", config.zulipClient.APIBase(), err)},
 				}
 			}
 		}(config.mainTextChannel)
@@ -147,17 +187,18 @@ func parseCmdLine(line string) {
 				Message: zulip.Message{Content: fmt.Sprintf("Attempting to send test message to %s", cmd[1])},
 			}
 			go func(channel chan<- WindowMessage) {
-				msgid, err := zulip.SendPrivateMessage(config.zulipContext,
-					zulip.OutgoingPrivateMessage{
-						To:      []string{cmd[1]},
-						Content: "Test message!\n**Hello world** is in bold.\n:octopus: is an emoji.",
-					})
+				msg := zulip.OutgoingPrivateMessage{
+					To:      []string{cmd[1]},
+					Content: "Test message!\n**Hello world** is in bold.\n:octopus: is an emoji.",
+				}
+				msgid, err := config.zulipClient.SendPrivateMessage(context.Background(), msg)
 				if err != nil {
 					channel <- WindowMessage{
 						Type:    ErrorMessage,
 						Message: zulip.Message{Content: err.Error()},
 					}
 				} else {
+					logMessages(messagelog.OutgoingPrivateEntry(msgid, config.Email, msg))
 					channel <- WindowMessage{
 						Type:    DebugMessage,
 						Message: zulip.Message{Content: fmt.Sprintf("Test message sent: got message ID %d", msgid)},
@@ -232,13 +273,22 @@ func handleCommandConfig(cmd []string) {
 		if len(cmd) != 4 {
 			goto CmdConfigShowHelp
 		}
-		err = setConfigFromStrings(strings.ToLower(strings.TrimSpace(cmd[2])), cmd[3])
+		if strings.EqualFold(strings.TrimSpace(cmd[2]), "code-colors") {
+			err = checkCodeColors(cmd[3])
+		}
+		if err == nil {
+			err = setConfigFromStrings(strings.ToLower(strings.TrimSpace(cmd[2])), cmd[3])
+		}
 		if err == nil {
 			config.mainTextChannel <- WindowMessage{
 				Type:    CommandFeedbackMessage,
 				Message: zulip.Message{Content: fmt.Sprintf("%s set to %s", strings.ToLower(strings.TrimSpace(cmd[2])), cmd[3])},
 			}
-			updateZulipContext()
+			updateZulipClient()
+			// Settings such as code-colors and site change how messages look
+			if main, err := config.ui.View("main"); err == nil {
+				config.feed.reformat(main)
+			}
 			break
 		}
 		config.mainTextChannel <- WindowMessage{
@@ -256,3 +306,597 @@ func handleCommandConfig(cmd []string) {
 		}
 	}
 }
+
+// logQueryLimit is the number of entries shown by the log command if no limit is given
+const logQueryLimit = 100
+
+func handleCommandLog(cmd []string) {
+	if config.messageLog == nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: "Message logging is not enabled (start with --logging to enable it)"},
+		}
+		return
+	}
+
+	q := messagelog.Query{Limit: logQueryLimit}
+	for _, arg := range cmd[1:] {
+		parts := strings.SplitN(arg, ":", 2)
+		if len(parts) != 2 {
+			goto CmdLogShowHelp
+		}
+		var err error
+		switch strings.ToLower(parts[0]) {
+		case "since":
+			q.Since, err = parseLogDate(parts[1])
+		case "until":
+			q.Until, err = parseLogDate(parts[1])
+			// Until a date means until the end of that day
+			if err == nil && !strings.Contains(parts[1], "T") {
+				q.Until = q.Until.AddDate(0, 0, 1)
+			}
+		case "stream":
+			q.Stream = parts[1]
+		case "topic":
+			q.Topic = parts[1]
+		case "pm":
+			q.PMWith = parts[1]
+		case "limit":
+			q.Limit, err = strconv.Atoi(parts[1])
+		default:
+			goto CmdLogShowHelp
+		}
+		if err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Invalid value for %s: %v", parts[0], err)},
+			}
+			return
+		}
+	}
+
+	go func(channel chan<- WindowMessage, q messagelog.Query) {
+		entries, err := config.messageLog.Query(q)
+		if err != nil {
+			channel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Unable to read message log: %v", err)},
+			}
+			return
+		}
+		ret := fmt.Sprintf("%d logged messages", len(entries))
+		for _, e := range entries {
+			direction := "<-"
+			if e.Direction == messagelog.Outgoing {
+				direction = "->"
+			}
+			to := e.Recipient
+			if e.Type == zulip.StreamMessage {
+				to = fmt.Sprintf("%s > %s", e.Recipient, e.Topic)
+			}
+			content := plainContent(zulip.Message{Content: e.Content, ContentType: e.ContentType})
+			ret += fmt.Sprintf("\n%s %s %s to %s: %s", e.Timestamp.Format("2006-01-02 15:04"), direction, e.Sender, to, content)
+		}
+		channel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: ret},
+		}
+	}(config.mainTextChannel, q)
+	return
+
+CmdLogShowHelp:
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: "Usage: log [since:<date>] [until:<date>] [stream:<name>] [topic:<name>] [pm:<email>] [limit:<n>]\nDates are YYYY-MM-DD or YYYY-MM-DDTHH:MM in local time."},
+	}
+}
+
+func handleCommandHistory(cmd []string) {
+	if len(cmd) != 2 {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: "Usage: history <message id>"},
+		}
+		return
+	}
+	messageID, err := strconv.ParseInt(cmd[1], 10, 64)
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Invalid message ID %s", cmd[1])},
+		}
+		return
+	}
+
+	go func(channel chan<- WindowMessage) {
+		snapshots, err := config.zulipClient.GetMessageHistory(context.Background(), messageID)
+		if err != nil {
+			channel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Unable to get the history of message %d: %v", messageID, err)},
+			}
+			return
+		}
+		ret := fmt.Sprintf("%d versions of message %d", len(snapshots), messageID)
+		for i, snapshot := range snapshots {
+			ret += fmt.Sprintf("\n%d. %s, topic %s", i+1, time.Unix(snapshot.Timestamp, 0).Format("2006-01-02 15:04"), snapshot.Topic)
+			if snapshot.PrevTopic != "" {
+				ret += fmt.Sprintf(" (was %s)", snapshot.PrevTopic)
+			}
+			ret += "\n" + snapshot.Content
+		}
+		channel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: ret},
+		}
+	}(config.mainTextChannel)
+}
+
+// messageEdit is an edit to a message which is in progress in one of the composers
+type messageEdit struct {
+	original      zulip.Message
+	content       string              // the markdown of original, which may have been fetched as HTML
+	propagateMode zulip.PropagateMode // for a change of topic
+}
+
+// targetMessage returns the message a command acts on: the one with the ID given as
+// an argument, or else the selected one, or else the last one the user sent. Must be
+// called from the gocui main loop.
+func targetMessage(idArg string) (zulip.Message, error) {
+	if idArg == "" {
+		if m, ok := config.feed.selectedMessage(); ok {
+			return m, nil
+		}
+		if m, ok := config.feed.lastMessageFrom(config.Email); ok {
+			return m, nil
+		}
+		return zulip.Message{}, fmt.Errorf("You have not sent any messages")
+	}
+	id, err := strconv.ParseInt(idArg, 10, 64)
+	if err != nil {
+		return zulip.Message{}, fmt.Errorf("Invalid message ID %s", idArg)
+	}
+	if m, ok := config.feed.message(id); ok {
+		return m, nil
+	}
+	if config.cache != nil {
+		if cached, err := config.cache.Get(id); err == nil && len(cached) == 1 {
+			return cached[0], nil
+		}
+	}
+	return zulip.Message{}, fmt.Errorf("Message %d is not loaded", id)
+}
+
+// targetMessageOrNewest is like targetMessage, but if there is no ID given and no
+// message selected it returns the newest message rather than the user's own
+func targetMessageOrNewest(idArg string) (zulip.Message, error) {
+	if idArg == "" {
+		if m, ok := config.feed.selectedMessage(); ok {
+			return m, nil
+		}
+		if m, ok := config.feed.lastMessage(); ok {
+			return m, nil
+		}
+		return zulip.Message{}, fmt.Errorf("There are no messages")
+	}
+	return targetMessage(idArg)
+}
+
+func handleCommandEdit(cmd []string) {
+	idArg := ""
+	mode := zulip.ChangeOne
+	for _, arg := range cmd[1:] {
+		switch strings.ToLower(arg) {
+		case "propagate:one":
+			mode = zulip.ChangeOne
+		case "propagate:later":
+			mode = zulip.ChangeLater
+		case "propagate:all":
+			mode = zulip.ChangeAll
+		default:
+			if idArg != "" || strings.Contains(arg, ":") {
+				config.mainTextChannel <- WindowMessage{
+					Type:    CommandFeedbackMessage,
+					Message: zulip.Message{Content: "Usage: edit [<message id>] [propagate:one|later|all]\nWithout a message ID, edits the selected message or else the last message you sent. propagate says which messages a change of topic applies to."},
+				}
+				return
+			}
+			idArg = arg
+		}
+	}
+	m, err := targetMessage(idArg)
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: err.Error()},
+		}
+		return
+	}
+	if !strings.EqualFold(m.SenderEmail, config.Email) {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Message %d was sent by %s; you can only edit your own messages", m.ID, m.SenderFullName)},
+		}
+		return
+	}
+
+	withRawContent(m, func(content string) {
+		config.editing = &messageEdit{original: m, content: content, propagateMode: mode}
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Editing message %d", m.ID)},
+		}
+		if m.Type == zulip.PrivateMessage {
+			to := []string{}
+			for _, u := range m.DisplayRecipient.Users {
+				to = append(to, u.Email)
+			}
+			showNewPrivateMessagePrompt(config.ui, zulip.OutgoingPrivateMessage{To: to, Content: content})
+			return
+		}
+		showNewStreamMessagePrompt(config.ui, zulip.OutgoingStreamMessage{
+			Stream:  m.DisplayRecipient.Stream,
+			Topic:   m.Subject,
+			Content: content,
+		})
+	})
+}
+
+// withRawContent calls use with the markdown of m: straight away, unless m was
+// fetched as HTML, in which case the markdown is retrieved from the server first.
+// It must be called from the gocui main loop, and use is called from it too.
+func withRawContent(m zulip.Message, use func(content string)) {
+	if !m.IsHTML() {
+		use(m.Content)
+		return
+	}
+	go func() {
+		content, err := config.zulipClient.GetRawContent(context.Background(), m.ID)
+		if err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot retrieve the markdown of message %d: %v", m.ID, err)},
+			}
+			return
+		}
+		config.ui.Execute(func(g *gocui.Gui) error {
+			use(content)
+			return nil
+		})
+	}()
+}
+
+// editMessage sends the changes made to edit.original in a composer. stream and
+// topic are ignored for private messages.
+func editMessage(edit messageEdit, stream string, topic string, content string) {
+	m := edit.original
+	stream, topic, content = strings.TrimSpace(stream), strings.TrimSpace(topic), strings.TrimRight(content, "\n")
+	if m.Type == zulip.StreamMessage && stream != m.DisplayRecipient.Stream {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: "Messages cannot be moved to another stream"},
+		}
+		return
+	}
+	// Trailing newlines were trimmed from content, so they do not count as a change
+	if content == strings.TrimRight(edit.content, "\n") {
+		content = ""
+	}
+	if m.Type == zulip.PrivateMessage || topic == m.Subject {
+		topic = ""
+	}
+	if content == "" && topic == "" {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Message %d not changed", m.ID)},
+		}
+		return
+	}
+	if err := config.zulipClient.UpdateMessage(context.Background(), m.ID, content, topic, edit.propagateMode); err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Unable to edit message %d: %v", m.ID, err)},
+		}
+		return
+	}
+	config.mainTextChannel <- WindowMessage{
+		Type:    DebugMessage,
+		Message: zulip.Message{Content: fmt.Sprintf("Message %d edited", m.ID)},
+	}
+}
+
+func handleCommandDelete(cmd []string) {
+	idArg := ""
+	confirmed := false
+	for _, arg := range cmd[1:] {
+		switch {
+		case strings.EqualFold(arg, "confirm"):
+			confirmed = true
+		case idArg == "":
+			idArg = arg
+		default:
+			config.mainTextChannel <- WindowMessage{
+				Type:    CommandFeedbackMessage,
+				Message: zulip.Message{Content: "Usage: delete [<message id>] confirm\nWithout a message ID, deletes the selected message or else the last message you sent. Deleting a message cannot be undone, so without confirm it only says which message would be deleted."},
+			}
+			return
+		}
+	}
+	m, err := targetMessage(idArg)
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: err.Error()},
+		}
+		return
+	}
+	if !strings.EqualFold(m.SenderEmail, config.Email) {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Message %d was sent by %s; you can only delete your own messages", m.ID, m.SenderFullName)},
+		}
+		return
+	}
+	if !confirmed {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Deleting message %d cannot be undone; use 'delete %d confirm' to delete it", m.ID, m.ID)},
+		}
+		return
+	}
+
+	go func(channel chan<- WindowMessage) {
+		if err := config.zulipClient.DeleteMessage(context.Background(), m.ID); err != nil {
+			channel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Unable to delete message %d: %v", m.ID, err)},
+			}
+			return
+		}
+		channel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Deleted message %d", m.ID)},
+		}
+	}(config.mainTextChannel)
+}
+
+func handleCommandReact(cmd []string) {
+	if len(cmd) < 2 || len(cmd) > 3 {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: "Usage: react <emoji or :name:> [<message id>]\nWithout a message ID, reacts to the selected message or else the newest message. Reacting again with the same emoji removes your reaction."},
+		}
+		return
+	}
+	emojiName := strings.Trim(cmd[1], ":")
+	if name, ok := emoji.Name(cmd[1]); ok {
+		emojiName = name
+	}
+	idArg := ""
+	if len(cmd) == 3 {
+		idArg = cmd[2]
+	}
+	m, err := targetMessageOrNewest(idArg)
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: err.Error()},
+		}
+		return
+	}
+
+	userID, known := config.roster.userID(config.Email)
+	remove := known && m.HasReaction(userID, emojiName)
+	go func(channel chan<- WindowMessage) {
+		var err error
+		if remove {
+			err = config.zulipClient.RemoveReaction(context.Background(), m.ID, emojiName)
+		} else {
+			err = config.zulipClient.AddReaction(context.Background(), m.ID, emojiName)
+		}
+		if err != nil {
+			channel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Unable to react with :%s: to message %d: %v", emojiName, m.ID, err)},
+			}
+			return
+		}
+		feedback := fmt.Sprintf("Reacted with :%s: to message %d", emojiName, m.ID)
+		if remove {
+			feedback = fmt.Sprintf("Removed your :%s: reaction from message %d", emojiName, m.ID)
+		}
+		channel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: feedback},
+		}
+	}(config.mainTextChannel)
+}
+
+// parseLogDate parses a date given to the log command, in local time
+func parseLogDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02T15:04", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+func handleCommandWho(cmd []string) {
+	all := len(cmd) > 1 && strings.ToLower(cmd[1]) == "all"
+	now := time.Now()
+	byStatus := map[zulip.PresenceStatus][]string{}
+	for _, entry := range config.roster.all() {
+		status, _ := entry.status(now)
+		byStatus[status] = append(byStatus[status], describeRosterEntry(entry, now))
+	}
+	if len(byStatus) == 0 {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: "The list of users has not been loaded; use 'connect' first"},
+		}
+		return
+	}
+
+	ret := fmt.Sprintf("%d active, %d idle, %d offline",
+		len(byStatus[zulip.ActivePresence]),
+		len(byStatus[zulip.IdlePresence]),
+		len(byStatus[zulip.OfflinePresence]))
+	lines := append(byStatus[zulip.ActivePresence], byStatus[zulip.IdlePresence]...)
+	if all {
+		lines = append(lines, byStatus[zulip.OfflinePresence]...)
+	}
+	for _, line := range lines {
+		ret += "\n" + line
+	}
+	if !all && len(byStatus[zulip.OfflinePresence]) > 0 {
+		ret += "\nUse 'who all' to include offline users."
+	}
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: ret},
+	}
+}
+
+func handleCommandWhois(cmd []string) {
+	query := strings.TrimSpace(strings.Join(cmd[1:], " "))
+	if query == "" {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: "Usage: whois <email or part of a name>"},
+		}
+		return
+	}
+	found := config.roster.find(query)
+	if len(found) == 0 {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("No user matches %s", query)},
+		}
+		return
+	}
+
+	now := time.Now()
+	ret := ""
+	for i, entry := range found {
+		if i > 0 {
+			ret += "\n"
+		}
+		ret += describeRosterEntry(entry, now)
+		if entry.person.Timezone != "" {
+			ret += fmt.Sprintf("\n  Timezone: %s", entry.person.Timezone)
+			if loc, err := time.LoadLocation(entry.person.Timezone); err == nil {
+				ret += fmt.Sprintf(" (local time %s)", now.In(loc).Format("15:04"))
+			}
+		}
+		switch {
+		case !entry.person.IsActive:
+			ret += "\n  Deactivated"
+		case entry.person.IsBot:
+			ret += "\n  Bot"
+		case entry.person.IsAdmin:
+			ret += "\n  Administrator"
+		}
+	}
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: ret},
+	}
+}
+
+func handleCommandAway(cmd []string) {
+	away := strings.ToLower(cmd[0]) == "away"
+	setAway(away)
+	ret := "You are now shown as active"
+	if away {
+		ret = "You are now shown as idle until you use 'back'"
+	}
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: ret},
+	}
+}
+
+func handleCommandNarrow(cmd []string) {
+	if len(cmd) < 2 {
+		ret := "Not narrowed; showing all messages"
+		if !config.feed.narrow.isAll() {
+			ret = fmt.Sprintf("Narrowed to %s", config.feed.narrow)
+		}
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: ret + "\nUsage: narrow stream:<stream> [topic:<topic>] | pm:<email>[,<email>...] | search:<text> | off\nsearch: may also follow stream:, topic: or pm:. Searches are fetched from the server, not the cache."},
+		}
+		return
+	}
+	n, err := parseNarrow(cmd[1:])
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot narrow: %v", err)},
+		}
+		return
+	}
+	if err := setNarrow(config.ui, n); err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot narrow: %v", err)},
+		}
+		return
+	}
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: fmt.Sprintf("Narrowed to %s", n)},
+	}
+}
+
+// commandMessage returns the message a command such as reply acts on, reporting an
+// error if there is none
+func commandMessage(cmd []string) (zulip.Message, bool) {
+	idArg := ""
+	if len(cmd) > 1 {
+		idArg = cmd[1]
+	}
+	m, err := targetMessageOrNewest(idArg)
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: err.Error()},
+		}
+		return zulip.Message{}, false
+	}
+	return m, true
+}
+
+func handleCommandReply(cmd []string) {
+	if m, ok := commandMessage(cmd); ok {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Replying to message %d", m.ID)},
+		}
+		composeInConversation(m, "")
+	}
+}
+
+func handleCommandQuote(cmd []string) {
+	if m, ok := commandMessage(cmd); ok {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Quoting message %d", m.ID)},
+		}
+		withRawContent(m, func(content string) {
+			composeInConversation(m, quotation(m, emoji.ToShortcodes(content)))
+		})
+	}
+}
+
+func handleCommandLink(cmd []string) {
+	m, ok := commandMessage(cmd)
+	if !ok {
+		return
+	}
+	link := messageLink(m)
+	copyToClipboard(link)
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: fmt.Sprintf("Link to message %d (copied to the clipboard if your terminal allows): %s", m.ID, link)},
+	}
+}
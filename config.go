@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/casimir/xdg-go"
 	"github.com/codegangsta/cli"
 	"github.com/codegangsta/cli/altsrc"
 	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/cache"
+	"github.com/mjec/clisiana/lib/messagelog"
 	"github.com/mjec/clisiana/lib/notifications"
 	"github.com/mjec/clisiana/lib/zulip"
 )
@@ -35,6 +39,11 @@ type Config struct {
 	Logging              bool   `config-name:"logging"`
 	LogFile              string `config-name:"log-file"`
 	CacheFile            string `config-name:"cache-file"`
+	Backfill             int    `config-name:"backfill"`
+	IdleAfter            int    `config-name:"idle-after"`
+	Sidebar              bool   `config-name:"sidebar"`
+	CodeColors           string `config-name:"code-colors"`
+	MessageFormat        string `config-name:"message-format"`
 
 	// Internal fields
 	xdgApp                         xdg.App
@@ -43,9 +52,17 @@ type Config struct {
 	mainTextChannel                chan WindowMessage
 	outgoingStreamMessagesChannel  chan zulip.OutgoingStreamMessage
 	outgoingPrivateMessagesChannel chan zulip.OutgoingPrivateMessage
-	zulipContext                   *zulip.Context
-	closeConnection                chan bool
+	zulipClient                    *zulip.Client
+	closeConnection                context.CancelFunc
 	notifications                  notifications.Notifier
+	feed                           *mainFeed
+	cache                          *cache.Cache
+	messageLog                     *messagelog.Log
+	editing                        *messageEdit // the edit in progress in a composer, if any
+	streamList                     *streamList  // the stream list view, if it is open
+	roster                         *roster
+	unread                         *unreadMessages
+	sidebar                        *sidebar
 }
 
 // Handles command line arguments and help printing
@@ -157,6 +174,40 @@ Usage: {{.HelpName}} {{if .VisibleFlags}}[options]{{end}}
 			Destination: &config.LogFile,
 			EnvVar:      "CLISIANA_LOG_FILE",
 		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        "backfill",
+			Value:       50,
+			Usage:       "The number of messages of history to load at once",
+			Destination: &config.Backfill,
+			EnvVar:      "CLISIANA_BACKFILL",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:        "idle-after",
+			Value:       5,
+			Usage:       "The number of minutes without input after which you are shown as idle",
+			Destination: &config.IdleAfter,
+			EnvVar:      "CLISIANA_IDLE_AFTER",
+		}),
+		altsrc.NewBoolTFlag(cli.BoolTFlag{
+			Name:        "sidebar",
+			Usage:       "Show the sidebar of streams and conversations at startup (default true, disable by --sidebar=false)",
+			Destination: &config.Sidebar,
+			EnvVar:      "CLISIANA_SIDEBAR",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "code-colors",
+			Usage:       "Colour scheme to highlight code in messages with, one of dark (default), light, bold or none",
+			Value:       "dark",
+			Destination: &config.CodeColors,
+			EnvVar:      "CLISIANA_CODE_COLORS",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:        "message-format",
+			Usage:       "How messages are fetched and displayed, either markdown (default), rendered by clisiana, or html, rendered by the server",
+			Value:       "markdown",
+			Destination: &config.MessageFormat,
+			EnvVar:      "CLISIANA_MESSAGE_FORMAT",
+		}),
 	}
 
 	cliApp.Before = func(context *cli.Context) error {
@@ -170,7 +221,11 @@ Usage: {{.HelpName}} {{if .VisibleFlags}}[options]{{end}}
 			return fmt.Errorf("Base URL is not https but secure is set to true.\nEither pass --secure=false or make sure --site begins with https.")
 		}
 
-		updateZulipContext()
+		if err := checkCodeColors(config.CodeColors); err != nil {
+			return err
+		}
+
+		updateZulipClient()
 		return nil
 	}
 	return *cliApp
@@ -217,13 +272,15 @@ func configFileFromFlags(context *cli.Context) (altsrc.InputSourceContext, error
 	return nil, nil
 }
 
-func updateZulipContext() {
-	config.zulipContext = &zulip.Context{
+// updateZulipClient replaces the Zulip client with one using the current configuration.
+// Connections which are already open keep using the client they were opened with.
+func updateZulipClient() {
+	config.zulipClient = zulip.NewClient(zulip.Context{
 		Email:   config.Email,
 		APIKey:  config.APIKey,
 		APIBase: config.APIBase,
 		Secure:  config.Secure,
-	}
+	})
 }
 
 func setConfigFromStrings(key string, value string) error {
@@ -256,6 +313,15 @@ setConfigFromStringsLoop:
 				default:
 					err = fmt.Errorf("%s is not a valid boolean value", value)
 				}
+			case reflect.Int:
+				n, convErr := strconv.Atoi(strings.TrimSpace(value))
+				if convErr != nil {
+					err = fmt.Errorf("%s is not a valid integer value", value)
+					break setConfigFromStringsLoop
+				}
+				reflectedConfig.Field(i).SetInt(int64(n))
+				err = nil
+				break setConfigFromStringsLoop
 			}
 		}
 	}
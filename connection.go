@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/notifications"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// ConnectionState is an enum of the states of the connection to the Zulip server
+type ConnectionState int
+
+// ConnectionState possibilities
+const (
+	Disconnected ConnectionState = iota // Disconnected means no connection has been made
+	Registering  ConnectionState = iota // Registering means an event queue is being requested
+	Polling      ConnectionState = iota // Polling means events are being retrieved from the queue
+	BackingOff   ConnectionState = iota // BackingOff means we are waiting to retry after an error
+	Closed       ConnectionState = iota // Closed means the connection was closed by the user
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Registering:
+		return "registering"
+	case Polling:
+		return "polling"
+	case BackingOff:
+		return "backing off"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// unauthorizedHelp is shown when the server does not accept our email address and API key
+const unauthorizedHelp = "The server did not accept your email address and API key. " +
+	"Use 'config set email <email>' and 'config set apikey <key>', then 'connect' again."
+
+// connectionEventTypes are the events handled by handleEvent
+const connectionEventTypes = zulip.MessageEvent | zulip.UpdateMessageEvent | zulip.DeleteMessageEvent |
+	zulip.ReactionEvent | zulip.RealmUserEvent | zulip.PresenceEvent | zulip.UpdateMessageFlagsEvent |
+	zulip.SubscriptionsEvent
+
+// Backoff parameters for retrying after a failed request
+const (
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 5 * time.Minute
+)
+
+// connectionStatus is the current state of the connection, for display
+var connectionStatus struct {
+	sync.Mutex
+	state   ConnectionState
+	since   time.Time // when state was entered
+	retryAt time.Time // when the next attempt will be made, if BackingOff
+	lastErr error     // the error which caused us to back off, if BackingOff
+}
+
+// currentConnectionState returns the state of the connection, when it was entered
+// and, if it is BackingOff, when the next attempt will be made and why.
+func currentConnectionState() (state ConnectionState, since time.Time, retryAt time.Time, lastErr error) {
+	connectionStatus.Lock()
+	defer connectionStatus.Unlock()
+	return connectionStatus.state, connectionStatus.since, connectionStatus.retryAt, connectionStatus.lastErr
+}
+
+// connectionStateDescription returns a short, human readable description of the
+// state of the connection
+func connectionStateDescription() string {
+	state, _, retryAt, _ := currentConnectionState()
+	if state == BackingOff {
+		return fmt.Sprintf("%s (retry in %ds)", state, int(retryAt.Sub(time.Now()).Seconds()+0.5))
+	}
+	return state.String()
+}
+
+// rateLimitDescription returns a short, human readable description of the rate limit
+// on requests to the server if it is close to being reached, or "" if it is not
+func rateLimitDescription() string {
+	if config.zulipClient == nil {
+		return ""
+	}
+	limit := config.zulipClient.RateLimit()
+	switch {
+	case limit.Waiting():
+		return fmt.Sprintf("rate limited (%ds)", int(limit.Reset.Sub(time.Now()).Seconds()+0.5))
+	case limit.Low():
+		return fmt.Sprintf("%d/%d requests left", limit.Remaining, limit.Limit)
+	}
+	return ""
+}
+
+// statusDescription returns the text of the status view
+func statusDescription() string {
+	description := connectionStateDescription()
+	if limit := rateLimitDescription(); limit != "" {
+		description += ", " + limit
+	}
+	if unread := unreadDescription(); unread != "" {
+		description += ", " + unread
+	}
+	if narrow := narrowDescription(); narrow != "" {
+		description += ", " + narrow
+	}
+	if presence := presenceDescription(); presence != "" {
+		description += ", " + presence
+	}
+	return description
+}
+
+// redrawWhileCountingDown redraws the interface every second while the status view
+// is counting down to a retry, so that the countdown is kept up to date
+func redrawWhileCountingDown(g *gocui.Gui) {
+	for range time.Tick(time.Second) {
+		state, _, _, _ := currentConnectionState()
+		if state == BackingOff || (config.zulipClient != nil && config.zulipClient.RateLimit().Waiting()) {
+			g.Execute(func(g *gocui.Gui) error { return nil })
+		}
+	}
+}
+
+func setConnectionState(state ConnectionState, retryAt time.Time, lastErr error) {
+	connectionStatus.Lock()
+	connectionStatus.state = state
+	connectionStatus.since = time.Now()
+	connectionStatus.retryAt = retryAt
+	connectionStatus.lastErr = lastErr
+	connectionStatus.Unlock()
+	// Redraw so that the new state is displayed
+	if config.ui != nil {
+		config.ui.Execute(func(g *gocui.Gui) error { return nil })
+	}
+}
+
+// backoffDelay returns how long to wait before the next attempt after the given
+// number of consecutive failures: exponential, capped at maxBackoff and with the
+// top half jittered so that many clients do not retry in lockstep.
+func backoffDelay(failures int) time.Duration {
+	delay := maxBackoff
+	if failures < 30 { // beyond this the shift would overflow
+		if d := initialBackoff << uint(failures-1); d > 0 && d < maxBackoff {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// startReceivingMessages connects to the Zulip server and displays messages as they
+// arrive, until the returned function is called.
+func startReceivingMessages() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	go receiveMessages(ctx, config.zulipClient)
+	go reportPresence(ctx, config.zulipClient)
+	return cancel
+}
+
+// receiveMessages runs the connection state machine:
+//
+//	Registering -> Polling           once a queue is obtained
+//	Polling     -> Registering       when the queue expires
+//	Registering -> BackingOff        on error
+//	Polling     -> BackingOff        on error
+//	BackingOff  -> Registering       after the backoff delay
+//	any         -> Closed            when ctx is done
+func receiveMessages(ctx context.Context, client *zulip.Client) {
+	var queueID string
+	var lastEventID int64
+	// The ID of the newest message received, so that we can catch up on anything
+	// which arrived between one queue expiring and the next being registered.
+	var lastMessageID int64
+	var err error
+	failures := 0
+	state := Registering
+
+	for {
+		if ctx.Err() != nil {
+			state = Closed
+		}
+
+		switch state {
+		case Registering:
+			setConnectionState(Registering, time.Time{}, nil)
+			var unread zulip.UnreadMessages
+			queueID, lastEventID, unread, err = client.Register(ctx, connectionEventTypes, requestHTML())
+			if errors.Is(err, zulip.ErrUnauthorized) {
+				// Retrying will not help
+				config.mainTextChannel <- WindowMessage{Type: ErrorMessage, Message: zulip.Message{Content: unauthorizedHelp}}
+				state = Closed
+				continue
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					config.mainTextChannel <- WindowMessage{
+						Type:    ErrorMessage,
+						Message: zulip.Message{Content: fmt.Sprintf("Cannot register: %v", err)},
+					}
+				}
+				failures++
+				state = BackingOff
+				continue
+			}
+			config.mainTextChannel <- WindowMessage{
+				Type:    DebugMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Queue %s obtained, waiting for messages...", queueID)},
+			}
+			// Likewise for changes to users and their presence, to subscriptions and
+			// to what is unread. Unread messages can only be attributed to conversations
+			// once the roster and subscriptions are loaded.
+			config.unread.clear()
+			go func() {
+				loadRoster(ctx, client)
+				loadUnread(unread, loadSubscriptions(ctx, client))
+			}()
+			// Messages which arrive from now on will be in the queue, so fill in what came before
+			lastMessageID = syncHistory(ctx, client, lastMessageID)
+			state = Polling
+			setConnectionState(Polling, time.Time{}, nil)
+
+		case Polling:
+			var events []zulip.Event
+			events, err = client.GetEvents(ctx, queueID, lastEventID, false)
+			if errors.Is(err, zulip.ErrUnauthorized) {
+				// Retrying will not help
+				config.mainTextChannel <- WindowMessage{Type: ErrorMessage, Message: zulip.Message{Content: unauthorizedHelp}}
+				state = Closed
+				continue
+			}
+			if errors.Is(err, zulip.ErrBadEventQueueID) {
+				// The queue expired (e.g. the computer went to sleep) so get a new one,
+				// which will fetch any messages we missed in the meantime
+				config.mainTextChannel <- WindowMessage{
+					Type:    DebugMessage,
+					Message: zulip.Message{Content: fmt.Sprintf("Queue %s expired, registering a new one...", queueID)},
+				}
+				state = Registering
+				continue
+			}
+			if err != nil {
+				// If this is because of a cancellation we will be closing on the next
+				// iteration, so only show other errors
+				if ctx.Err() == nil {
+					config.mainTextChannel <- WindowMessage{
+						Type:    ErrorMessage,
+						Message: zulip.Message{Content: fmt.Sprintf("%v", err)},
+					}
+				}
+				failures++
+				state = BackingOff
+				continue
+			}
+			failures = 0
+			for i := range events {
+				if events[i].ID > lastEventID {
+					lastEventID = events[i].ID
+				}
+				handleEvent(events[i], &lastMessageID)
+			}
+
+		case BackingOff:
+			delay := backoffDelay(failures)
+			setConnectionState(BackingOff, time.Now().Add(delay), err)
+			select {
+			case <-ctx.Done():
+				state = Closed
+			case <-time.After(delay):
+				// Ask for a new queue, Just In Case the old one is the problem
+				state = Registering
+			}
+
+		case Closed:
+			setConnectionState(Closed, time.Time{}, nil)
+			config.mainTextChannel <- WindowMessage{
+				Type:    DebugMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Closing connection...")},
+			}
+			return
+		}
+	}
+}
+
+// notificationForMessage returns a desktop notification announcing m
+func notificationForMessage(m zulip.Message) notifications.Notification {
+	if m.Type == zulip.PrivateMessage {
+		return notifications.Notification{
+			Title:   fmt.Sprintf("Private message from %s", m.SenderFullName),
+			Content: plainContent(m),
+		}
+	}
+	return notifications.Notification{
+		Title:   fmt.Sprintf("%s in %s > %s", m.SenderFullName, m.DisplayRecipient.Stream, m.Subject),
+		Content: plainContent(m),
+	}
+}
+
+// handleEvent acts on a single event from the event queue, updating lastMessageID if
+// it is a newer message
+func handleEvent(event zulip.Event, lastMessageID *int64) {
+	switch event.Type {
+	case zulip.HeartbeatEvent:
+		break
+	case zulip.MessageEvent:
+		previous := *lastMessageID
+		if event.Message.ID > previous {
+			*lastMessageID = event.Message.ID
+		}
+		storeMessages(event.Message)
+		if previous != 0 && event.Message.ID > previous {
+			// The queue gives us every message, so none are missing since the last
+			recordContiguous(previous, event.Message.ID, false)
+		}
+		if !hasFlag(event.Flags, zulip.ReadFlag) {
+			config.unread.add(event.Message)
+		}
+		switch event.Message.Type {
+		case zulip.StreamMessage:
+			config.notifications.Push(notificationForMessage(event.Message))
+			config.mainTextChannel <- WindowMessage{
+				Type:    StreamMessage,
+				Message: event.Message,
+			}
+		case zulip.PrivateMessage:
+			config.notifications.Push(notificationForMessage(event.Message))
+			config.mainTextChannel <- WindowMessage{
+				Type:    PrivateMessage,
+				Message: event.Message,
+			}
+		}
+	case zulip.UpdateMessageEvent:
+		applyMessageUpdate(event.UpdateMessage)
+	case zulip.DeleteMessageEvent:
+		applyMessageDeletion(event.DeleteMessage)
+	case zulip.ReactionEvent:
+		applyReaction(event.Reaction)
+	case zulip.UpdateMessageFlagsEvent:
+		applyMessageFlags(event.UpdateMessageFlags)
+	case zulip.SubscriptionsEvent:
+		applySubscriptionUpdate(event.Subscription)
+	case zulip.RealmUserEvent:
+		config.roster.applyRealmUser(event.RealmUser)
+	case zulip.PresenceEvent:
+		config.roster.applyPresence(event.Presence)
+	case zulip.RestartEvent:
+		config.mainTextChannel <- WindowMessage{
+			Type:    DebugMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Server restarted (Zulip %s)", event.Restart.ZulipVersion)},
+		}
+	case zulip.UnknownEvent:
+		config.mainTextChannel <- WindowMessage{
+			Type:    DebugMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Ignoring event which could not be decoded: %s", event.Raw)},
+		}
+	default:
+		// Not something we act on
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/markdown"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// mainFeed holds everything displayed in the main view, so that the view can be
+// redrawn when older messages are inserted above those already shown.
+// Its methods must only be called from the gocui main loop (i.e. in a Handler).
+type mainFeed struct {
+	entries         []WindowMessage // oldest first
+	seen            map[int64]bool  // IDs of the zulip messages in entries
+	fetchingHistory bool            // true while a page of history is being retrieved
+	foundOldest     bool            // true once there is no older history to retrieve
+	narrow          narrowing       // which zulip messages are shown
+	selected        int64           // the ID of the selected zulip message, or 0 if none is
+	width           int             // the width of the view the feed was last drawn in
+
+	// Worked out from entries when needed, because formatting every entry on every
+	// redraw is slow once the feed is long. Both are nil when not worked out.
+	starts      []int       // the line each entry starts on, then the line after the last
+	startsWidth int         // the width of view starts were worked out for
+	visible     []int64     // as last returned by visibleMessageIDs
+	visibleArea visibleArea // what visible was worked out for
+}
+
+// visibleArea is the part of the feed a view of a given size shows
+type visibleArea struct {
+	origin, width, height int
+}
+
+func newMainFeed() *mainFeed {
+	return &mainFeed{seen: make(map[int64]bool)}
+}
+
+// reset forgets everything in the feed, e.g. when the main view is cleared
+func (f *mainFeed) reset() {
+	f.entries = []WindowMessage{}
+	f.seen = make(map[int64]bool)
+	f.foundOldest = false
+	f.selected = 0
+	f.changed()
+}
+
+// changed forgets what was worked out from entries, after they change
+func (f *mainFeed) changed() {
+	f.starts = nil
+	f.visible = nil
+}
+
+// narrowTo empties the feed and v, and from then on only shows zulip messages which
+// match n
+func (f *mainFeed) narrowTo(v *gocui.View, n narrowing) {
+	f.reset()
+	f.narrow = n
+	v.Clear()
+	v.Autoscroll = true
+	v.SetOrigin(0, 0)
+}
+
+// add displays m in v. Zulip messages which are already displayed or which do not
+// match the narrow are ignored, and those older than a message already displayed are
+// inserted in ID order.
+func (f *mainFeed) add(v *gocui.View, m WindowMessage) {
+	f.insert(v, []WindowMessage{m})
+}
+
+// insert displays ms in v, as add() does, redrawing v at most once. If the user has
+// scrolled up, the lines they are looking at stay where they are.
+func (f *mainFeed) insert(v *gocui.View, ms []WindowMessage) {
+	width, _ := v.Size()
+	_, oy := v.Origin()
+	top, offset := f.entryAtLine(oy, width)
+	redraw := false
+
+	for _, m := range ms {
+		if m.Message.ID != 0 {
+			if f.seen[m.Message.ID] || !f.narrow.matches(m.Message) {
+				continue
+			}
+			f.seen[m.Message.ID] = true
+		}
+		pos := f.position(m.Message.ID)
+		f.entries = append(f.entries, WindowMessage{})
+		copy(f.entries[pos+1:], f.entries[pos:])
+		f.entries[pos] = m
+		f.visible = nil
+		if pos == len(f.entries)-1 && !redraw {
+			text := formatWindowMessage(m, width)
+			fmt.Fprint(v, text)
+			if f.starts != nil && f.startsWidth == width {
+				f.starts = append(f.starts, f.starts[len(f.starts)-1]+wrappedLineCount(text, width))
+			}
+			continue
+		}
+		f.starts = nil
+		redraw = true
+		if pos <= top {
+			top++
+		}
+	}
+
+	if !redraw {
+		return
+	}
+	f.redraw(v, top, offset)
+}
+
+// update calls change on each of the zulip messages with the given IDs which are in
+// the feed and redraws v. Returns the changed messages.
+func (f *mainFeed) update(v *gocui.View, ids []int64, change func(*zulip.Message)) []zulip.Message {
+	width, _ := v.Size()
+	_, oy := v.Origin()
+	top, offset := f.entryAtLine(oy, width)
+
+	wanted := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	changed := []zulip.Message{}
+	for i := range f.entries {
+		if f.entries[i].Message.ID != 0 && wanted[f.entries[i].Message.ID] {
+			change(&f.entries[i].Message)
+			changed = append(changed, f.entries[i].Message)
+		}
+	}
+	if len(changed) > 0 {
+		f.changed()
+		f.redraw(v, top, offset)
+	}
+	return changed
+}
+
+// remove removes the zulip messages with the given IDs from the feed and redraws v
+func (f *mainFeed) remove(v *gocui.View, ids []int64) {
+	width, _ := v.Size()
+	_, oy := v.Origin()
+	top, offset := f.entryAtLine(oy, width)
+
+	unwanted := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		unwanted[id] = true
+	}
+	kept := f.entries[:0]
+	removed := false
+	for i := range f.entries {
+		if f.entries[i].Message.ID != 0 && unwanted[f.entries[i].Message.ID] {
+			delete(f.seen, f.entries[i].Message.ID)
+			removed = true
+			if i < top {
+				top--
+			} else if i == top {
+				offset = 0
+			}
+			continue
+		}
+		kept = append(kept, f.entries[i])
+	}
+	f.entries = kept
+	if removed {
+		f.changed()
+		f.redraw(v, top, offset)
+	}
+}
+
+// resize redraws v if its width has changed since the feed was last drawn in it,
+// because zulip messages are wrapped to fit the width
+func (f *mainFeed) resize(v *gocui.View) {
+	width, _ := v.Size()
+	if width == f.width {
+		return
+	}
+	f.reformat(v)
+}
+
+// reformat formats every entry afresh and rewrites them to v, keeping the entry at
+// the top of v there, e.g. after a setting which changes how messages look
+func (f *mainFeed) reformat(v *gocui.View) {
+	_, oy := v.Origin()
+	top, _ := f.entryAtLine(oy, f.width)
+	f.width, _ = v.Size()
+	f.changed()
+	f.redraw(v, top, 0)
+}
+
+// redraw rewrites every entry to v. If the user has scrolled up, v is scrolled to
+// offset lines into entries[top].
+func (f *mainFeed) redraw(v *gocui.View, top int, offset int) {
+	width, _ := v.Size()
+	v.Clear()
+	for i := range f.entries {
+		fmt.Fprint(v, formatWindowMessage(f.entries[i], width))
+	}
+	if !v.Autoscroll {
+		v.SetOrigin(0, f.lineOfEntry(top, width)+offset)
+	}
+}
+
+// position returns the index in entries at which a message with the given ID should
+// be inserted. Anything without an ID goes at the end, as does anything newer than
+// every message displayed. Messages older than every message displayed go right at
+// the top, above any feedback which was displayed before them.
+func (f *mainFeed) position(id int64) int {
+	if id == 0 {
+		return len(f.entries)
+	}
+	pos := len(f.entries)
+	foundNewer := false
+	for i := len(f.entries) - 1; i >= 0; i-- {
+		if f.entries[i].Message.ID == 0 {
+			continue
+		}
+		if f.entries[i].Message.ID < id {
+			return pos
+		}
+		pos = i
+		foundNewer = true
+	}
+	if foundNewer {
+		return 0
+	}
+	return pos
+}
+
+// message returns the zulip message in the feed with the given ID, if there is one
+func (f *mainFeed) message(id int64) (zulip.Message, bool) {
+	for i := range f.entries {
+		if f.entries[i].Message.ID == id {
+			return f.entries[i].Message, true
+		}
+	}
+	return zulip.Message{}, false
+}
+
+// lastMessage returns the newest zulip message in the feed, if there is one
+func (f *mainFeed) lastMessage() (zulip.Message, bool) {
+	for i := len(f.entries) - 1; i >= 0; i-- {
+		if f.entries[i].Message.ID != 0 {
+			return f.entries[i].Message, true
+		}
+	}
+	return zulip.Message{}, false
+}
+
+// lastMessageFrom returns the newest zulip message in the feed sent by email, if
+// there is one
+func (f *mainFeed) lastMessageFrom(email string) (zulip.Message, bool) {
+	for i := len(f.entries) - 1; i >= 0; i-- {
+		if f.entries[i].Message.ID != 0 && strings.EqualFold(f.entries[i].Message.SenderEmail, email) {
+			return f.entries[i].Message, true
+		}
+	}
+	return zulip.Message{}, false
+}
+
+// visibleMessageIDs returns the IDs of the zulip messages which are at least partly
+// visible in v. They are only worked out again once v scrolls or the feed changes.
+func (f *mainFeed) visibleMessageIDs(v *gocui.View) []int64 {
+	width, height := v.Size()
+	oy := f.origin(v)
+	area := visibleArea{origin: oy, width: width, height: height}
+	if f.visible != nil && f.visibleArea == area {
+		return f.visible
+	}
+	first, _ := f.entryAtLine(oy, width)
+	last, _ := f.entryAtLine(oy+height-1, width)
+	ids := []int64{}
+	for i := first; i <= last && i < len(f.entries); i++ {
+		if f.entries[i].Message.ID != 0 {
+			ids = append(ids, f.entries[i].Message.ID)
+		}
+	}
+	f.visible, f.visibleArea = ids, area
+	return ids
+}
+
+// selectedMessage returns the selected zulip message, if there is one
+func (f *mainFeed) selectedMessage() (zulip.Message, bool) {
+	if f.selected == 0 {
+		return zulip.Message{}, false
+	}
+	return f.message(f.selected)
+}
+
+// moveSelection selects the zulip message dy messages after the selected one (or
+// before, if dy is negative) and scrolls v so that it is visible. If nothing is
+// selected, the newest message is. Moving up from the oldest message fetches more
+// history.
+func (f *mainFeed) moveSelection(v *gocui.View, dy int) error {
+	indices := []int{}
+	current := -1
+	for i := range f.entries {
+		if f.entries[i].Message.ID == 0 {
+			continue
+		}
+		if f.entries[i].Message.ID == f.selected {
+			current = len(indices)
+		}
+		indices = append(indices, i)
+	}
+	if len(indices) == 0 {
+		return nil
+	}
+	next := len(indices) - 1
+	if current >= 0 {
+		next = current + dy
+	}
+	if next < 0 {
+		next = 0
+		f.requestHistory()
+	}
+	if next >= len(indices) {
+		next = len(indices) - 1
+	}
+	f.selected = f.entries[indices[next]].Message.ID
+	return f.scrollToEntry(v, indices[next])
+}
+
+// scrollToEntry scrolls v as little as possible to make entries[index] visible
+func (f *mainFeed) scrollToEntry(v *gocui.View, index int) error {
+	width, height := v.Size()
+	start := f.lineOfEntry(index, width)
+	end := f.lineOfEntry(index+1, width)
+	oy := f.origin(v)
+	switch {
+	case start < oy:
+		oy = start
+	case end > oy+height:
+		oy = end - height
+		if oy > start {
+			oy = start
+		}
+	}
+	v.Autoscroll = false
+	return v.SetOrigin(0, oy)
+}
+
+// placeSelectionCursor puts the cursor of v on the header of the selected message and
+// highlights it, or turns highlighting off if it is not visible
+func (f *mainFeed) placeSelectionCursor(v *gocui.View) {
+	v.Highlight = false
+	if f.selected == 0 {
+		return
+	}
+	index := -1
+	for i := range f.entries {
+		if f.entries[i].Message.ID == f.selected {
+			index = i
+		}
+	}
+	if index < 0 {
+		// It has been deleted, or the view narrowed
+		f.selected = 0
+		return
+	}
+	width, height := v.Size()
+	line := f.lineOfEntry(index, width)
+	if strings.HasPrefix(formatWindowMessage(f.entries[index], width), "\n") {
+		line++
+	}
+	oy := f.origin(v)
+	if line < oy || line >= oy+height {
+		return
+	}
+	v.Highlight = true
+	v.SetCursor(0, line-oy)
+}
+
+// origin returns the first line of the feed displayed in v
+func (f *mainFeed) origin(v *gocui.View) int {
+	_, oy := v.Origin()
+	if v.Autoscroll {
+		// The origin is only updated when v is drawn, so may not include new messages
+		width, height := v.Size()
+		oy = f.lineCount(width) - height
+		if oy < 0 {
+			oy = 0
+		}
+	}
+	return oy
+}
+
+// oldestMessageID returns the ID of the oldest zulip message in the feed, or
+// zulip.AnchorNewest if there are none.
+func (f *mainFeed) oldestMessageID() int64 {
+	for i := range f.entries {
+		if f.entries[i].Message.ID != 0 {
+			return f.entries[i].Message.ID
+		}
+	}
+	return zulip.AnchorNewest
+}
+
+// lineCount returns the number of lines the feed occupies in a view of the given width
+func (f *mainFeed) lineCount(width int) int {
+	return f.lineOfEntry(len(f.entries), width) + 1 // +1 for the empty line after the final newline
+}
+
+// lineOfEntry returns the line on which entries[index] starts in a view of the given width
+func (f *mainFeed) lineOfEntry(index int, width int) int {
+	starts := f.lineStarts(width)
+	if index > len(f.entries) {
+		index = len(f.entries)
+	}
+	return starts[index]
+}
+
+// entryAtLine returns the index of the entry displayed on the given line in a view
+// of the given width, and how far into that entry the line is.
+func (f *mainFeed) entryAtLine(line int, width int) (index int, offset int) {
+	starts := f.lineStarts(width)
+	index = sort.Search(len(f.entries), func(i int) bool { return line < starts[i+1] })
+	if index == len(f.entries) {
+		return index, 0
+	}
+	return index, line - starts[index]
+}
+
+// lineStarts returns the line on which each entry starts in a view of the given
+// width, followed by the line after the last entry
+func (f *mainFeed) lineStarts(width int) []int {
+	if f.starts != nil && f.startsWidth == width {
+		return f.starts
+	}
+	f.starts = make([]int, len(f.entries)+1)
+	for i := range f.entries {
+		f.starts[i+1] = f.starts[i] + wrappedLineCount(formatWindowMessage(f.entries[i], width), width)
+	}
+	f.startsWidth = width
+	return f.starts
+}
+
+// wrappedLineCount returns the number of lines text (which ends in a newline) takes
+// up when written to a view of the given width with Wrap set. Escape codes take up
+// no room.
+func wrappedLineCount(text string, width int) int {
+	if text == "" {
+		return 0
+	}
+	lines := strings.Split(strings.TrimSuffix(markdown.Strip(text), "\n"), "\n")
+	if width < 1 {
+		return len(lines)
+	}
+	count := 0
+	for _, l := range lines {
+		count += (utf8.RuneCountInString(l) + width - 1) / width
+		if l == "" {
+			count++
+		}
+	}
+	return count
+}
+
+// requestHistory starts fetching the page of history before the oldest message in the
+// feed, unless that is already happening or there is nothing more to fetch.
+func (f *mainFeed) requestHistory() {
+	if f.fetchingHistory || f.foundOldest || (config.closeConnection == nil && config.cache == nil) {
+		return
+	}
+	f.fetchingHistory = true
+	go fetchHistory(f.oldestMessageID(), f.narrow)
+}
+
+// scrollMainView scrolls the main view by dy lines, fetching older history when the
+// user scrolls past the top and following new messages again once they scroll back
+// to the bottom.
+func scrollMainView(g *gocui.Gui, dy int) error {
+	v, err := g.View("main")
+	if err != nil {
+		return err
+	}
+	width, height := v.Size()
+	bottom := config.feed.lineCount(width) - height
+	if bottom < 0 {
+		bottom = 0
+	}
+	_, oy := v.Origin()
+	if v.Autoscroll {
+		oy = bottom
+	}
+	oy += dy
+	if oy <= 0 {
+		oy = 0
+		config.feed.requestHistory()
+	}
+	if oy >= bottom {
+		v.Autoscroll = true
+		return nil
+	}
+	v.Autoscroll = false
+	return v.SetOrigin(0, oy)
+}
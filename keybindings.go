@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/emoji"
 )
 
 func setGlobalKeybindings(g *gocui.Gui) error {
@@ -16,13 +17,126 @@ func setGlobalKeybindings(g *gocui.Gui) error {
 	if err := g.SetKeybinding("", gocui.KeyF1, gocui.ModNone, showHelp); err != nil {
 		return err
 	}
+	if err := g.SetKeybinding("", gocui.KeyF2, gocui.ModNone, recordingInput(toggleSidebar)); err != nil {
+		return err
+	}
 	return nil
 }
 
 func setCmdViewKeybindings(g *gocui.Gui, viewName string) error {
+	if err := g.SetKeybinding(viewName, gocui.KeyPgup, gocui.ModNone, recordingInput(scrollMainViewUp)); err != nil {
+		return err
+	}
+	if err := g.SetKeybinding(viewName, gocui.KeyPgdn, gocui.ModNone, recordingInput(scrollMainViewDown)); err != nil {
+		return err
+	}
+	if err := g.SetKeybinding(viewName, gocui.KeyTab, gocui.ModNone, recordingInput(focusSidebar)); err != nil {
+		return err
+	}
+	if err := g.SetKeybinding(viewName, gocui.KeyArrowUp, gocui.ModNone, recordingInput(enterSelectionMode)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func setStreamListKeybindings(g *gocui.Gui, viewName string) error {
+	bindings := []struct {
+		key     interface{}
+		handler gocui.KeybindingHandler
+	}{
+		{gocui.KeyArrowUp, streamListCursorUp},
+		{'k', streamListCursorUp},
+		{gocui.KeyArrowDown, streamListCursorDown},
+		{'j', streamListCursorDown},
+		{gocui.KeyEnter, toggleStreamListSubscription},
+		{gocui.KeySpace, toggleStreamListSubscription},
+		{'m', showStreamListMembers},
+		{gocui.KeyEsc, closeStreamList},
+		{'q', closeStreamList},
+	}
+	for _, b := range bindings {
+		if err := g.SetKeybinding(viewName, b.key, gocui.ModNone, recordingInput(b.handler)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setMainViewKeybindings(g *gocui.Gui, viewName string) error {
+	bindings := []struct {
+		key     interface{}
+		handler gocui.KeybindingHandler
+	}{
+		{gocui.KeyArrowUp, selectionUp},
+		{'k', selectionUp},
+		{gocui.KeyArrowDown, selectionDown},
+		{'j', selectionDown},
+		{gocui.KeyPgup, scrollMainViewUp},
+		{gocui.KeyPgdn, scrollMainViewDown},
+		{gocui.KeyEnter, replyToSelection},
+		{'r', replyToSelection},
+		{'q', quoteSelection},
+		{'e', editSelection},
+		{'c', copySelectionLink},
+		{gocui.KeyEsc, cancelSelection},
+		{gocui.KeyTab, leaveSelectionMode},
+	}
+	for _, b := range bindings {
+		if err := g.SetKeybinding(viewName, b.key, gocui.ModNone, recordingInput(b.handler)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func setSidebarKeybindings(g *gocui.Gui, viewName string) error {
+	bindings := []struct {
+		key     interface{}
+		handler gocui.KeybindingHandler
+	}{
+		{gocui.KeyArrowUp, sidebarCursorUp},
+		{'k', sidebarCursorUp},
+		{gocui.KeyArrowDown, sidebarCursorDown},
+		{'j', sidebarCursorDown},
+		{gocui.KeyEnter, selectSidebarRow},
+		{gocui.KeySpace, selectSidebarRow},
+		{gocui.KeyTab, unfocusSidebar},
+		{gocui.KeyEsc, unfocusSidebar},
+	}
+	for _, b := range bindings {
+		if err := g.SetKeybinding(viewName, b.key, gocui.ModNone, recordingInput(b.handler)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func streamListCursorUp(g *gocui.Gui, v *gocui.View) error {
+	return moveStreamListCursor(v, -1)
+}
+
+func streamListCursorDown(g *gocui.Gui, v *gocui.View) error {
+	return moveStreamListCursor(v, 1)
+}
+
+func scrollMainViewUp(g *gocui.Gui, v *gocui.View) error {
+	main, err := g.View("main")
+	if err != nil {
+		return err
+	}
+	_, height := main.Size()
+	return scrollMainView(g, -height/2)
+}
+
+func scrollMainViewDown(g *gocui.Gui, v *gocui.View) error {
+	main, err := g.View("main")
+	if err != nil {
+		return err
+	}
+	_, height := main.Size()
+	return scrollMainView(g, height/2)
+}
+
 func clearCmdView() error {
 	v, err := config.ui.View("cmd")
 	if err != nil {
@@ -104,13 +218,48 @@ func cuiStreamMessageContentEditor(v *gocui.View, key gocui.Key, ch rune, mod go
 	}
 }
 
+func cuiPrivateMessageRecipientsEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	switch {
+	case key == gocui.KeyEsc:
+		if len(v.Buffer()) > 0 {
+			clearCurrentView()
+		} else {
+			destroyPrivateMessagePrompt()
+		}
+	case key == gocui.KeyEnter:
+		config.ui.Execute(func(g *gocui.Gui) error {
+			return g.SetCurrentView("private-view-content")
+		})
+	default:
+		cuiCommonEditor(v, key, ch, mod, false, "private-view-content")
+	}
+}
+
+func cuiPrivateMessageContentEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	switch {
+	case key == gocui.KeyEsc:
+		if len(v.Buffer()) > 0 {
+			clearCurrentView()
+		} else {
+			destroyPrivateMessagePrompt()
+		}
+	case key == gocui.KeyEnter:
+		v.EditNewLine()
+	case key == gocui.KeyCtrlD, key == gocui.KeyCtrlS:
+		sendPrivateMessageFromPrompt()
+		destroyPrivateMessagePrompt()
+	default:
+		cuiCommonEditor(v, key, ch, mod, true, "private-view-recipients")
+	}
+}
+
 func cuiCmdEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
 	switch {
 	case key == gocui.KeyEsc:
 		if len(v.Buffer()) > 0 {
 			clearCurrentView()
 		} else {
-			// toggle view?
+			clearSelection()
 		}
 	// case key == gocui.KeyCtrlE:
 	// 	v.MoveCursor(dx, dy, writeMode)
@@ -145,7 +294,7 @@ func cuiCmdEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
 func cuiCommonEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier, updown bool, nextView string) {
 	switch {
 	case ch != 0 && mod == 0:
-		v.EditWrite(ch)
+		editWriteRune(v, ch)
 	case key == gocui.KeySpace:
 		v.EditWrite(' ')
 	case key == gocui.KeyCtrlH:
@@ -178,3 +327,72 @@ func cuiCommonEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier,
 		}
 	}
 }
+
+// writtenEmoji is the emoji most recently written to a composer. It is remembered so
+// that an emoji written as its shortcode can be written as itself after all if the
+// next rune joins it into a sequence (e.g. a thumbs up followed by a skin tone, when
+// both are pasted), and so that an emoji after a zero width joiner is left alone.
+type writtenEmoji struct {
+	view      *gocui.View
+	glyph     string // including any presentation selector
+	shortcode string // empty if the glyph was written as it is
+	cx, cy    int    // where the cursor was left
+	ox, oy    int    // and the origin
+}
+
+// lastEmoji is the emoji most recently written to a composer, or nil if anything else
+// has been written since. Only used from the gocui main loop.
+var lastEmoji *writtenEmoji
+
+// editWriteRune writes ch at the cursor in v. An emoji is written as its :shortcode:,
+// which the server turns back into the emoji, because a composer cannot show a glyph
+// two columns wide. Emoji in a sequence are written as they are.
+func editWriteRune(v *gocui.View, ch rune) {
+	last := lastEmoji
+	lastEmoji = nil
+	if last != nil && !last.at(v) {
+		last = nil
+	}
+
+	written := string(ch)
+	switch {
+	case last != nil && last.shortcode != "" && ch == '\ufe0f':
+		// A presentation selector, which the shortcode has no need of unless the
+		// emoji turns out to be part of a sequence
+		last.glyph += written
+		lastEmoji = last
+		return
+	case last != nil && last.shortcode != "" && emoji.Joins(ch):
+		for range last.shortcode {
+			v.EditDelete(true)
+		}
+		written = last.glyph + written
+	case last != nil && last.shortcode == "":
+		// Joined to the emoji before it
+	default:
+		written = emoji.ToShortcodes(written)
+		if written != string(ch) {
+			lastEmoji = &writtenEmoji{glyph: string(ch), shortcode: written}
+		}
+	}
+	for _, r := range written {
+		v.EditWrite(r)
+	}
+
+	if ch == '\u200d' {
+		// A zero width joiner, so the next emoji is part of the same sequence
+		lastEmoji = &writtenEmoji{glyph: string(ch)}
+	}
+	if lastEmoji != nil {
+		lastEmoji.view = v
+		lastEmoji.cx, lastEmoji.cy = v.Cursor()
+		lastEmoji.ox, lastEmoji.oy = v.Origin()
+	}
+}
+
+// at returns true if e was written to v and its cursor has not moved since
+func (e *writtenEmoji) at(v *gocui.View) bool {
+	cx, cy := v.Cursor()
+	ox, oy := v.Origin()
+	return e.view == v && cx == e.cx && cy == e.cy && ox == e.ox && oy == e.oy
+}
@@ -0,0 +1,311 @@
+package cache
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+
+	// Registers the sqlite3 driver with database/sql
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// schema is run every time the cache is opened, so must be idempotent
+const schema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id           INTEGER PRIMARY KEY,
+	type         TEXT NOT NULL,
+	stream       TEXT NOT NULL,
+	topic        TEXT NOT NULL,
+	pm_with      TEXT NOT NULL,
+	sender_email TEXT NOT NULL,
+	timestamp    INTEGER NOT NULL,
+	data         TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_stream_topic ON messages (stream, topic);
+CREATE INDEX IF NOT EXISTS messages_pm_with ON messages (pm_with);
+CREATE INDEX IF NOT EXISTS messages_sender_email ON messages (sender_email);
+CREATE INDEX IF NOT EXISTS messages_timestamp ON messages (timestamp);
+CREATE TABLE IF NOT EXISTS ranges (
+	first INTEGER NOT NULL,
+	last  INTEGER NOT NULL
+);
+`
+
+// Cache is a persistent store of Zulip messages, backed by an SQLite3 database
+type Cache struct {
+	db *sql.DB
+}
+
+// Open opens (creating if necessary) the cache stored in the file at path
+func Open(path string) (*Cache, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time, so avoid "database is locked" errors
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Cache{db: db}, nil
+}
+
+// Close closes the underlying database
+func (c *Cache) Close() error {
+	return c.db.Close()
+}
+
+// Store adds messages to the cache, replacing any cached message with the same ID
+func (c *Cache) Store(messages ...zulip.Message) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO messages
+		(id, type, stream, topic, pm_with, sender_email, timestamp, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for i := range messages {
+		data, err := json.Marshal(messages[i])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		messageType := "stream"
+		if messages[i].Type == zulip.PrivateMessage {
+			messageType = "private"
+		}
+		if _, err = stmt.Exec(messages[i].ID,
+			messageType,
+			messages[i].DisplayRecipient.Stream,
+			messages[i].Subject,
+			PMWith(messages[i]),
+			messages[i].SenderEmail,
+			messages[i].Timestamp,
+			string(data)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddRange records that the cache holds every message with an ID from first to last
+// inclusive, merging the range with any it overlaps
+func (c *Cache) AddRange(first int64, last int64) error {
+	if first > last {
+		return nil
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	var lowest, highest sql.NullInt64
+	if err = tx.QueryRow("SELECT MIN(first), MAX(last) FROM ranges WHERE first <= ? AND last >= ?", last, first).Scan(&lowest, &highest); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if lowest.Valid && lowest.Int64 < first {
+		first = lowest.Int64
+	}
+	if highest.Valid && highest.Int64 > last {
+		last = highest.Int64
+	}
+	if _, err = tx.Exec("DELETE FROM ranges WHERE first >= ? AND last <= ?", first, last); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO ranges (first, last) VALUES (?, ?)", first, last); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Covers returns true if the cache holds every message with an ID from first to last
+// inclusive, as recorded by AddRange
+func (c *Cache) Covers(first int64, last int64) (bool, error) {
+	var n int
+	if err := c.db.QueryRow("SELECT COUNT(*) FROM ranges WHERE first <= ? AND last >= ?", first, last).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Latest returns up to n of the newest messages in the cache, oldest first
+func (c *Cache) Latest(n int) ([]zulip.Message, error) {
+	return c.Before(math.MaxInt64, n)
+}
+
+// Filter restricts the messages returned by BeforeMatching to one conversation. Empty
+// fields match every message. Stream and Topic are compared ignoring case.
+type Filter struct {
+	Stream string
+	Topic  string
+	PMWith string // in the form returned by PMWith
+}
+
+// Conversation is a topic of a stream or a private message conversation in the
+// cache, along with the ID of its newest message
+type Conversation struct {
+	Stream   string // empty for private messages
+	Topic    string // empty for private messages
+	PMWith   string // in the form returned by PMWith, or empty for stream messages
+	NewestID int64
+}
+
+// Before returns up to n of the messages in the cache with an ID less than id, oldest first
+func (c *Cache) Before(id int64, n int) ([]zulip.Message, error) {
+	return c.BeforeMatching(id, n, Filter{})
+}
+
+// BeforeMatching returns up to n of the messages in the cache with an ID less than id
+// which match f, oldest first
+func (c *Cache) BeforeMatching(id int64, n int, f Filter) ([]zulip.Message, error) {
+	query := "SELECT data FROM messages WHERE id < ?"
+	args := []interface{}{id}
+	if f.Stream != "" {
+		query += " AND type = 'stream' AND stream = ? COLLATE NOCASE"
+		args = append(args, f.Stream)
+	}
+	if f.Topic != "" {
+		query += " AND topic = ? COLLATE NOCASE"
+		args = append(args, f.Topic)
+	}
+	if f.PMWith != "" {
+		query += " AND type = 'private' AND pm_with = ?"
+		args = append(args, f.PMWith)
+	}
+	rows, err := c.db.Query(query+" ORDER BY id DESC LIMIT ?", append(args, n)...)
+	if err != nil {
+		return []zulip.Message{}, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return []zulip.Message{}, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// Get returns those of the messages with the given IDs which are in the cache, oldest first
+func (c *Cache) Get(ids ...int64) ([]zulip.Message, error) {
+	if len(ids) == 0 {
+		return []zulip.Message{}, nil
+	}
+	rows, err := c.db.Query("SELECT data FROM messages WHERE id IN ("+placeholders(len(ids))+") ORDER BY id", int64sToArgs(ids)...)
+	if err != nil {
+		return []zulip.Message{}, err
+	}
+	return scanMessages(rows)
+}
+
+// Delete removes the messages with the given IDs from the cache
+func (c *Cache) Delete(ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := c.db.Exec("DELETE FROM messages WHERE id IN ("+placeholders(len(ids))+")", int64sToArgs(ids)...)
+	return err
+}
+
+// RecentConversations returns up to n of the conversations in the cache, those with
+// the newest messages first
+func (c *Cache) RecentConversations(n int) ([]Conversation, error) {
+	rows, err := c.db.Query(`SELECT stream, topic, pm_with, MAX(id) AS newest FROM messages
+		GROUP BY type, stream, topic, pm_with ORDER BY newest DESC LIMIT ?`, n)
+	if err != nil {
+		return []Conversation{}, err
+	}
+	defer rows.Close()
+	conversations := []Conversation{}
+	for rows.Next() {
+		var conversation Conversation
+		if err := rows.Scan(&conversation.Stream, &conversation.Topic, &conversation.PMWith, &conversation.NewestID); err != nil {
+			return conversations, err
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+// NewestID returns the ID of the newest message in the cache, or 0 if it is empty
+func (c *Cache) NewestID() (int64, error) {
+	var id sql.NullInt64
+	if err := c.db.QueryRow("SELECT MAX(id) FROM messages").Scan(&id); err != nil {
+		return 0, err
+	}
+	return id.Int64, nil
+}
+
+// PMWith returns the sorted, comma separated email addresses of everyone in a private
+// message conversation, or an empty string for a stream message.
+func PMWith(m zulip.Message) string {
+	if m.Type != zulip.PrivateMessage {
+		return ""
+	}
+	emails := make([]string, len(m.DisplayRecipient.Users))
+	for i := range m.DisplayRecipient.Users {
+		emails[i] = m.DisplayRecipient.Users[i].Email
+	}
+	return PMWithEmails(emails)
+}
+
+// PMWithEmails returns the sorted, comma separated email addresses of everyone in a
+// private message conversation between the given email addresses, in the form
+// returned by PMWith.
+func PMWithEmails(emails []string) string {
+	seen := make(map[string]bool, len(emails))
+	lowered := []string{}
+	for _, email := range emails {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email != "" && !seen[email] {
+			seen[email] = true
+			lowered = append(lowered, email)
+		}
+	}
+	sort.Strings(lowered)
+	return strings.Join(lowered, ",")
+}
+
+// placeholders returns n comma separated placeholders for an SQL query
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// int64sToArgs converts ids to arguments for an SQL query
+func int64sToArgs(ids []int64) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i := range ids {
+		args[i] = ids[i]
+	}
+	return args
+}
+
+// scanMessages decodes the data column of every row into a message, then closes rows
+func scanMessages(rows *sql.Rows) ([]zulip.Message, error) {
+	defer rows.Close()
+	messages := []zulip.Message{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return messages, err
+		}
+		var m zulip.Message
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			return messages, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// ranges returns the ranges recorded in c, in order
+func ranges(t *testing.T, c *Cache) string {
+	rows, err := c.db.Query("SELECT first, last FROM ranges ORDER BY first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	s := ""
+	for rows.Next() {
+		var first, last int64
+		if err := rows.Scan(&first, &last); err != nil {
+			t.Fatal(err)
+		}
+		s += fmt.Sprintf("[%d,%d]", first, last)
+	}
+	return s
+}
+
+func TestAddRange(t *testing.T) {
+	tests := []struct {
+		add  [][2]int64
+		want string
+	}{
+		{[][2]int64{{10, 20}}, "[10,20]"},
+		{[][2]int64{{10, 20}, {15, 30}}, "[10,30]"},
+		{[][2]int64{{10, 20}, {5, 10}}, "[5,20]"},
+		{[][2]int64{{10, 20}, {12, 18}}, "[10,20]"},
+		{[][2]int64{{10, 20}, {1, 100}}, "[1,100]"},
+		// Ranges which meet without overlapping are not merged
+		{[][2]int64{{10, 20}, {21, 30}}, "[10,20][21,30]"},
+		{[][2]int64{{10, 20}, {30, 40}, {15, 35}}, "[10,40]"},
+		{[][2]int64{{10, 20}, {30, 40}, {50, 60}, {20, 50}}, "[10,60]"},
+		{[][2]int64{{10, 20}, {30, 20}}, "[10,20]"},
+	}
+	for _, tt := range tests {
+		c, err := Open(filepath.Join(t.TempDir(), "cache.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range tt.add {
+			if err := c.AddRange(r[0], r[1]); err != nil {
+				t.Fatalf("AddRange(%d, %d) = %v", r[0], r[1], err)
+			}
+		}
+		if got := ranges(t, c); got != tt.want {
+			t.Errorf("after adding %v, ranges are %s, want %s", tt.add, got, tt.want)
+		}
+		c.Close()
+	}
+}
+
+func TestCovers(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.AddRange(10, 20)
+	c.AddRange(21, 30)
+
+	for r, want := range map[[2]int64]bool{
+		{10, 20}: true,
+		{12, 12}: true,
+		{21, 30}: true,
+		{5, 15}:  false,
+		{15, 25}: false, // both ends are cached, but not by the same range
+		{31, 40}: false,
+	} {
+		got, err := c.Covers(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Covers(%d, %d) = %v, want %v", r[0], r[1], got, want)
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package emoji
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// emoji is an emoji's code points, as Zulip gives them (e.g. "1f419"), and its names.
+// The first name is the one Zulip uses; the rest are aliases used elsewhere.
+type emoji struct {
+	code  string
+	names []string
+}
+
+// table is every emoji with a name. Only emoji of one code point are included,
+// because a terminal may show a sequence of several as separate glyphs.
+var table = []emoji{
+	// Faces
+	{"1f600", []string{"grinning"}},
+	{"1f603", []string{"smiley", "happy"}},
+	{"1f604", []string{"big_smile"}},
+	{"1f601", []string{"grinning_face_with_smiling_eyes", "grin"}},
+	{"1f606", []string{"laughing", "lol", "satisfied"}},
+	{"1f605", []string{"sweat_smile"}},
+	{"1f602", []string{"joy", "tears"}},
+	{"1f923", []string{"rolling_on_the_floor_laughing", "rofl"}},
+	{"263a", []string{"smiling_face", "relaxed"}},
+	{"1f60a", []string{"blush"}},
+	{"1f607", []string{"innocent", "halo"}},
+	{"1f642", []string{"smile", "slightly_smiling_face"}},
+	{"1f643", []string{"upside_down", "oops"}},
+	{"1f609", []string{"wink"}},
+	{"1f60c", []string{"relieved"}},
+	{"1f60d", []string{"heart_eyes", "in_love"}},
+	{"1f970", []string{"smiling_face_with_hearts"}},
+	{"1f618", []string{"heart_kiss", "blow_a_kiss", "kissing_heart"}},
+	{"1f617", []string{"kiss", "kissing"}},
+	{"1f60b", []string{"yum"}},
+	{"1f61b", []string{"stuck_out_tongue"}},
+	{"1f61c", []string{"stuck_out_tongue_wink", "stuck_out_tongue_winking_eye"}},
+	{"1f61d", []string{"stuck_out_tongue_closed_eyes"}},
+	{"1f911", []string{"money_face", "money_mouth_face"}},
+	{"1f917", []string{"hug", "arms_open", "hugs"}},
+	{"1f913", []string{"nerd", "nerd_face"}},
+	{"1f60e", []string{"sunglasses"}},
+	{"1f929", []string{"star_struck"}},
+	{"1f973", []string{"partying_face", "party_face"}},
+	{"1f921", []string{"clown", "clown_face"}},
+	{"1f920", []string{"cowboy", "cowboy_hat_face"}},
+	{"1f60f", []string{"smirk"}},
+	{"1f612", []string{"unamused"}},
+	{"1f61e", []string{"disappointed"}},
+	{"1f614", []string{"pensive"}},
+	{"1f61f", []string{"worried"}},
+	{"1f615", []string{"confused"}},
+	{"1f641", []string{"frown", "slightly_frowning_face"}},
+	{"2639", []string{"sad", "frowning_face"}},
+	{"1f623", []string{"persevere"}},
+	{"1f616", []string{"confounded"}},
+	{"1f62b", []string{"tired_face"}},
+	{"1f629", []string{"weary", "distraught"}},
+	{"1f97a", []string{"pleading", "pleading_face"}},
+	{"1f624", []string{"triumph"}},
+	{"1f620", []string{"angry"}},
+	{"1f621", []string{"rage", "mad", "pout"}},
+	{"1f92f", []string{"exploding_head", "mind_blown"}},
+	{"1f636", []string{"speechless", "no_mouth"}},
+	{"1f610", []string{"neutral", "neutral_face"}},
+	{"1f611", []string{"expressionless"}},
+	{"1f62f", []string{"hushed"}},
+	{"1f626", []string{"frowning"}},
+	{"1f627", []string{"anguished"}},
+	{"1f62e", []string{"open_mouth", "surprise"}},
+	{"1f632", []string{"astonished"}},
+	{"1f635", []string{"dizzy", "dizzy_face"}},
+	{"1f633", []string{"flushed", "embarrassed"}},
+	{"1f631", []string{"scream"}},
+	{"1f628", []string{"fear", "scared", "fearful"}},
+	{"1f630", []string{"cold_sweat"}},
+	{"1f622", []string{"cry"}},
+	{"1f625", []string{"disappointed_relieved"}},
+	{"1f924", []string{"drooling", "drooling_face"}},
+	{"1f62d", []string{"sob"}},
+	{"1f613", []string{"sweat"}},
+	{"1f62a", []string{"sleepy"}},
+	{"1f634", []string{"sleeping"}},
+	{"1f971", []string{"yawn", "yawning_face"}},
+	{"1f644", []string{"rolling_eyes", "roll_eyes"}},
+	{"1f914", []string{"thinking"}},
+	{"1f928", []string{"raised_eyebrow"}},
+	{"1f9d0", []string{"monocle", "monocle_face"}},
+	{"1f925", []string{"lying", "lying_face"}},
+	{"1f62c", []string{"grimacing", "nervous"}},
+	{"1f910", []string{"silence", "zipper_mouth_face"}},
+	{"1f92b", []string{"shush", "shushing_face"}},
+	{"1f92d", []string{"hand_over_mouth"}},
+	{"1f922", []string{"nauseated", "sick", "nauseated_face"}},
+	{"1f92e", []string{"vomit", "vomiting_face"}},
+	{"1f927", []string{"sneezing", "sneezing_face"}},
+	{"1f637", []string{"mask"}},
+	{"1f912", []string{"thermometer_face", "face_with_thermometer"}},
+	{"1f915", []string{"hurt", "head_bandage"}},
+	{"1f974", []string{"woozy", "woozy_face"}},
+	{"1f975", []string{"hot", "hot_face"}},
+	{"1f976", []string{"cold", "cold_face"}},
+	{"1f608", []string{"smiling_devil", "smiling_imp"}},
+	{"1f47f", []string{"devil", "angry_devil", "imp"}},
+	{"1f479", []string{"ogre", "japanese_ogre"}},
+	{"1f47a", []string{"goblin", "japanese_goblin"}},
+	{"1f4a9", []string{"poop", "hankey", "shit"}},
+	{"1f47b", []string{"ghost"}},
+	{"1f480", []string{"skull"}},
+	{"1f47d", []string{"alien"}},
+	{"1f47e", []string{"space_invader"}},
+	{"1f916", []string{"robot"}},
+	{"1f383", []string{"jack-o-lantern", "jack_o_lantern"}},
+	{"1f63a", []string{"smiley_cat"}},
+	{"1f638", []string{"smile_cat"}},
+	{"1f639", []string{"joy_cat"}},
+	{"1f63b", []string{"heart_eyes_cat"}},
+	{"1f648", []string{"see_no_evil"}},
+	{"1f649", []string{"hear_no_evil"}},
+	{"1f64a", []string{"speak_no_evil"}},
+
+	// People and gestures
+	{"1f44d", []string{"+1", "thumbs_up", "like", "thumbsup"}},
+	{"1f44e", []string{"-1", "thumbs_down", "thumbsdown"}},
+	{"1f44c", []string{"ok", "ok_hand"}},
+	{"1f44f", []string{"clap", "applause"}},
+	{"1f64c", []string{"raised_hands", "hooray"}},
+	{"1f44b", []string{"wave", "hello", "hi"}},
+	{"1f64f", []string{"pray", "folded_hands"}},
+	{"1f91d", []string{"handshake", "done_deal"}},
+	{"1f4aa", []string{"muscle", "strong"}},
+	{"270c", []string{"victory", "peace_sign", "v"}},
+	{"1f91e", []string{"fingers_crossed", "crossed_fingers"}},
+	{"1f918", []string{"rock_on", "metal"}},
+	{"1f919", []string{"call_me", "call_me_hand"}},
+	{"1f448", []string{"point_left"}},
+	{"1f449", []string{"point_right"}},
+	{"1f446", []string{"point_up", "point_up_2"}},
+	{"1f447", []string{"point_down"}},
+	{"270b", []string{"raised_hand", "hand", "high_five"}},
+	{"270a", []string{"fist", "power"}},
+	{"1f44a", []string{"punch", "fist_bump", "facepunch"}},
+	{"1f440", []string{"eyes", "looking"}},
+	{"1f445", []string{"tongue"}},
+	{"1f444", []string{"lips", "mouth"}},
+	{"1f9e0", []string{"brain"}},
+	{"1f476", []string{"baby"}},
+	{"1f937", []string{"shrug"}},
+	{"1f926", []string{"facepalm"}},
+	{"1f645", []string{"gesturing_no", "no_good"}},
+	{"1f64b", []string{"raising_hand"}},
+	{"1f483", []string{"dancer", "dancing"}},
+	{"1f57a", []string{"man_dancing"}},
+	{"1f3c3", []string{"running", "runner"}},
+	{"1f6b6", []string{"walking"}},
+	{"1f6b4", []string{"cyclist", "bicyclist"}},
+	{"1f3c4", []string{"surf", "surfer"}},
+	{"1f3ca", []string{"swim", "swimmer"}},
+	{"1f385", []string{"santa"}},
+	{"1f451", []string{"crown"}},
+	{"1f393", []string{"graduate", "mortar_board"}},
+
+	// Hearts and symbols
+	{"2764", []string{"heart", "love"}},
+	{"1f494", []string{"broken_heart"}},
+	{"1f495", []string{"two_hearts"}},
+	{"1f496", []string{"sparkling_heart"}},
+	{"1f497", []string{"heart_pulse", "growing_heart", "heartpulse"}},
+	{"1f499", []string{"blue_heart"}},
+	{"1f49a", []string{"green_heart"}},
+	{"1f49b", []string{"yellow_heart"}},
+	{"1f49c", []string{"purple_heart"}},
+	{"1f9e1", []string{"orange_heart"}},
+	{"1f5a4", []string{"black_heart"}},
+	{"1f90d", []string{"white_heart"}},
+	{"1f4af", []string{"100", "hundred"}},
+	{"1f525", []string{"fire", "lit"}},
+	{"2728", []string{"sparkles", "glamour"}},
+	{"2b50", []string{"star"}},
+	{"1f31f", []string{"glowing_star", "star2"}},
+	{"26a1", []string{"zap", "high_voltage"}},
+	{"1f4a5", []string{"boom", "collision"}},
+	{"1f4a2", []string{"anger"}},
+	{"1f4a4", []string{"zzz"}},
+	{"1f4a6", []string{"sweat_drops"}},
+	{"1f4a8", []string{"dash"}},
+	{"1f4ac", []string{"speech_bubble", "speech_balloon"}},
+	{"1f4ad", []string{"thought", "thought_balloon"}},
+	{"2705", []string{"check", "white_check_mark"}},
+	{"2714", []string{"check_mark", "heavy_check_mark"}},
+	{"274c", []string{"x", "cross_mark"}},
+	{"274e", []string{"negative_squared_cross_mark"}},
+	{"2753", []string{"question"}},
+	{"2757", []string{"exclamation", "heavy_exclamation_mark"}},
+	{"26a0", []string{"warning"}},
+	{"1f6ab", []string{"prohibited", "no_entry_sign"}},
+	{"26d4", []string{"no_entry"}},
+	{"2795", []string{"plus", "heavy_plus_sign"}},
+	{"2796", []string{"minus", "heavy_minus_sign"}},
+	{"1f534", []string{"red_circle"}},
+	{"1f535", []string{"blue_circle", "large_blue_circle"}},
+	{"1f7e2", []string{"green_circle"}},
+	{"1f7e1", []string{"yellow_circle"}},
+	{"26aa", []string{"white_circle"}},
+	{"26ab", []string{"black_circle"}},
+	{"1f6a8", []string{"siren", "rotating_light"}},
+	{"1f514", []string{"notifications", "bell"}},
+	{"1f515", []string{"mute_notifications", "no_bell"}},
+	{"1f4e2", []string{"loudspeaker"}},
+	{"1f4e3", []string{"megaphone", "mega"}},
+	{"1f50a", []string{"loud", "speaker_high_volume"}},
+	{"1f507", []string{"mute"}},
+	{"1f195", []string{"new"}},
+	{"1f192", []string{"cool"}},
+	{"1f193", []string{"free"}},
+	{"1f199", []string{"up"}},
+	{"1f198", []string{"sos"}},
+	{"1f504", []string{"counterclockwise", "arrows_counterclockwise"}},
+	{"1f501", []string{"repeat"}},
+	{"1f500", []string{"shuffle", "twisted_rightwards_arrows"}},
+	{"1f6a9", []string{"triangular_flag", "triangular_flag_on_post"}},
+	{"1f3c1", []string{"checkered_flag"}},
+	{"1f3f4", []string{"black_flag"}},
+
+	// Celebration and activities
+	{"1f389", []string{"tada", "party_popper"}},
+	{"1f38a", []string{"confetti", "confetti_ball"}},
+	{"1f388", []string{"balloon"}},
+	{"1f381", []string{"gift", "present"}},
+	{"1f382", []string{"birthday", "cake"}},
+	{"1f380", []string{"bow", "ribbon"}},
+	{"1f384", []string{"holiday_tree", "christmas_tree"}},
+	{"1f386", []string{"fireworks"}},
+	{"1f387", []string{"sparkler"}},
+	{"1f3c6", []string{"trophy"}},
+	{"1f947", []string{"first_place", "gold", "1st_place_medal"}},
+	{"1f948", []string{"second_place", "silver", "2nd_place_medal"}},
+	{"1f949", []string{"third_place", "bronze", "3rd_place_medal"}},
+	{"1f3c5", []string{"medal"}},
+	{"26bd", []string{"soccer"}},
+	{"26be", []string{"baseball"}},
+	{"1f3c0", []string{"basketball"}},
+	{"1f3c8", []string{"football"}},
+	{"1f3be", []string{"tennis"}},
+	{"1f3af", []string{"direct_hit", "bullseye", "target", "dart"}},
+	{"1f3ae", []string{"video_game"}},
+	{"1f3b2", []string{"dice", "game_die"}},
+	{"1f9e9", []string{"puzzle", "jigsaw"}},
+	{"1f9f8", []string{"teddy_bear"}},
+	{"1f3a8", []string{"art"}},
+	{"1f3ac", []string{"action", "clapper"}},
+	{"1f3b5", []string{"music", "musical_note"}},
+	{"1f3b6", []string{"musical_notes", "notes"}},
+	{"1f3a4", []string{"microphone"}},
+	{"1f3a7", []string{"headphones"}},
+
+	// Objects
+	{"1f680", []string{"rocket"}},
+	{"1f6e0", []string{"working_on_it", "hammer_and_wrench"}},
+	{"1f527", []string{"fixing", "wrench"}},
+	{"1f528", []string{"hammer"}},
+	{"1f41b", []string{"bug"}},
+	{"1f4bb", []string{"laptop", "computer"}},
+	{"1f4f1", []string{"mobile_phone", "smartphone", "iphone"}},
+	{"260e", []string{"phone", "telephone"}},
+	{"1f4e7", []string{"e-mail", "email"}},
+	{"2709", []string{"envelope"}},
+	{"1f4dd", []string{"memo", "note"}},
+	{"1f4c5", []string{"calendar", "date"}},
+	{"1f4c8", []string{"chart", "chart_with_upwards_trend"}},
+	{"1f4c9", []string{"downwards_trend", "chart_with_downwards_trend"}},
+	{"1f4ca", []string{"bar_chart"}},
+	{"1f4cc", []string{"push_pin", "pushpin"}},
+	{"1f4cd", []string{"pin", "round_pushpin"}},
+	{"1f4ce", []string{"paperclip"}},
+	{"1f512", []string{"locked", "lock"}},
+	{"1f513", []string{"unlocked", "unlock"}},
+	{"1f511", []string{"key"}},
+	{"1f50d", []string{"search", "mag"}},
+	{"1f50e", []string{"mag_right"}},
+	{"1f517", []string{"link"}},
+	{"1f4a1", []string{"idea", "bulb", "light_bulb"}},
+	{"1f4d6", []string{"book", "open_book"}},
+	{"1f4da", []string{"books"}},
+	{"1f4e6", []string{"package"}},
+	{"1f4bc", []string{"briefcase"}},
+	{"1f4c1", []string{"folder", "file_folder"}},
+	{"1f4c2", []string{"open_folder", "open_file_folder"}},
+	{"1f4cb", []string{"clipboard"}},
+	{"1f4c4", []string{"document", "page_facing_up"}},
+	{"1f4be", []string{"floppy_disk"}},
+	{"1f4bf", []string{"cd"}},
+	{"23f0", []string{"alarm_clock"}},
+	{"231b", []string{"times_up", "hourglass"}},
+	{"23f3", []string{"time_ticking", "hourglass_flowing_sand"}},
+	{"231a", []string{"watch"}},
+	{"1f4b0", []string{"money", "moneybag"}},
+	{"1f4b8", []string{"losing_money", "money_with_wings"}},
+	{"1f4b3", []string{"credit_card"}},
+	{"1f48e", []string{"gem"}},
+	{"1f4f7", []string{"camera"}},
+	{"1f4fa", []string{"tv"}},
+	{"1f50b", []string{"battery"}},
+	{"1f50c", []string{"electric_plug"}},
+	{"1f4a3", []string{"bomb"}},
+	{"1f52a", []string{"knife", "hocho"}},
+	{"1f48a", []string{"pill"}},
+	{"1f489", []string{"injection", "syringe"}},
+	{"1f9ea", []string{"test_tube"}},
+	{"1f52c", []string{"microscope"}},
+	{"1f52d", []string{"telescope"}},
+	{"1f4e1", []string{"satellite_antenna"}},
+	{"1f6f8", []string{"flying_saucer", "ufo"}},
+	{"1f6aa", []string{"door"}},
+	{"1f6a7", []string{"construction"}},
+	{"1f697", []string{"car"}},
+	{"1f68c", []string{"bus"}},
+	{"1f686", []string{"train"}},
+	{"2708", []string{"airplane"}},
+	{"1f6b2", []string{"bike"}},
+	{"1f3e0", []string{"house", "home"}},
+	{"1f3e2", []string{"office"}},
+	{"1f30e", []string{"earth_americas"}},
+	{"1f30d", []string{"earth_africa"}},
+	{"1f30f", []string{"earth_asia"}},
+	{"1f310", []string{"globe", "www"}},
+
+	// Food and drink
+	{"2615", []string{"coffee"}},
+	{"1f375", []string{"tea"}},
+	{"1f37a", []string{"beer"}},
+	{"1f37b", []string{"beers"}},
+	{"1f377", []string{"wine"}},
+	{"1f378", []string{"cocktail"}},
+	{"1f942", []string{"clink", "champagne_glasses"}},
+	{"1f355", []string{"pizza"}},
+	{"1f354", []string{"hamburger", "burger"}},
+	{"1f35f", []string{"fries"}},
+	{"1f32e", []string{"taco"}},
+	{"1f32f", []string{"burrito"}},
+	{"1f363", []string{"sushi"}},
+	{"1f35c", []string{"ramen"}},
+	{"1f37f", []string{"popcorn"}},
+	{"1f36a", []string{"cookie"}},
+	{"1f369", []string{"donut", "doughnut"}},
+	{"1f36b", []string{"chocolate"}},
+	{"1f370", []string{"shortcake"}},
+	{"1f34e", []string{"apple"}},
+	{"1f34c", []string{"banana"}},
+	{"1f353", []string{"strawberry"}},
+	{"1f351", []string{"peach"}},
+	{"1f346", []string{"eggplant"}},
+	{"1f951", []string{"avocado"}},
+	{"1f955", []string{"carrot"}},
+	{"1f33d", []string{"corn"}},
+
+	// Nature
+	{"2600", []string{"sunny"}},
+	{"2601", []string{"cloud"}},
+	{"1f308", []string{"rainbow"}},
+	{"2744", []string{"snowflake"}},
+	{"2614", []string{"umbrella_with_rain"}},
+	{"1f319", []string{"crescent_moon"}},
+	{"1f31e", []string{"sun_face"}},
+	{"1f30a", []string{"ocean"}},
+	{"1f30c", []string{"milky_way"}},
+	{"1f320", []string{"shooting_star"}},
+	{"1f333", []string{"tree", "deciduous_tree"}},
+	{"1f332", []string{"evergreen_tree"}},
+	{"1f334", []string{"palm_tree"}},
+	{"1f335", []string{"cactus"}},
+	{"1f331", []string{"seedling"}},
+	{"1f340", []string{"four_leaf_clover", "lucky"}},
+	{"1f33b", []string{"sunflower"}},
+	{"1f339", []string{"rose"}},
+	{"1f337", []string{"tulip"}},
+	{"1f338", []string{"cherry_blossom"}},
+	{"1f341", []string{"maple_leaf"}},
+	{"1f342", []string{"fallen_leaf"}},
+
+	// Animals
+	{"1f419", []string{"octopus"}},
+	{"1f436", []string{"dog"}},
+	{"1f431", []string{"cat"}},
+	{"1f42d", []string{"mouse"}},
+	{"1f439", []string{"hamster"}},
+	{"1f430", []string{"rabbit", "bunny"}},
+	{"1f98a", []string{"fox"}},
+	{"1f43b", []string{"bear"}},
+	{"1f43c", []string{"panda"}},
+	{"1f428", []string{"koala"}},
+	{"1f42f", []string{"tiger"}},
+	{"1f981", []string{"lion"}},
+	{"1f42e", []string{"cow"}},
+	{"1f437", []string{"pig"}},
+	{"1f438", []string{"frog"}},
+	{"1f435", []string{"monkey_face"}},
+	{"1f414", []string{"chicken"}},
+	{"1f427", []string{"penguin"}},
+	{"1f426", []string{"bird"}},
+	{"1f424", []string{"chick", "baby_chick"}},
+	{"1f986", []string{"duck"}},
+	{"1f985", []string{"eagle"}},
+	{"1f989", []string{"owl"}},
+	{"1f987", []string{"bat"}},
+	{"1f43a", []string{"wolf"}},
+	{"1f417", []string{"boar"}},
+	{"1f434", []string{"horse"}},
+	{"1f984", []string{"unicorn"}},
+	{"1f41d", []string{"bee", "honeybee"}},
+	{"1f40c", []string{"snail"}},
+	{"1f98b", []string{"butterfly"}},
+	{"1f41e", []string{"lady_beetle", "ladybug"}},
+	{"1f422", []string{"turtle"}},
+	{"1f40d", []string{"snake"}},
+	{"1f996", []string{"t-rex", "t_rex"}},
+	{"1f995", []string{"dinosaur", "sauropod"}},
+	{"1f40b", []string{"whale"}},
+	{"1f42c", []string{"dolphin"}},
+	{"1f41f", []string{"fish"}},
+	{"1f420", []string{"tropical_fish"}},
+	{"1f988", []string{"shark"}},
+	{"1f980", []string{"crab"}},
+	{"1f990", []string{"shrimp"}},
+	{"1f991", []string{"squid"}},
+	{"1f40a", []string{"crocodile"}},
+	{"1f418", []string{"elephant"}},
+	{"1f42b", []string{"camel"}},
+	{"1f992", []string{"giraffe"}},
+	{"1f993", []string{"zebra"}},
+	{"1f994", []string{"hedgehog"}},
+	{"1f43e", []string{"paw_prints", "feet"}},
+}
+
+var (
+	byName  = make(map[string]string) // glyph by name
+	byGlyph = make(map[string]string) // name by glyph
+)
+
+func init() {
+	for _, e := range table {
+		glyph, _ := FromCode(e.code)
+		byGlyph[glyph] = e.names[0]
+		for _, name := range e.names {
+			byName[name] = glyph
+		}
+	}
+}
+
+// shortcode matches an emoji's name between colons, e.g. ":octopus:"
+var shortcode = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+
+// Glyph returns the Unicode emoji with the given name (without colons), if there is
+// one. Realm custom emoji have no Unicode form.
+func Glyph(name string) (string, bool) {
+	glyph, ok := byName[strings.ToLower(name)]
+	return glyph, ok
+}
+
+// Name returns the name Zulip uses for a Unicode emoji, if it has one
+func Name(glyph string) (string, bool) {
+	name, ok := byGlyph[strings.TrimSuffix(glyph, string(presentationSelect))]
+	return name, ok
+}
+
+// FromCode returns the emoji with the given code points, written in hexadecimal
+// and separated by dashes as Zulip does, e.g. "1f419" or "1f1e9-1f1f0"
+func FromCode(code string) (string, bool) {
+	var b strings.Builder
+	for _, part := range strings.Split(code, "-") {
+		r, err := strconv.ParseInt(part, 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return "", false
+		}
+		b.WriteRune(rune(r))
+	}
+	return b.String(), true
+}
+
+// Replace returns text with each :shortcode: of a Unicode emoji replaced by its
+// glyph. Other shortcodes, such as those of realm custom emoji, are left as they are.
+func Replace(text string) string {
+	return shortcode.ReplaceAllStringFunc(text, func(s string) string {
+		if glyph, ok := Glyph(strings.Trim(s, ":")); ok {
+			return glyph
+		}
+		return s
+	})
+}
+
+// Code points which join emoji into sequences displayed as one glyph
+const (
+	zeroWidthJoiner    = '\u200d'
+	presentationSelect = '\ufe0f' // VS16: show the preceding character as an emoji
+)
+
+// ToShortcodes returns text with each emoji which has a name replaced by its
+// :shortcode:, along with any presentation selector after it. Emoji which are part of
+// a sequence, such as a thumbs up with a skin tone, are left as they are, because
+// their shortcodes would lose the rest of the sequence.
+func ToShortcodes(text string) string {
+	runes := []rune(text)
+	var b strings.Builder
+	for i := 0; i < len(runes); i++ {
+		name, ok := byGlyph[string(runes[i])]
+		if !ok || inSequence(runes, i) {
+			b.WriteRune(runes[i])
+			continue
+		}
+		b.WriteString(":" + name + ":")
+		if i+1 < len(runes) && runes[i+1] == presentationSelect {
+			i++
+		}
+	}
+	return b.String()
+}
+
+// inSequence returns true if runes[i] is joined to the runes around it
+func inSequence(runes []rune, i int) bool {
+	if i > 0 && runes[i-1] == zeroWidthJoiner {
+		return true
+	}
+	next := i + 1
+	if next < len(runes) && runes[next] == presentationSelect {
+		next++
+	}
+	return next < len(runes) && Joins(runes[next])
+}
+
+// Joins returns true if r joins the emoji before it into a sequence: a zero width
+// joiner or a skin tone modifier
+func Joins(r rune) bool {
+	return r == zeroWidthJoiner || (r >= 0x1f3fb && r <= 0x1f3ff)
+}
+
+// Padded returns glyph followed by a space if it is displayed two columns wide. Each
+// rune written to a gocui view takes up one cell, so the space stops the next rune
+// from being drawn over the glyph's second column.
+func Padded(glyph string) string {
+	r, _ := utf8.DecodeRuneInString(glyph)
+	if utf8.RuneCountInString(glyph) == 1 && Wide(r) {
+		return glyph + " "
+	}
+	return glyph
+}
+
+// wideRanges are the ranges of emoji code points which are displayed two columns
+// wide (those with an East Asian Width of Wide)
+var wideRanges = [][2]rune{
+	{0x231a, 0x231b}, {0x23e9, 0x23ec}, {0x23f0, 0x23f0}, {0x23f3, 0x23f3},
+	{0x25fd, 0x25fe}, {0x2614, 0x2615}, {0x2648, 0x2653}, {0x267f, 0x267f},
+	{0x2693, 0x2693}, {0x26a1, 0x26a1}, {0x26aa, 0x26ab}, {0x26bd, 0x26be},
+	{0x26c4, 0x26c5}, {0x26ce, 0x26ce}, {0x26d4, 0x26d4}, {0x26ea, 0x26ea},
+	{0x26f2, 0x26f3}, {0x26f5, 0x26f5}, {0x26fa, 0x26fa}, {0x26fd, 0x26fd},
+	{0x2705, 0x2705}, {0x270a, 0x270b}, {0x2728, 0x2728}, {0x274c, 0x274c},
+	{0x274e, 0x274e}, {0x2753, 0x2755}, {0x2757, 0x2757}, {0x2795, 0x2797},
+	{0x27b0, 0x27b0}, {0x27bf, 0x27bf}, {0x2b1b, 0x2b1c}, {0x2b50, 0x2b50},
+	{0x2b55, 0x2b55},
+	{0x1f004, 0x1f004}, {0x1f0cf, 0x1f0cf}, {0x1f18e, 0x1f18e}, {0x1f191, 0x1f19a},
+	{0x1f200, 0x1f202}, {0x1f210, 0x1f23b}, {0x1f240, 0x1f248}, {0x1f250, 0x1f251},
+	{0x1f260, 0x1f265}, {0x1f300, 0x1f320}, {0x1f32d, 0x1f335}, {0x1f337, 0x1f37c},
+	{0x1f37e, 0x1f393}, {0x1f3a0, 0x1f3ca}, {0x1f3cf, 0x1f3d3}, {0x1f3e0, 0x1f3f0},
+	{0x1f3f4, 0x1f3f4}, {0x1f3f8, 0x1f43e}, {0x1f440, 0x1f440}, {0x1f442, 0x1f4fc},
+	{0x1f4ff, 0x1f53d}, {0x1f54b, 0x1f54e}, {0x1f550, 0x1f567}, {0x1f57a, 0x1f57a},
+	{0x1f595, 0x1f596}, {0x1f5a4, 0x1f5a4}, {0x1f5fb, 0x1f64f}, {0x1f680, 0x1f6c5},
+	{0x1f6cc, 0x1f6cc}, {0x1f6d0, 0x1f6d2}, {0x1f6d5, 0x1f6d7}, {0x1f6dc, 0x1f6df},
+	{0x1f6eb, 0x1f6ec}, {0x1f6f4, 0x1f6fc}, {0x1f7e0, 0x1f7eb}, {0x1f7f0, 0x1f7f0},
+	{0x1f90c, 0x1f93a}, {0x1f93c, 0x1f945}, {0x1f947, 0x1f9ff}, {0x1fa70, 0x1faff},
+}
+
+// Wide returns true if the emoji r is displayed two columns wide
+func Wide(r rune) bool {
+	for _, w := range wideRanges {
+		if r >= w[0] && r <= w[1] {
+			return true
+		}
+	}
+	return false
+}
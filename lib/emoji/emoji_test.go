@@ -0,0 +1,54 @@
+package emoji
+
+import "testing"
+
+// Every emoji in the table converts to its shortcode and back, under each of its names
+func TestTableRoundTrip(t *testing.T) {
+	for _, e := range table {
+		glyph, ok := FromCode(e.code)
+		if !ok {
+			t.Errorf("FromCode(%q) failed", e.code)
+			continue
+		}
+		if got, want := ToShortcodes(glyph), ":"+e.names[0]+":"; got != want {
+			t.Errorf("ToShortcodes(%q) = %q, want %q", glyph, got, want)
+		}
+		for _, name := range e.names {
+			if got := Replace(":" + name + ":"); got != glyph {
+				t.Errorf("Replace(:%s:) = %q, want %q", name, got, glyph)
+			}
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	for text, want := range map[string]string{
+		"no emoji here":            "no emoji here",
+		":+1::tada:":               "👍🎉",
+		":zulip: is a realm emoji": ":zulip: is a realm emoji",
+		"at 12:30:45":              "at 12:30:45",
+		"10:00 :octopus:":          "10:00 🐙",
+	} {
+		if got := Replace(text); got != want {
+			t.Errorf("Replace(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+// A sequence of emoji shown as one glyph is left whole, because the shortcode of its
+// first emoji would lose the rest of it
+func TestToShortcodesSequences(t *testing.T) {
+	for text, want := range map[string]string{
+		"\u2764\ufe0f ok":         ":heart: ok",
+		"👍\U0001f3fd":             "👍\U0001f3fd",
+		"👍\U0001f3fd👍":            "👍\U0001f3fd:+1:",
+		"👨\u200d👩\u200d👧":         "👨\u200d👩\u200d👧",
+		"\U0001f3f3\ufe0f\u200d🌈": "\U0001f3f3\ufe0f\u200d🌈",
+		"a 🐙\u200d b":             "a 🐙\u200d b",
+		"\u200d🐙 after":           "\u200d🐙 after",
+	} {
+		if got := ToShortcodes(text); got != want {
+			t.Errorf("ToShortcodes(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
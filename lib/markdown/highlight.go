@@ -0,0 +1,292 @@
+package markdown
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Scheme is the colours code is highlighted in, each the parameters of an ANSI escape
+// code (e.g. "35;1" for bold magenta), or "" for the terminal's default
+type Scheme struct {
+	Plain   string
+	Keyword string
+	String  string
+	Comment string
+	Number  string
+	Type    string // also builtin functions and shell variables
+}
+
+// Schemes are the colour schemes available, by name
+var Schemes = map[string]*Scheme{
+	"dark": {
+		Keyword: "35;1",
+		String:  "32",
+		Comment: "36",
+		Number:  "33",
+		Type:    "34;1",
+	},
+	"light": {
+		Keyword: "34;1",
+		String:  "31",
+		Comment: "32",
+		Number:  "35",
+		Type:    "36",
+	},
+	"bold": {
+		Keyword: "1",
+		Comment: "4",
+		Type:    "1",
+	},
+}
+
+// language describes how to pick out the parts of code in a programming language
+type language struct {
+	lineComments    []string
+	blockComments   [][2]string // opening and closing delimiters
+	quotes          []string    // string delimiters, longest first
+	rawQuotes       []string    // string delimiters inside which backslash is not an escape
+	multiLineQuotes []string    // string delimiters which may contain newlines
+	keywords        map[string]bool
+	types           map[string]bool
+	ignoreCase      bool // keywords and types match in any case
+	variables       bool // $NAME and ${NAME} are variables
+}
+
+// wordSet returns the set of the words in s
+func wordSet(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var (
+	goLanguage = &language{
+		lineComments:    []string{"//"},
+		blockComments:   [][2]string{{"/*", "*/"}},
+		quotes:          []string{`"`, "'", "`"},
+		rawQuotes:       []string{"`"},
+		multiLineQuotes: []string{"`"},
+		keywords: wordSet(`break case chan const continue default defer else fallthrough for func go
+			goto if import interface map package range return select struct switch type var
+			true false nil iota`),
+		types: wordSet(`bool byte complex64 complex128 error float32 float64 int int8 int16 int32
+			int64 rune string uint uint8 uint16 uint32 uint64 uintptr any comparable
+			append cap clear close complex copy delete imag len make max min new panic print
+			println real recover`),
+	}
+	sqlLanguage = &language{
+		lineComments:  []string{"--"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		quotes:        []string{"'", `"`},
+		keywords: wordSet(`add all alter and as asc begin between by case check column commit
+			constraint create cross default delete desc distinct drop else end exists explain
+			foreign from full group having if in index inner insert intersect into is join key
+			left like limit not null offset on or order outer primary references returning
+			right rollback select set table then transaction trigger truncate union unique
+			update using values view when where with`),
+		types: wordSet(`bigint blob boolean char date decimal double float int integer interval
+			json jsonb numeric real serial smallint text time timestamp timestamptz uuid
+			varchar avg coalesce count max min now sum`),
+		ignoreCase: true,
+	}
+	shellLanguage = &language{
+		lineComments: []string{"#"},
+		quotes:       []string{`"`, "'"},
+		rawQuotes:    []string{"'"},
+		keywords: wordSet(`case do done elif else esac export fi for function if in local return
+			select then until while`),
+		types: wordSet(`alias cd echo eval exec exit printf read set shift source test trap
+			unset`),
+		variables: true,
+	}
+	pythonLanguage = &language{
+		lineComments:    []string{"#"},
+		quotes:          []string{`"""`, "'''", `"`, "'"},
+		multiLineQuotes: []string{`"""`, "'''"},
+		keywords: wordSet(`and as assert async await break class continue def del elif else
+			except finally for from global if import in is lambda nonlocal not or pass raise
+			return try while with yield True False None`),
+		types: wordSet(`bool bytes dict float int list object set str tuple type abs all any
+			enumerate filter isinstance len map open print range repr sorted sum super zip
+			self`),
+	}
+	javascriptLanguage = &language{
+		lineComments:    []string{"//"},
+		blockComments:   [][2]string{{"/*", "*/"}},
+		quotes:          []string{`"`, "'", "`"},
+		multiLineQuotes: []string{"`"},
+		keywords: wordSet(`async await break case catch class const continue default delete do
+			else export extends finally for from function if import in instanceof let new of
+			return static super switch this throw try typeof var void while yield true false
+			null undefined`),
+		types: wordSet(`Array Boolean Date Error JSON Map Math Number Object Promise RegExp Set
+			String console document window`),
+	}
+	jsonLanguage = &language{
+		quotes:   []string{`"`},
+		keywords: wordSet(`true false null`),
+	}
+)
+
+// languages are the languages which are highlighted, by the names they are tagged with
+var languages = map[string]*language{
+	"go":         goLanguage,
+	"golang":     goLanguage,
+	"sql":        sqlLanguage,
+	"mysql":      sqlLanguage,
+	"postgresql": sqlLanguage,
+	"postgres":   sqlLanguage,
+	"sqlite":     sqlLanguage,
+	"sh":         shellLanguage,
+	"shell":      shellLanguage,
+	"bash":       shellLanguage,
+	"zsh":        shellLanguage,
+	"console":    shellLanguage,
+	"python":     pythonLanguage,
+	"python3":    pythonLanguage,
+	"py":         pythonLanguage,
+	"javascript": javascriptLanguage,
+	"js":         javascriptLanguage,
+	"typescript": javascriptLanguage,
+	"ts":         javascriptLanguage,
+	"json":       jsonLanguage,
+}
+
+// highlight splits src, which is code in lang, into lines of spans styled by what
+// they are
+func highlight(lang *language, src string) []line {
+	out := []line{{}}
+	add := func(text string, s style) {
+		// Spans never cross lines
+		for i, part := range strings.Split(text, "\n") {
+			if i > 0 {
+				out = append(out, line{})
+			}
+			if part != "" {
+				out[len(out)-1] = append(out[len(out)-1], span{part, s | code | highlighted})
+			}
+		}
+	}
+
+	plainStart := 0
+	for i := 0; i < len(src); {
+		rest := src[i:]
+		text, s := lang.token(rest, i == 0 || !isIdentifierRune(lastRune(src[:i])))
+		if text == "" {
+			_, size := utf8.DecodeRuneInString(rest)
+			i += size
+			continue
+		}
+		add(src[plainStart:i], 0)
+		add(text, s)
+		i += len(text)
+		plainStart = i
+	}
+	add(src[plainStart:], 0)
+	return out
+}
+
+// token returns the token at the start of code and its style, or "" if it starts with
+// plain text. wordStart is true if code is not in the middle of a word.
+func (lang *language) token(code string, wordStart bool) (string, style) {
+	for _, c := range lang.lineComments {
+		if strings.HasPrefix(code, c) {
+			if end := strings.IndexByte(code, '\n'); end >= 0 {
+				return code[:end], codeComment
+			}
+			return code, codeComment
+		}
+	}
+	for _, c := range lang.blockComments {
+		if strings.HasPrefix(code, c[0]) {
+			if end := strings.Index(code[len(c[0]):], c[1]); end >= 0 {
+				return code[:len(c[0])+end+len(c[1])], codeComment
+			}
+			return code, codeComment
+		}
+	}
+	for _, q := range lang.quotes {
+		if strings.HasPrefix(code, q) {
+			return code[:lang.stringLength(code, q)], codeString
+		}
+	}
+	if !wordStart {
+		return "", 0
+	}
+	if lang.variables && code[0] == '$' && len(code) > 1 {
+		if code[1] == '{' {
+			if end := strings.IndexByte(code, '}'); end >= 0 {
+				return code[:end+1], codeType
+			}
+		}
+		if n := identifierLength(code[1:]); n > 0 {
+			return code[:1+n], codeType
+		}
+	}
+	r, _ := utf8.DecodeRuneInString(code)
+	switch {
+	case unicode.IsDigit(r):
+		n := strings.IndexFunc(code, func(r rune) bool { return !isIdentifierRune(r) && r != '.' })
+		if n < 0 {
+			n = len(code)
+		}
+		return code[:n], codeNumber
+	case isIdentifierRune(r):
+		n := identifierLength(code)
+		word := code[:n]
+		if lang.ignoreCase {
+			word = strings.ToLower(word)
+		}
+		switch {
+		case lang.keywords[word]:
+			return code[:n], codeKeyword
+		case lang.types[word]:
+			return code[:n], codeType
+		}
+		return "", 0
+	}
+	return "", 0
+}
+
+// stringLength returns the length of the string literal at the start of code, which
+// is opened by quote. An unclosed string runs to the end of the line (or of the code,
+// if it may contain newlines).
+func (lang *language) stringLength(code string, quote string) int {
+	raw := contains(lang.rawQuotes, quote)
+	multiLine := contains(lang.multiLineQuotes, quote)
+	for i := len(quote); i < len(code); i++ {
+		switch {
+		case code[i] == '\\' && !raw:
+			i++
+		case code[i] == '\n' && !multiLine:
+			return i
+		case strings.HasPrefix(code[i:], quote):
+			return i + len(quote)
+		}
+	}
+	return len(code)
+}
+
+func identifierLength(s string) int {
+	n := strings.IndexFunc(s, func(r rune) bool { return !isIdentifierRune(r) })
+	if n < 0 {
+		return len(s)
+	}
+	return n
+}
+
+func isIdentifierRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+// marked returns lines with each highlighted token wrapped in the initial of what it
+// is, e.g. k(func) for a keyword, so that expected output can be written inline
+func marked(lines []line) string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		var b strings.Builder
+		for _, s := range l {
+			kind := ""
+			switch {
+			case s.style&codeKeyword != 0:
+				kind = "k"
+			case s.style&codeString != 0:
+				kind = "s"
+			case s.style&codeComment != 0:
+				kind = "c"
+			case s.style&codeNumber != 0:
+				kind = "n"
+			case s.style&codeType != 0:
+				kind = "t"
+			}
+			if kind == "" {
+				b.WriteString(s.text)
+			} else {
+				b.WriteString(kind + "(" + s.text + ")")
+			}
+		}
+		out[i] = b.String()
+	}
+	return strings.Join(out, "\n")
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		lang string
+		src  string
+		want string
+	}{
+		{"go", `x := "s" // c`, `x := s("s") c(// c)`},
+		{"go", "func f() error { return nil }", "k(func) f() t(error) { k(return) k(nil) }"},
+		{"go", "a := `x\ny`", "a := s(`x)\ns(y`)"},
+		{"go", "/* a\nb */ x", "c(/* a)\nc(b */) x"},
+		{"go", "formatted := 0x1f", "formatted := n(0x1f)"},
+		{"go", `"a \" b"`, `s("a \" b")`},
+		{"sql", "SELECT 1 from t -- all", "k(SELECT) n(1) k(from) t c(-- all)"},
+		{"bash", "echo $HOME ${PATH} # hi", "t(echo) t($HOME) t(${PATH}) c(# hi)"},
+		{"python", "def f(): return 'x'", "k(def) f(): k(return) s('x')"},
+		{"python", `s = """a` + "\n" + `b"""`, `s = s("""a)` + "\n" + `s(b""")`},
+		{"js", "const x = null; // y", "k(const) x = k(null); c(// y)"},
+		{"json", `{"a": true, "b": 1.5}`, `{s("a"): k(true), s("b"): n(1.5)}`},
+	}
+	for _, tt := range tests {
+		got := marked(highlight(languages[tt.lang], tt.src))
+		if got != tt.want {
+			t.Errorf("highlight(%s, %q) = %q, want %q", tt.lang, tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestHighlightedCodeBlock(t *testing.T) {
+	src := "```go\nreturn 1\n```"
+	dark := Renderer{Highlighting: Schemes["dark"]}.Render(src)
+	if want := "\x1b[35;1mreturn\x1b[0m \x1b[33m1\x1b[0m"; dark != want {
+		t.Errorf("dark Render(%q) = %q, want %q", src, dark, want)
+	}
+	// Without a scheme, and in a language which is not known, code is just code
+	for _, got := range []string{
+		Renderer{}.Render(src),
+		Renderer{Highlighting: Schemes["dark"]}.Render("```cobol\nreturn 1\n```"),
+	} {
+		if want := "\x1b[33mreturn 1\x1b[0m"; got != want {
+			t.Errorf("Render = %q, want %q", got, want)
+		}
+	}
+}
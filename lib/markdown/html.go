@@ -0,0 +1,492 @@
+package markdown
+
+import (
+	"encoding/xml"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mjec/clisiana/lib/emoji"
+)
+
+// node is an element or a piece of text in an HTML document
+type node struct {
+	tag      string // "" for text
+	attrs    map[string]string
+	children []*node
+	text     string
+}
+
+// hasClass returns true if n has class among its classes
+func (n *node) hasClass(class string) bool {
+	for _, c := range strings.Fields(n.attrs["class"]) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// textContent returns all the text in n and its children
+func (n *node) textContent() string {
+	if n.tag == "" {
+		return n.text
+	}
+	var b strings.Builder
+	for _, c := range n.children {
+		b.WriteString(c.textContent())
+	}
+	return b.String()
+}
+
+// find returns the first descendant of n with the given tag, or nil if there is none
+func (n *node) find(tag string) *node {
+	for _, c := range n.children {
+		if c.tag == tag {
+			return c
+		}
+		if found := c.find(tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+var (
+	whitespace = regexp.MustCompile(`\s+`)
+	htmlTags   = regexp.MustCompile(`<[^>]*>`)
+	// blockEnds are the tags which end a paragraph of stripped text
+	blockEnds = regexp.MustCompile(`(?i)</(p|h[1-6]|li|div|pre|blockquote|tr)>|<br\s*/?>`)
+)
+
+// parseHTML parses src, an HTML fragment, into a tree under a root div. It is lenient
+// about unclosed and void elements. Text and attributes are sanitized once their
+// entities have been decoded, so an entity cannot smuggle in a control character. If
+// src cannot be parsed, the tree is its text with the tags stripped out instead.
+func parseHTML(src string) *node {
+	root := &node{tag: "div", attrs: map[string]string{}}
+	d := xml.NewDecoder(strings.NewReader(src))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	stack := []*node{root}
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return strippedHTML(src)
+		}
+		parent := stack[len(stack)-1]
+		switch t := t.(type) {
+		case xml.StartElement:
+			n := &node{tag: strings.ToLower(t.Name.Local), attrs: make(map[string]string, len(t.Attr))}
+			for _, a := range t.Attr {
+				n.attrs[strings.ToLower(a.Name.Local)] = sanitize(a.Value)
+			}
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			// Close the innermost matching element, and any left open inside it
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].tag == strings.ToLower(t.Name.Local) {
+					stack = stack[:i]
+					break
+				}
+			}
+		case xml.CharData:
+			parent.children = append(parent.children, &node{text: sanitize(string(t))})
+		}
+	}
+	return root
+}
+
+// strippedHTML returns a tree of the text in src, a paragraph for each block, for HTML
+// which cannot be parsed
+func strippedHTML(src string) *node {
+	root := &node{tag: "div", attrs: map[string]string{}}
+	for _, block := range blockEnds.Split(src, -1) {
+		text := sanitize(html.UnescapeString(htmlTags.ReplaceAllString(block, "")))
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		root.children = append(root.children, &node{tag: "p", children: []*node{{text: text}}})
+	}
+	return root
+}
+
+// RenderHTML returns src, the HTML which the Zulip server renders a message's
+// markdown as, rendered for the terminal. There is no newline at the end.
+func (r Renderer) RenderHTML(src string) string {
+	width := r.Width
+	if width < 1 {
+		width = noWrap
+	}
+	lines := r.htmlBlocks(parseHTML(src), width, true)
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = l.format(r.Highlighting)
+	}
+	return strings.Join(out, "\n")
+}
+
+// htmlBlocks renders the children of n, wrapped to width. If separate is true, there
+// is a blank line between each block.
+func (r Renderer) htmlBlocks(n *node, width int, separate bool) []line {
+	out := []line{}
+	addBlock := func(lines []line) {
+		if len(lines) == 0 {
+			return
+		}
+		if separate && len(out) > 0 {
+			out = append(out, line{})
+		}
+		out = append(out, lines...)
+	}
+	inlineContent := line{}
+	flush := func() {
+		addBlock(r.paragraph(inlineContent, width))
+		inlineContent = line{}
+	}
+
+	for _, c := range n.children {
+		switch {
+		case c.tag == "p" || c.tag == "h1" || c.tag == "h2" || c.tag == "h3" ||
+			c.tag == "h4" || c.tag == "h5" || c.tag == "h6":
+			flush()
+			base := style(0)
+			if c.tag != "p" {
+				base = bold
+			}
+			addBlock(r.paragraph(r.htmlInline(c, base), width))
+
+		case c.tag == "blockquote":
+			flush()
+			addBlock(quote(r.htmlBlocks(c, width-2, true)))
+
+		case c.tag == "ul" || c.tag == "ol":
+			flush()
+			addBlock(r.htmlList(c, width))
+
+		case c.tag == "pre" || c.hasClass("codehilite"):
+			flush()
+			addBlock(r.htmlCode(c, width))
+
+		case c.hasClass("spoiler-block"):
+			flush()
+			addBlock(r.htmlSpoiler(c, width))
+
+		case c.tag == "hr":
+			flush()
+			n := width
+			if n > 40 {
+				n = 40
+			}
+			addBlock([]line{{{strings.Repeat("─", n), quoteMarker}}})
+
+		case c.tag == "table":
+			flush()
+			addBlock(r.htmlTable(c, width))
+
+		case c.hasClass("message_inline_image") || c.hasClass("message_inline_ref") || c.hasClass("youtube-video"):
+			flush()
+			if a := c.find("a"); a != nil {
+				addBlock(wrap(line{{"[preview] ", 0}, {r.absoluteURL(a.attrs["href"]), url}}, width))
+			}
+
+		case c.tag == "div" || c.tag == "li" || c.tag == "section":
+			flush()
+			addBlock(r.htmlBlocks(c, width, separate))
+
+		default:
+			inlineContent = append(inlineContent, r.htmlInline(&node{tag: "span", children: []*node{c}}, 0)...)
+		}
+	}
+	flush()
+	return out
+}
+
+// paragraph wraps inline content to width, breaking it at line breaks and dropping the
+// white space at the start and end of each line
+func (r Renderer) paragraph(content line, width int) []line {
+	out := []line{}
+	current := line{}
+	addLine := func() {
+		trimmed := trimLine(current)
+		if len(trimmed) > 0 || len(out) > 0 {
+			out = append(out, wrap(trimmed, width)...)
+		}
+		current = line{}
+	}
+	for _, s := range content {
+		if s.text == "\n" {
+			addLine()
+			continue
+		}
+		current = append(current, s)
+	}
+	addLine()
+	// A trailing line break leaves an empty line behind
+	for len(out) > 0 && out[len(out)-1].width() == 0 {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// trimLine returns l without spaces at the start or end
+func trimLine(l line) line {
+	l = append(line{}, l...)
+	for len(l) > 0 {
+		l[0].text = strings.TrimLeft(l[0].text, " ")
+		if l[0].text != "" {
+			break
+		}
+		l = l[1:]
+	}
+	for len(l) > 0 {
+		last := &l[len(l)-1]
+		last.text = strings.TrimRight(last.text, " ")
+		if last.text != "" {
+			break
+		}
+		l = l[:len(l)-1]
+	}
+	return l
+}
+
+// htmlInline renders the inline content of n. Line breaks are spans of "\n".
+func (r Renderer) htmlInline(n *node, base style) line {
+	out := line{}
+	for _, c := range n.children {
+		s := base
+		switch {
+		case c.tag == "":
+			out = append(out, span{whitespace.ReplaceAllString(c.text, " "), base})
+			continue
+		case c.tag == "br":
+			out = append(out, span{"\n", base})
+			continue
+		case c.tag == "strong" || c.tag == "b":
+			s |= bold
+		case c.tag == "em" || c.tag == "i":
+			s |= italic
+		case c.tag == "del" || c.tag == "s":
+			out = append(out, struckThrough(r.htmlInline(c, s|strikethrough), s)...)
+			continue
+		case c.tag == "code":
+			out = append(out, span{whitespace.ReplaceAllString(c.textContent(), " "), s | code})
+			continue
+		case c.hasClass("user-mention") || c.hasClass("user-group-mention") || c.hasClass("topic-mention"):
+			out = append(out, span{strings.TrimSpace(c.textContent()), s | mention})
+			continue
+		case c.tag == "a" && (c.hasClass("stream") || c.hasClass("stream-topic")):
+			out = append(out, span{strings.TrimSpace(c.textContent()), s | streamLink})
+			continue
+		case c.tag == "a":
+			text := r.htmlInline(c, s|linkText)
+			target := r.absoluteURL(c.attrs["href"])
+			if label := strings.TrimSpace(c.textContent()); label == "" || label == c.attrs["href"] || label == target {
+				out = append(out, span{target, s | url})
+			} else {
+				out = append(out, text...)
+				out = append(out, span{" (", s}, span{target, s | url}, span{")", s})
+			}
+			continue
+		case c.tag == "span" && c.hasClass("emoji"):
+			// Realm emoji are images, so any emoji here has a Unicode form
+			if glyph, ok := emoji.FromCode(emojiCode(c)); ok {
+				out = append(out, span{emoji.Padded(glyph), s})
+			} else {
+				out = append(out, span{c.textContent(), s})
+			}
+			continue
+		case c.tag == "img":
+			alt := c.attrs["alt"]
+			if alt == "" {
+				alt = "[image]"
+			}
+			out = append(out, span{alt, s})
+			continue
+		case c.tag == "time":
+			out = append(out, span{localTime(c), s | bold})
+			continue
+		case c.hasClass("katex") || c.hasClass("katex-display"):
+			tex := c.textContent()
+			if a := c.find("annotation"); a != nil {
+				tex = a.textContent()
+			}
+			out = append(out, span{"$$" + strings.TrimSpace(tex) + "$$", s | code})
+			continue
+		}
+		out = append(out, r.htmlInline(c, s)...)
+	}
+	return out
+}
+
+// emojiCode returns the code points of the emoji n, from its class, e.g. "1f419" from
+// "emoji emoji-1f419"
+func emojiCode(n *node) string {
+	for _, class := range strings.Fields(n.attrs["class"]) {
+		if strings.HasPrefix(class, "emoji-") {
+			return strings.TrimPrefix(class, "emoji-")
+		}
+	}
+	return ""
+}
+
+// localTime returns the time in a time element in the local time zone, or its text if
+// it has no machine readable time
+func localTime(n *node) string {
+	t, err := time.Parse(time.RFC3339, n.attrs["datetime"])
+	if err != nil {
+		return strings.TrimSpace(n.textContent())
+	}
+	return t.Local().Format("Mon 2 Jan 2006 15:04 MST")
+}
+
+// absoluteURL returns href resolved against the realm's URL, if it is relative
+func (r Renderer) absoluteURL(href string) string {
+	if strings.HasPrefix(href, "/") && !strings.HasPrefix(href, "//") && r.BaseURL != "" {
+		return strings.TrimSuffix(r.BaseURL, "/") + href
+	}
+	return href
+}
+
+// htmlList renders a ul or ol element
+func (r Renderer) htmlList(n *node, width int) []line {
+	out := []line{}
+	number := 1
+	if start, err := strconv.Atoi(n.attrs["start"]); err == nil {
+		number = start
+	}
+	for _, c := range n.children {
+		if c.tag != "li" {
+			continue
+		}
+		marker := "•"
+		if n.tag == "ol" {
+			marker = strconv.Itoa(number) + "."
+			number++
+		}
+		prefix := marker + " "
+		w := utf8.RuneCountInString(prefix)
+		// Loose lists have a paragraph in each item, but are no more readable spaced out
+		item := r.htmlBlocks(c, width-w, false)
+		out = append(out, indented(item, span{prefix, 0}, span{strings.Repeat(" ", w), 0}, 0)...)
+	}
+	return out
+}
+
+// htmlCode renders a code block. The server highlights code in languages it knows
+// with Pygments, whose classes are mapped to the styles of highlighted code.
+func (r Renderer) htmlCode(n *node, width int) []line {
+	spans := line{}
+	var collect func(n *node, s style)
+	collect = func(n *node, s style) {
+		for _, c := range n.children {
+			if c.tag == "" {
+				spans = append(spans, span{c.text, s})
+				continue
+			}
+			inner := s
+			if r.Highlighting != nil {
+				inner |= pygmentsStyle(c.attrs["class"])
+			}
+			collect(c, inner)
+		}
+	}
+	collect(n, code)
+
+	// Split into lines, as highlight does
+	lines := []line{{}}
+	for _, s := range spans {
+		for i, part := range strings.Split(s.text, "\n") {
+			if i > 0 {
+				lines = append(lines, line{})
+			}
+			if part != "" {
+				lines[len(lines)-1] = append(lines[len(lines)-1], span{part, s.style})
+			}
+		}
+	}
+	if len(lines) > 1 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	out := []line{}
+	for _, l := range lines {
+		out = append(out, breakWord(l, width)...)
+	}
+	return out
+}
+
+// pygmentsStyle returns the style of code in a span with Pygments' class
+func pygmentsStyle(class string) style {
+	switch {
+	case class == "":
+		return 0
+	case class == "kt" || class == "nb" || class == "bp" || class == "nc" || class == "nf" ||
+		class == "fm" || class == "nt" || class == "nv" || class == "vg":
+		return highlighted | codeType
+	case class[0] == 'k' || class == "ow":
+		return highlighted | codeKeyword
+	case class[0] == 's':
+		return highlighted | codeString
+	case class[0] == 'c':
+		return highlighted | codeComment
+	case class[0] == 'm' || class == "il":
+		return highlighted | codeNumber
+	}
+	return highlighted
+}
+
+// htmlSpoiler renders a spoiler block: its header, then its hidden contents
+func (r Renderer) htmlSpoiler(n *node, width int) []line {
+	header := line{}
+	var contents []line
+	for _, c := range n.children {
+		switch {
+		case c.hasClass("spoiler-header"):
+			header = trimLine(line{{whitespace.ReplaceAllString(c.textContent(), " "), spoilerHeader}})
+		case c.hasClass("spoiler-content"):
+			contents = r.htmlBlocks(c, width-2, true)
+		}
+	}
+	return spoiler(header, contents, width)
+}
+
+// htmlTable renders a table a row to a line, with its cells separated by bars
+func (r Renderer) htmlTable(n *node, width int) []line {
+	out := []line{}
+	var rows func(n *node)
+	rows = func(n *node) {
+		for _, c := range n.children {
+			if c.tag != "tr" {
+				rows(c)
+				continue
+			}
+			row := line{}
+			for _, cell := range c.children {
+				if cell.tag != "td" && cell.tag != "th" {
+					continue
+				}
+				if len(row) > 0 {
+					row = append(row, span{" │ ", quoteMarker})
+				}
+				s := style(0)
+				if cell.tag == "th" {
+					s = bold
+				}
+				row = append(row, trimLine(r.htmlInline(cell, s))...)
+			}
+			out = append(out, wrap(row, width)...)
+		}
+	}
+	rows(n)
+	return out
+}
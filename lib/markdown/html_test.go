@@ -0,0 +1,70 @@
+package markdown
+
+import "testing"
+
+func TestRenderHTML(t *testing.T) {
+	r := Renderer{BaseURL: "https://zulip.example.com/"}
+	for _, tt := range []struct{ src, want string }{
+		{"<p>one</p><p>two</p>", "one\n\ntwo"},
+		{"<p>a<br>b</p>", "a\nb"},
+		{"<p>a\n  b</p>", "a b"},
+		{"<p>a &amp; b &lt;c&gt;</p>", "a & b <c>"},
+		{"<p><strong>b</strong> <em>i</em> <code>c</code></p>", "b i c"},
+		{"<p><del>gone</del></p>", "~~gone~~"},
+		{"<h1>Title</h1><p>text</p>", "Title\n\ntext"},
+		{"<blockquote><p>q</p></blockquote>", "│ q"},
+		{"<ul><li>one</li><li>two</li></ul>", "• one\n• two"},
+		{`<ol start="3"><li>c</li><li>d</li></ol>`, "3. c\n4. d"},
+		{`<p><a href="https://example.com">site</a></p>`, "site (https://example.com)"},
+		{`<p><a href="/#narrow/stream/1">here</a></p>`, "here (https://zulip.example.com/#narrow/stream/1)"},
+		{`<p><a href="https://example.com">https://example.com</a></p>`, "https://example.com"},
+		{`<p><span class="user-mention" data-user-id="1">@Hamlet</span></p>`, "@Hamlet"},
+		{`<p><a class="stream" href="/#narrow/stream/1-general">#general</a></p>`, "#general"},
+		{`<p><span class="emoji emoji-1f419" title="octopus">:octopus:</span> hi</p>`, "🐙  hi"},
+		{`<p><img alt=":zulip:" src="/static/zulip.png"></p>`, ":zulip:"},
+		{`<div class="codehilite"><pre><span class="k">func</span> f()` + "\n" + `}</pre></div>`, "func f()\n}"},
+		{`<div class="spoiler-block"><div class="spoiler-header"><p>Secret</p></div><div class="spoiler-content"><p>hidden</p></div></div>`, "▸ Secret\n  hidden"},
+		{`<div class="spoiler-block"><div class="spoiler-header"></div><div class="spoiler-content"><p>hidden</p></div></div>`, "▸ Spoiler\n  hidden"},
+		{"<table><tr><th>a</th><th>b</th></tr><tr><td>1</td><td>2</td></tr></table>", "a │ b\n1 │ 2"},
+	} {
+		if got := Strip(r.RenderHTML(tt.src)); got != tt.want {
+			t.Errorf("RenderHTML(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// Entities are decoded before control characters are removed, so that an entity
+// cannot put an escape code on the terminal, and HTML which cannot be parsed is shown
+// as its text rather than cut short
+func TestRenderHTMLUntrusted(t *testing.T) {
+	for src, want := range map[string]string{
+		"<p>esc &#27;[31mred</p>":                    "esc [31mred",
+		`<p><a href="https://x.test/&#27;[2J">x</a>`: "x",
+		"<p>ctrl &#1; char</p><p>after</p>":          "ctrl char\n\nafter",
+		"<p>broken &#1;</p><ul><li>a<br>b</li></ul>": "broken\n\na\n\nb",
+	} {
+		got := Renderer{}.RenderHTML(src)
+		if got != want {
+			t.Errorf("RenderHTML(%q) = %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestPygmentsStyle(t *testing.T) {
+	for class, want := range map[string]style{
+		"":   0,
+		"k":  highlighted | codeKeyword,
+		"kd": highlighted | codeKeyword,
+		"ow": highlighted | codeKeyword,
+		"kt": highlighted | codeType,
+		"nf": highlighted | codeType,
+		"s2": highlighted | codeString,
+		"c1": highlighted | codeComment,
+		"mi": highlighted | codeNumber,
+		"p":  highlighted,
+	} {
+		if got := pygmentsStyle(class); got != want {
+			t.Errorf("pygmentsStyle(%q) = %v, want %v", class, got, want)
+		}
+	}
+}
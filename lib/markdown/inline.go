@@ -0,0 +1,305 @@
+package markdown
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mjec/clisiana/lib/emoji"
+)
+
+// escapable is the characters which a backslash stops being treated as markdown
+const escapable = "\\`*_{}[]()#+-.!~>@|$"
+
+// inline parses the inline markdown in text: emphasis, code, links, mentions and so
+// on. Every span has at least the style base.
+func inline(text string, base style) line {
+	out := line{}
+	plain := strings.Builder{}
+	flush := func() {
+		if plain.Len() > 0 {
+			out = append(out, span{plain.String(), base})
+			plain.Reset()
+		}
+	}
+	emit := func(spans ...span) {
+		flush()
+		out = append(out, spans...)
+	}
+
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.IndexByte(escapable, rest[1]) >= 0:
+			plain.WriteByte(rest[1])
+			i += 2
+			continue
+
+		case rest[0] == '`':
+			fence := rest[:len(rest)-len(strings.TrimLeft(rest, "`"))]
+			if end := strings.Index(rest[len(fence):], fence); end >= 0 {
+				emit(span{strings.TrimSpace(rest[len(fence) : len(fence)+end]), base | code})
+				i += len(fence)*2 + end
+				continue
+			}
+			plain.WriteString(fence)
+			i += len(fence)
+			continue
+
+		case strings.HasPrefix(rest, "@**") || strings.HasPrefix(rest, "@_**"):
+			start := strings.Index(rest, "**") + 2
+			if end := strings.Index(rest[start:], "**"); end > 0 {
+				name := rest[start : start+end]
+				if bar := strings.LastIndex(name, "|"); bar >= 0 {
+					name = name[:bar]
+				}
+				if rest[1] != '_' {
+					name = "@" + name
+				}
+				emit(span{name, base | mention})
+				i += start + end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "@*") || strings.HasPrefix(rest, "@_*"):
+			// A user group
+			start := strings.Index(rest, "*") + 1
+			if end := strings.Index(rest[start:], "*"); end > 0 {
+				name := rest[start : start+end]
+				if rest[1] != '_' {
+					name = "@" + name
+				}
+				emit(span{name, base | mention})
+				i += start + end + 1
+				continue
+			}
+
+		case strings.HasPrefix(rest, "#**"):
+			if end := strings.Index(rest[3:], "**"); end > 0 {
+				name := rest[3 : 3+end]
+				if gt := strings.Index(name, ">"); gt >= 0 {
+					name = name[:gt] + " > " + name[gt+1:]
+				}
+				emit(span{"#" + name, base | streamLink})
+				i += 3 + end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**"):
+			if end := closingDelimiter(rest[2:], "**"); end > 0 {
+				emit(inline(rest[2:2+end], base|bold)...)
+				i += 2 + end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "~~"):
+			if end := closingDelimiter(rest[2:], "~~"); end > 0 {
+				emit(struckThrough(inline(rest[2:2+end], base|strikethrough), base)...)
+				i += 2 + end + 2
+				continue
+			}
+
+		case rest[0] == '*':
+			if end := closingDelimiter(rest[1:], "*"); end > 0 && !strings.HasPrefix(rest[1+end:], "**") {
+				emit(inline(rest[1:1+end], base|italic)...)
+				i += 1 + end + 1
+				continue
+			}
+
+		case rest[0] == '[':
+			if text, target, n, ok := link(rest); ok {
+				if text == target || text == "" {
+					emit(span{target, base | url})
+				} else {
+					emit(inline(text, base|linkText)...)
+					emit(span{" (", base}, span{target, base | url}, span{")", base})
+				}
+				i += n
+				continue
+			}
+
+		case rest[0] == ':':
+			if m := shortcode.FindString(rest); m != "" {
+				if glyph, ok := emoji.Glyph(strings.Trim(m, ":")); ok {
+					emit(span{emoji.Padded(glyph), base})
+					i += len(m)
+					continue
+				}
+			}
+
+		case strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://"):
+			if i == 0 || !isWordRune(lastRune(text[:i])) {
+				n := strings.IndexFunc(rest, unicode.IsSpace)
+				if n < 0 {
+					n = len(rest)
+				}
+				// Trailing punctuation is more likely to end the sentence than the URL
+				target := strings.TrimRight(rest[:n], ".,;:!?'\")")
+				emit(span{target, base | url})
+				i += len(target)
+				continue
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(rest)
+		plain.WriteString(rest[:size])
+		i += size
+	}
+	flush()
+	return out
+}
+
+// closingDelimiter returns the index in s of the delimiter which closes emphasis
+// opened just before s, or -1 if there is none. The emphasised text may not start or
+// end with a space.
+func closingDelimiter(s string, delimiter string) int {
+	if s == "" || s[0] == ' ' {
+		return -1
+	}
+	for start := 0; ; {
+		end := strings.Index(s[start:], delimiter)
+		if end < 0 {
+			return -1
+		}
+		end += start
+		if end > 0 && s[end-1] != ' ' {
+			return end
+		}
+		start = end + len(delimiter)
+	}
+}
+
+// link parses a markdown link at the start of s, e.g. "[Zulip](https://zulip.com)",
+// returning its text, its target and its length
+func link(s string) (text string, target string, n int, ok bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			if !strings.HasPrefix(s[i+1:], "(") {
+				return "", "", 0, false
+			}
+			end := strings.Index(s[i+2:], ")")
+			if end < 0 {
+				return "", "", 0, false
+			}
+			return s[1:i], strings.TrimSpace(s[i+2 : i+2+end]), i + 2 + end + 1, true
+		}
+	}
+	return "", "", 0, false
+}
+
+func lastRune(s string) rune {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return r
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wrap breaks l into lines no wider than width, between words where possible
+func wrap(l line, width int) []line {
+	if width < 1 {
+		width = 1
+	}
+	out := []line{}
+	current := line{}
+	currentWidth := 0
+	var spaces line
+	spacesWidth := 0
+
+	for _, w := range words(l) {
+		ww := w.width()
+		if strings.TrimLeft(w[0].text, " ") == "" {
+			spaces = append(spaces, w...)
+			spacesWidth += ww
+			continue
+		}
+		if currentWidth > 0 && currentWidth+spacesWidth+ww > width {
+			out = append(out, current)
+			current, currentWidth = line{}, 0
+			spaces, spacesWidth = nil, 0
+		}
+		if currentWidth+spacesWidth+ww > width {
+			// Too long for a line of its own
+			pieces := breakWord(append(spaces, w...), width)
+			out = append(out, pieces[:len(pieces)-1]...)
+			current = pieces[len(pieces)-1]
+			currentWidth = current.width()
+		} else {
+			current = append(append(current, spaces...), w...)
+			currentWidth += spacesWidth + ww
+		}
+		spaces, spacesWidth = nil, 0
+	}
+	return append(out, current)
+}
+
+// words splits l into words and runs of spaces, each of which may be in several styles
+func words(l line) []line {
+	out := []line{}
+	current := line{}
+	inSpace := false
+	for _, s := range l {
+		start := 0
+		for i, r := range s.text {
+			if (r == ' ') != inSpace {
+				if i > start {
+					current = append(current, span{s.text[start:i], s.style})
+				}
+				if len(current) > 0 {
+					out = append(out, current)
+				}
+				current = line{}
+				start = i
+				inSpace = r == ' '
+			}
+		}
+		if start < len(s.text) {
+			current = append(current, span{s.text[start:], s.style})
+		}
+	}
+	if len(current) > 0 {
+		out = append(out, current)
+	}
+	return out
+}
+
+// breakWord breaks l into lines of exactly width columns, apart from the last
+func breakWord(l line, width int) []line {
+	if width < 1 {
+		width = 1
+	}
+	out := []line{}
+	current := line{}
+	currentWidth := 0
+	for _, s := range l {
+		text := s.text
+		for text != "" {
+			if currentWidth == width {
+				out = append(out, current)
+				current, currentWidth = line{}, 0
+			}
+			n := 0
+			end := len(text)
+			for i := range text {
+				if n == width-currentWidth {
+					end = i
+					break
+				}
+				n++
+			}
+			current = append(current, span{text[:end], s.style})
+			currentWidth += n
+			text = text[end:]
+		}
+	}
+	return append(out, current)
+}
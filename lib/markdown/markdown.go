@@ -0,0 +1,364 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Renderer turns Zulip's dialect of markdown into text styled with ANSI escape codes,
+// for display in a terminal
+type Renderer struct {
+	Width        int     // the number of columns to wrap lines to, or 0 not to wrap
+	Highlighting *Scheme // the colours to highlight code in, or nil not to highlight it
+	BaseURL      string  // the realm's URL, which relative links in HTML are relative to
+}
+
+// style is a set of the ways a span of text is displayed
+type style uint
+
+// style flags
+const (
+	bold style = 1 << iota
+	italic
+	strikethrough
+	code
+	linkText
+	url
+	mention
+	streamLink
+	quoteMarker
+	spoilerHeader
+	hidden      // spoiler contents
+	highlighted // code in a language which is highlighted
+	codeKeyword
+	codeString
+	codeComment
+	codeNumber
+	codeType
+)
+
+// span is a run of text displayed in a single style
+type span struct {
+	text  string
+	style style
+}
+
+// line is a line of rendered output
+type line []span
+
+// noWrap is the width used when lines are not to be wrapped
+const noWrap = int(^uint(0) >> 1)
+
+var (
+	escapeCode   = regexp.MustCompile("\x1b\\[[0-9;]*m")
+	fenceOpening = regexp.MustCompile("^(```+|~~~+)[ \t]*(.*)$")
+	listItem     = regexp.MustCompile(`^([*+-]|[0-9]+[.)])( +)(.*)$`)
+	heading      = regexp.MustCompile(`^#{1,6} +(.*?)[ #]*$`)
+	shortcode    = regexp.MustCompile(`^:[a-z0-9_+-]+:`)
+)
+
+// Render returns src rendered for the terminal. There is no newline at the end.
+func (r Renderer) Render(src string) string {
+	width := r.Width
+	if width < 1 {
+		width = noWrap
+	}
+	lines := r.blocks(strings.Split(sanitize(src), "\n"), width)
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = l.format(r.Highlighting)
+	}
+	return strings.Join(out, "\n")
+}
+
+// Strip returns s without any ANSI escape codes, i.e. the text which is displayed
+func Strip(s string) string {
+	return escapeCode.ReplaceAllString(s, "")
+}
+
+// sanitize removes control characters from src, so that a message cannot send escape
+// codes to the terminal, and replaces tabs with spaces
+func sanitize(src string) string {
+	src = strings.ReplaceAll(src, "\t", "    ")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n':
+			return r
+		case r < ' ' || r == 0x7f:
+			return -1
+		}
+		return r
+	}, src)
+}
+
+// blocks renders lines of markdown, wrapped to width
+func (r Renderer) blocks(lines []string, width int) []line {
+	out := []line{}
+	blank := false
+	for i := 0; i < len(lines); i++ {
+		text := strings.TrimRight(lines[i], " ")
+		trimmed := strings.TrimLeft(text, " ")
+		indent := len(text) - len(trimmed)
+
+		if trimmed == "" {
+			// Runs of blank lines are shown as one, and only between other lines
+			blank = len(out) > 0
+			continue
+		}
+		if blank {
+			out = append(out, line{})
+			blank = false
+		}
+
+		switch {
+		case fenceOpening.MatchString(trimmed) && indent < 4:
+			match := fenceOpening.FindStringSubmatch(trimmed)
+			body, end := fencedBody(lines[i+1:], match[1], indent)
+			out = append(out, r.fenced(match[2], body, width)...)
+			i += end
+
+		case strings.HasPrefix(trimmed, ">"):
+			quoted := []string{}
+			for ; i < len(lines); i++ {
+				t := strings.TrimLeft(lines[i], " ")
+				if !strings.HasPrefix(t, ">") {
+					break
+				}
+				t = strings.TrimPrefix(t, ">")
+				quoted = append(quoted, strings.TrimPrefix(t, " "))
+			}
+			i--
+			out = append(out, quote(r.blocks(quoted, width-2))...)
+
+		case listItem.MatchString(trimmed):
+			match := listItem.FindStringSubmatch(trimmed)
+			marker := match[1]
+			if len(marker) == 1 {
+				marker = "•"
+			}
+			item := []string{match[3]}
+			contentIndent := indent + len(match[1]) + len(match[2])
+			for i+1 < len(lines) {
+				next := lines[i+1]
+				nextTrimmed := strings.TrimLeft(next, " ")
+				nextIndent := len(next) - len(nextTrimmed)
+				if nextTrimmed == "" || nextIndent <= indent {
+					break
+				}
+				if nextIndent > contentIndent {
+					nextIndent = contentIndent
+				}
+				item = append(item, next[nextIndent:])
+				i++
+			}
+			prefix := marker + " "
+			n := utf8.RuneCountInString(prefix)
+			out = append(out, indented(r.blocks(item, width-n), span{prefix, 0}, span{strings.Repeat(" ", n), 0}, 0)...)
+
+		case heading.MatchString(trimmed):
+			text := heading.FindStringSubmatch(trimmed)[1]
+			out = append(out, wrap(inline(text, bold), width)...)
+
+		default:
+			out = append(out, wrap(inline(text, 0), width)...)
+		}
+	}
+	return out
+}
+
+// fencedBody returns the lines of a fenced block which starts just before lines and
+// is opened by fence, and how many lines it and its closing fence take up. An
+// unclosed block runs to the end.
+func fencedBody(lines []string, fence string, indent int) (body []string, end int) {
+	for i, l := range lines {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+			return body, i + 1
+		}
+		trimmed := strings.TrimLeft(l, " ")
+		if n := len(l) - len(trimmed); n > indent {
+			trimmed = l[indent:]
+		}
+		body = append(body, trimmed)
+	}
+	return body, len(lines)
+}
+
+// fenced renders a fenced block, whose info string (after the fence) is info: a quote,
+// a spoiler or code
+func (r Renderer) fenced(info string, body []string, width int) []line {
+	words := strings.Fields(info)
+	kind := ""
+	if len(words) > 0 {
+		kind = strings.ToLower(words[0])
+	}
+	switch kind {
+	case "quote":
+		return quote(r.blocks(body, width-2))
+	case "spoiler":
+		header := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(info), words[0]))
+		return spoiler(inline(header, spoilerHeader), r.blocks(body, width-2), width)
+	}
+	return r.codeBlock(kind, body, width)
+}
+
+// codeBlock renders lines of code in the language lang, breaking them at width rather
+// than between words. Code in languages which are not known is not highlighted.
+func (r Renderer) codeBlock(lang string, body []string, width int) []line {
+	lines := make([]line, len(body))
+	if l, ok := languages[lang]; ok && r.Highlighting != nil {
+		lines = highlight(l, strings.Join(body, "\n"))
+	} else {
+		for i, text := range body {
+			lines[i] = line{{text, code}}
+		}
+	}
+	out := []line{}
+	for _, l := range lines {
+		out = append(out, breakWord(l, width)...)
+	}
+	return out
+}
+
+// quote renders lines as a block quote
+func quote(lines []line) []line {
+	marker := span{"│ ", quoteMarker}
+	return indented(lines, marker, marker, 0)
+}
+
+// spoiler renders a spoiler block: header, then contents hidden and indented beneath
+// it. An empty header is shown as "Spoiler".
+func spoiler(header line, contents []line, width int) []line {
+	if len(header) == 0 {
+		header = line{{"Spoiler", spoilerHeader}}
+	}
+	out := wrap(append(line{{"▸ ", spoilerHeader}}, header...), width)
+	padding := span{"  ", 0}
+	return append(out, indented(contents, padding, padding, hidden)...)
+}
+
+// struckThrough returns content struck through. The tildes are kept because the main
+// view cannot strike text through.
+func struckThrough(content line, base style) line {
+	marker := span{"~~", base | strikethrough}
+	return append(append(line{marker}, content...), marker)
+}
+
+// indented returns lines with first before the first of them and rest before the
+// others. The style extra is added to each span of lines.
+func indented(lines []line, first span, rest span, extra style) []line {
+	if len(lines) == 0 {
+		return []line{{first}}
+	}
+	out := make([]line, len(lines))
+	for i, l := range lines {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		out[i] = append(line{prefix}, l...)
+		for j := 1; j < len(out[i]); j++ {
+			out[i][j].style |= extra
+		}
+	}
+	return out
+}
+
+// width returns the number of columns l takes up
+func (l line) width() int {
+	n := 0
+	for _, s := range l {
+		n += utf8.RuneCountInString(s.text)
+	}
+	return n
+}
+
+// format returns l with escape codes for its styles, highlighting code in scheme
+func (l line) format(scheme *Scheme) string {
+	var b strings.Builder
+	for i := 0; i < len(l); i++ {
+		s := l[i]
+		// Neighbouring spans in the same style share an escape code
+		for i+1 < len(l) && l[i+1].style == s.style {
+			s.text += l[i+1].text
+			i++
+		}
+		if s.text == "" {
+			continue
+		}
+		params := s.style.sgr(scheme)
+		if params == "0" {
+			b.WriteString(s.text)
+			continue
+		}
+		b.WriteString("\x1b[" + params + "m")
+		b.WriteString(s.text)
+		b.WriteString("\x1b[0m")
+	}
+	return b.String()
+}
+
+// sgr returns the parameters of the escape code which selects s. Colours come before
+// attributes, because gocui resets the attributes when it sets the foreground colour.
+// gocui cannot show italics or strikethrough, so italics are also underlined and
+// struck-through text keeps its tildes (see inline).
+func (s style) sgr(scheme *Scheme) string {
+	if s&hidden != 0 {
+		return "30;40"
+	}
+	if s&highlighted != 0 && scheme != nil {
+		return scheme.sgr(s)
+	}
+	params := []string{}
+	switch {
+	case s&code != 0:
+		params = append(params, "33")
+	case s&mention != 0:
+		params = append(params, "35")
+	case s&streamLink != 0:
+		params = append(params, "36")
+	case s&url != 0:
+		params = append(params, "34")
+	case s&(quoteMarker|spoilerHeader) != 0:
+		params = append(params, "32")
+	}
+	if s&(bold|mention|streamLink|spoilerHeader) != 0 {
+		params = append(params, "1")
+	}
+	if s&italic != 0 {
+		params = append(params, "3", "4")
+	}
+	if s&(linkText|url) != 0 {
+		params = append(params, "4")
+	}
+	if s&strikethrough != 0 {
+		params = append(params, "9")
+	}
+	if len(params) == 0 {
+		return "0"
+	}
+	return strings.Join(params, ";")
+}
+
+// sgr returns the parameters of the escape code which selects the colour of code in
+// the style s
+func (scheme *Scheme) sgr(s style) string {
+	params := scheme.Plain
+	switch {
+	case s&codeKeyword != 0:
+		params = scheme.Keyword
+	case s&codeString != 0:
+		params = scheme.String
+	case s&codeComment != 0:
+		params = scheme.Comment
+	case s&codeNumber != 0:
+		params = scheme.Number
+	case s&codeType != 0:
+		params = scheme.Type
+	}
+	if params == "" {
+		return "0"
+	}
+	return params
+}
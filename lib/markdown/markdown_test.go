@@ -0,0 +1,65 @@
+package markdown
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name  string
+		width int
+		src   string
+		want  string
+	}{
+		{"plain", 0, "hello world", "hello world"},
+		{"wrapped", 20, "a long line that needs to be wrapped at twenty", "a long line that\nneeds to be wrapped\nat twenty"},
+		{"blank lines collapsed", 0, "one\n\n\n\ntwo", "one\n\ntwo"},
+		{"escaped", 0, `\*not\* emphasis`, "*not* emphasis"},
+		{"heading", 0, "## Heading ##", "Heading"},
+		{"bullet list", 0, "- one\n- two", "• one\n• two"},
+		{"numbered list", 0, "1. one\n2. two", "1. one\n2. two"},
+		{"quote", 0, "> quoted\n> more", "│ quoted\n│ more"},
+		{"link", 0, "[site](https://example.com)", "site (https://example.com)"},
+		{"bare link", 0, "[https://example.com](https://example.com)", "https://example.com"},
+		{"mention", 0, "@**Hamlet** and @**Horatio|12**", "@Hamlet and @Horatio"},
+		{"silent mention", 0, "@_**Ophelia**", "Ophelia"},
+		{"stream link", 0, "#**general>castle**", "#general > castle"},
+		{"strikethrough", 0, "~~gone~~", "~~gone~~"},
+		{"emoji", 0, "hi :tada: :zulip:", "hi 🎉  :zulip:"}, // padded, as it is two columns wide
+		{"code block", 0, "```\nx := 1\n```", "x := 1"},
+		{"code block broken", 4, "```\nabcdefgh\n```", "abcd\nefgh"},
+		{"spoiler", 0, "```spoiler Secret\nhidden\n```", "▸ Secret\n  hidden"},
+		{"spoiler without header", 0, "```spoiler\nhidden\n```", "▸ Spoiler\n  hidden"},
+		{"quote block", 0, "```quote\nquoted\n```", "│ quoted"},
+		{"control characters", 0, "esc \x1b[31mred\x07", "esc [31mred"},
+		{"tab", 0, "```\n\tx\n```", "    x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Strip(Renderer{Width: tt.width}.Render(tt.src)); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderStyles(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"bold", "**bold** text", "\x1b[1mbold\x1b[0m text"},
+		{"italic", "*it*", "\x1b[3;4mit\x1b[0m"},
+		{"inline code", "`x := 1`", "\x1b[33mx := 1\x1b[0m"},
+		{"strikethrough", "~~gone~~", "\x1b[9m~~gone~~\x1b[0m"},
+		{"mention", "@**Hamlet**", "\x1b[35;1m@Hamlet\x1b[0m"},
+		{"quote", "> q", "\x1b[32m│ \x1b[0mq"},
+		{"spoiler", "```spoiler\nhidden\n```", "\x1b[32;1m▸ Spoiler\x1b[0m\n  \x1b[30;40mhidden\x1b[0m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Renderer{}).Render(tt.src); got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
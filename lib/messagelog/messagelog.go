@@ -0,0 +1,302 @@
+package messagelog
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	// Registers the sqlite3 driver with database/sql
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// schema is run every time the log is opened, so must be idempotent.
+// The triggers make sure the log is append-only.
+const schema = `
+CREATE TABLE IF NOT EXISTS log (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	direction    TEXT NOT NULL,
+	message_id   INTEGER NOT NULL,
+	type         TEXT NOT NULL,
+	timestamp    INTEGER NOT NULL,
+	sender       TEXT NOT NULL,
+	recipient    TEXT NOT NULL,
+	topic        TEXT NOT NULL,
+	content      TEXT NOT NULL,
+	content_type TEXT NOT NULL DEFAULT 'text/x-markdown',
+	UNIQUE (direction, message_id)
+);
+CREATE INDEX IF NOT EXISTS log_timestamp ON log (timestamp);
+CREATE INDEX IF NOT EXISTS log_recipient_topic ON log (recipient, topic);
+CREATE TRIGGER IF NOT EXISTS log_no_update BEFORE UPDATE ON log
+BEGIN
+	SELECT RAISE(ABORT, 'the message log is append-only');
+END;
+CREATE TRIGGER IF NOT EXISTS log_no_delete BEFORE DELETE ON log
+BEGIN
+	SELECT RAISE(ABORT, 'the message log is append-only');
+END;
+`
+
+// Direction is either Incoming or Outgoing
+type Direction string
+
+// Direction constants
+const (
+	Incoming Direction = "incoming" // Incoming is a message received from the server
+	Outgoing Direction = "outgoing" // Outgoing is a message sent by this client
+)
+
+// Entry is a single message in the log
+type Entry struct {
+	Direction   Direction
+	MessageID   int64
+	Type        zulip.MessageType
+	Timestamp   time.Time
+	Sender      string // email address
+	Recipient   string // stream name, or sorted comma separated email addresses for private messages
+	Topic       string // empty for private messages
+	Content     string // raw markdown, or HTML for incoming messages fetched as HTML
+	ContentType string // zulip.MarkdownContent or zulip.HTMLContent
+}
+
+// Query restricts the entries returned by Log.Query(). Zero values are not used to
+// restrict the results.
+type Query struct {
+	Since  time.Time // only entries at or after this time
+	Until  time.Time // only entries before this time
+	Stream string    // only entries to this stream
+	Topic  string    // only entries with this topic
+	PMWith string    // only private messages which include this email address
+	Limit  int       // at most this many entries (the newest ones)
+}
+
+// Log is an append-only log of messages, backed by an SQLite3 database
+type Log struct {
+	db *sql.DB
+}
+
+// Open opens (creating if necessary) the log stored in the file at path
+func Open(path string) (*Log, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time, so avoid "database is locked" errors
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = addContentType(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Log{db: db}, nil
+}
+
+// addContentType adds the content_type column to a log made before it existed, every
+// entry of which is markdown
+func addContentType(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('log')")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == "content_type" {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec("ALTER TABLE log ADD COLUMN content_type TEXT NOT NULL DEFAULT 'text/x-markdown'")
+	return err
+}
+
+// Close closes the underlying database
+func (l *Log) Close() error {
+	return l.db.Close()
+}
+
+// Append adds entries to the log. An entry with the same Direction and MessageID as
+// one already in the log is ignored, so the same message may safely be appended twice.
+func (l *Log) Append(entries ...Entry) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO log
+		(direction, message_id, type, timestamp, sender, recipient, topic, content, content_type)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for i := range entries {
+		if _, err = stmt.Exec(string(entries[i].Direction),
+			entries[i].MessageID,
+			typeString(entries[i].Type),
+			entries[i].Timestamp.Unix(),
+			entries[i].Sender,
+			entries[i].Recipient,
+			entries[i].Topic,
+			entries[i].Content,
+			contentType(entries[i].ContentType)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Query returns the entries in the log which match q, oldest first
+func (l *Log) Query(q Query) ([]Entry, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if !q.Since.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "timestamp < ?")
+		args = append(args, q.Until.Unix())
+	}
+	if q.Stream != "" {
+		where = append(where, "type = 'stream' AND recipient = ?")
+		args = append(args, q.Stream)
+	}
+	if q.Topic != "" {
+		where = append(where, "topic = ?")
+		args = append(args, q.Topic)
+	}
+	if q.PMWith != "" {
+		where = append(where, "type = 'private' AND ',' || recipient || ',' LIKE ?")
+		args = append(args, "%,"+strings.ToLower(q.PMWith)+",%")
+	}
+	limit := ""
+	if q.Limit > 0 {
+		limit = " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := l.db.Query(`SELECT direction, message_id, type, timestamp, sender, recipient, topic, content, content_type
+		FROM log WHERE `+strings.Join(where, " AND ")+` ORDER BY timestamp DESC, id DESC`+limit, args...)
+	if err != nil {
+		return []Entry{}, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var direction, messageType string
+		var timestamp int64
+		if err = rows.Scan(&direction, &e.MessageID, &messageType, &timestamp, &e.Sender, &e.Recipient, &e.Topic, &e.Content, &e.ContentType); err != nil {
+			return []Entry{}, err
+		}
+		e.Direction = Direction(direction)
+		e.Timestamp = time.Unix(timestamp, 0)
+		if messageType == "private" {
+			e.Type = zulip.PrivateMessage
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return []Entry{}, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// IncomingEntry returns an Entry recording a message received from the server
+func IncomingEntry(m zulip.Message) Entry {
+	e := Entry{
+		Direction:   Incoming,
+		MessageID:   m.ID,
+		Type:        m.Type,
+		Timestamp:   time.Unix(m.Timestamp, 0),
+		Sender:      m.SenderEmail,
+		Recipient:   m.DisplayRecipient.Stream,
+		Topic:       m.Subject,
+		Content:     m.Content,
+		ContentType: m.ContentType,
+	}
+	if m.Type == zulip.PrivateMessage {
+		emails := make([]string, len(m.DisplayRecipient.Users))
+		for i := range m.DisplayRecipient.Users {
+			emails[i] = m.DisplayRecipient.Users[i].Email
+		}
+		e.Recipient = recipientList(emails)
+	}
+	return e
+}
+
+// OutgoingStreamEntry returns an Entry recording a stream message sent by sender
+func OutgoingStreamEntry(msgid int64, sender string, m zulip.OutgoingStreamMessage) Entry {
+	return Entry{
+		Direction: Outgoing,
+		MessageID: msgid,
+		Type:      zulip.StreamMessage,
+		Timestamp: time.Now(),
+		Sender:    sender,
+		Recipient: m.Stream,
+		Topic:     m.Topic,
+		Content:   m.Content,
+	}
+}
+
+// OutgoingPrivateEntry returns an Entry recording a private message sent by sender
+func OutgoingPrivateEntry(msgid int64, sender string, m zulip.OutgoingPrivateMessage) Entry {
+	return Entry{
+		Direction: Outgoing,
+		MessageID: msgid,
+		Type:      zulip.PrivateMessage,
+		Timestamp: time.Now(),
+		Sender:    sender,
+		Recipient: recipientList(append([]string{sender}, m.To...)),
+		Content:   m.Content,
+	}
+}
+
+// contentType returns t, or zulip.MarkdownContent if it is empty, as messages sent by
+// this client and those from older servers are markdown
+func contentType(t string) string {
+	if t == "" {
+		return zulip.MarkdownContent
+	}
+	return t
+}
+
+// recipientList returns emails in the form stored in the recipient column: lower
+// case, de-duplicated, sorted and comma separated
+func recipientList(emails []string) string {
+	seen := map[string]bool{}
+	list := []string{}
+	for i := range emails {
+		email := strings.ToLower(strings.TrimSpace(emails[i]))
+		if email != "" && !seen[email] {
+			seen[email] = true
+			list = append(list, email)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func typeString(t zulip.MessageType) string {
+	if t == zulip.PrivateMessage {
+		return "private"
+	}
+	return "stream"
+}
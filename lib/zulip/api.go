@@ -1,118 +1,17 @@
 package zulip
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
-	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 )
 
-// openRequests contains a list of all open requests
-var openRequests []chan struct{}
-
-// A mutex to prevent multiple routines attempting to modify openRequests at once
-var openRequestsMutex sync.Mutex
-
-// Transport is the transport used for HTTP requests to the Zulip server
-var transport *http.Transport
-
-// CancelAllRequests cancels all currently open requests to the Zulip server
-func CancelAllRequests() {
-	openRequestsMutex.Lock()
-	for i := range openRequests {
-		close(openRequests[i])
-	}
-	openRequests = []chan struct{}{}
-	openRequestsMutex.Unlock()
-}
-
-// A helper function to handle HTTP requests to the Zulip server specified in the context
-func makeZulipRequest(context *Context, params url.Values, url string, method HTTPMethod) (resp *http.Response, done chan<- bool, err error) {
-	if transport == nil {
-		transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}
-		if context.Secure == false {
-			transport = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-		}
-	}
-
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   time.Duration(60 * time.Second),
-	}
-
-	var methodString string
-	switch method {
-	case POST:
-		methodString = "POST"
-	case PUT:
-		methodString = "PUT"
-	case GET:
-		methodString = "GET"
-	case HEAD:
-		methodString = "HEAD"
-	default:
-		log.Panic("Valid HTTPMethod not accepted by makeZulipRequest()!")
-	}
-
-	req, err := http.NewRequest(methodString, context.APIBase+"/"+url, strings.NewReader(params.Encode()))
-	if err != nil {
-		return nil, nil, err
-	}
-	req.SetBasicAuth(context.Email, context.APIKey)
-	switch method {
-	case POST:
-		req.Header.Add("Content-type", "application/x-www-form-urlencoded")
-	case GET:
-		req.URL.RawQuery = params.Encode()
-	}
-
-	cancel := make(chan struct{})
-	req.Cancel = cancel
-
-	openRequestsMutex.Lock()
-	openRequests = append(openRequests, cancel)
-	openRequestsMutex.Unlock()
-
-	doneChan := make(chan bool)
-	go func(req *http.Request, done chan bool) {
-		<-done
-		openRequestsMutex.Lock()
-		for i := range openRequests {
-			if openRequests[i] == req.Cancel {
-				close(openRequests[i])
-				openRequests[i] = openRequests[len(openRequests)-1]
-				openRequests[len(openRequests)-1] = nil
-				openRequests = openRequests[:len(openRequests)-1]
-				break
-			}
-		}
-		close(done)
-		openRequestsMutex.Unlock()
-	}(req, doneChan)
-
-	resp, err = client.Do(req)
-	return resp, doneChan, err
-}
-
 // A helper function to handle sending a private or stream message
-func sendMessage(context *Context,
+func (c *Client) sendMessage(ctx context.Context,
 	msgType MessageType,
 	messageContent string,
 	messageTo []string,
@@ -136,61 +35,183 @@ func sendMessage(context *Context,
 	params.Add("to", strings.Join(messageTo, ","))
 	params.Add("content", messageContent)
 
-	resp, done, err := makeZulipRequest(context, params, "messages", POST)
+	var ret zulipSendMessageReturn
+	_, err = c.makeZulipRequest(ctx, params, "messages", POST, &ret)
 	if err != nil {
-		done <- true
 		return 0, err
 	}
-	defer func() {
-		done <- true
-		resp.Body.Close()
-	}()
 
-	body := json.NewDecoder(resp.Body)
+	return ret.ID, nil
+}
 
-	var ret zulipSendMessageReturn
-	err = body.Decode(&ret)
-	if err != nil {
-		return 0, err
+// SendPrivateMessage sends a private message.
+// msg.To is an array of email addresses to which to send the message.
+func (c *Client) SendPrivateMessage(ctx context.Context, msg OutgoingPrivateMessage) (msgid int64, err error) {
+	return c.sendMessage(ctx, PrivateMessage, msg.Content, msg.To, "")
+}
+
+// SendStreamMessage sends a stream message.
+// msg.Stream is the name of a stream to send to and msg.Topic is the topic (which
+// must not be blank).
+func (c *Client) SendStreamMessage(ctx context.Context, msg OutgoingStreamMessage) (msgid int64, err error) {
+	return c.sendMessage(ctx, StreamMessage, msg.Content, []string{msg.Stream}, msg.Topic)
+}
+
+// UpdateMessage changes the content and/or topic of the message with ID messageID.
+// An empty content or topic is left unchanged. If the topic is changed, mode says
+// which other messages in the topic are moved with it.
+func (c *Client) UpdateMessage(ctx context.Context,
+	messageID int64,
+	content string,
+	topic string,
+	mode PropagateMode) error {
+
+	if content == "" && topic == "" {
+		return fmt.Errorf("Nothing to change in message %d", messageID)
 	}
 
-	if ret.Result != zulipSuccessResult {
-		return 0, fmt.Errorf("API call returned %s: %s", ret.Result, ret.Message)
+	params := url.Values{}
+	params.Add("message_id", strconv.FormatInt(messageID, 10))
+	if content != "" {
+		params.Add("content", content)
+	}
+	if topic != "" {
+		params.Add("subject", topic)
+		params.Add("propagate_mode", mode.String())
 	}
 
-	return ret.ID, nil
+	var ret zulipReturn
+	_, err := c.makeZulipRequest(ctx, params, fmt.Sprintf("messages/%d", messageID), PATCH, &ret)
+	return err
 }
 
-// SendPrivateMessage sends a private message using the Context.
-// messageTo is an array of email addresses to which to send the message.
-// messageSubject may be blank.
-func SendPrivateMessage(context *Context, msg OutgoingPrivateMessage) (msgid int64, err error) {
-	return sendMessage(context, PrivateMessage, msg.Content, msg.To, "")
+// DeleteMessage deletes the message with ID messageID
+func (c *Client) DeleteMessage(ctx context.Context, messageID int64) error {
+	var ret zulipReturn
+	_, err := c.makeZulipRequest(ctx, url.Values{}, fmt.Sprintf("messages/%d", messageID), DELETE, &ret)
+	return err
 }
 
-// SendStreamMessage sends a stream message using the Context.
-// messageTo is the name of a stream to send to and messageSubject is the topic (which
-// must not be blank).
-func SendStreamMessage(context *Context, msg OutgoingStreamMessage) (msgid int64, err error) {
-	return sendMessage(context, StreamMessage, msg.Content, []string{msg.Stream}, msg.Topic)
+// AddReaction reacts to the message with ID messageID with the emoji called emojiName
+// (e.g. 'octopus')
+func (c *Client) AddReaction(ctx context.Context, messageID int64, emojiName string) error {
+	params := url.Values{}
+	params.Add("emoji_name", emojiName)
+
+	var ret zulipReturn
+	_, err := c.makeZulipRequest(ctx, params, fmt.Sprintf("messages/%d/reactions", messageID), POST, &ret)
+	return err
 }
 
-//
-// func UpdateMessage() error {
-//
-// }
-//
-// func GetMessages() {
-//
-// }
-//
+// RemoveReaction removes the user's reaction with the emoji called emojiName from the
+// message with ID messageID
+func (c *Client) RemoveReaction(ctx context.Context, messageID int64, emojiName string) error {
+	params := url.Values{}
+	params.Add("emoji_name", emojiName)
+
+	var ret zulipReturn
+	_, err := c.makeZulipRequest(ctx, params, fmt.Sprintf("messages/%d/reactions", messageID), DELETE, &ret)
+	return err
+}
+
+// AddMessageFlag sets flag (e.g. ReadFlag) on each of the messages with the given IDs
+func (c *Client) AddMessageFlag(ctx context.Context, messageIDs []int64, flag string) error {
+	return c.updateMessageFlags(ctx, messageIDs, flag, AddOp)
+}
+
+// RemoveMessageFlag clears flag (e.g. ReadFlag) on each of the messages with the given IDs
+func (c *Client) RemoveMessageFlag(ctx context.Context, messageIDs []int64, flag string) error {
+	return c.updateMessageFlags(ctx, messageIDs, flag, RemoveOp)
+}
+
+func (c *Client) updateMessageFlags(ctx context.Context, messageIDs []int64, flag string, op EventOp) error {
+	jsonMessageIDs, err := json.Marshal(messageIDs)
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Add("messages", string(jsonMessageIDs))
+	params.Add("op", string(op))
+	params.Add("flag", flag)
+
+	var ret zulipReturn
+	_, err = c.makeZulipRequest(ctx, params, "messages/flags", POST, &ret)
+	return err
+}
+
+// GetMessages retreives up to numBefore messages before and numAfter messages after
+// the message with ID anchor (inclusive) which match narrow, oldest first. anchor may
+// also be AnchorOldest or AnchorNewest. foundOldest and foundNewest are true if the
+// returned messages include the oldest or newest message matching narrow, which means
+// there is nothing further to fetch in that direction. If applyMarkdown is true then
+// message content will be returned in HTML, otherwise markdown will be returned (as
+// the user entered it).
+func (c *Client) GetMessages(ctx context.Context,
+	narrow Narrow,
+	anchor int64,
+	numBefore int,
+	numAfter int,
+	applyMarkdown bool) (messages []Message, foundOldest bool, foundNewest bool, err error) {
+	if narrow == nil {
+		narrow = Narrow{}
+	}
+	jsonNarrow, err := json.Marshal(narrow)
+	if err != nil {
+		return []Message{}, false, false, err
+	}
+
+	params := url.Values{}
+	params.Add("anchor", strconv.FormatInt(anchor, 10))
+	params.Add("num_before", strconv.Itoa(numBefore))
+	params.Add("num_after", strconv.Itoa(numAfter))
+	params.Add("narrow", string(jsonNarrow[:]))
+	params.Add("apply_markdown", strconv.FormatBool(applyMarkdown))
+
+	var ret zulipMessagesReturn
+	_, err = c.makeZulipRequest(ctx, params, "messages", GET, &ret)
+	if err != nil {
+		return []Message{}, false, false, err
+	}
+
+	return ret.Messages, ret.FoundOldest, ret.FoundNewest, nil
+}
+
+// GetRawContent retrieves the content of the message with the given ID as markdown,
+// as the user entered it, whichever form the message was fetched in
+func (c *Client) GetRawContent(ctx context.Context, messageID int64) (string, error) {
+	params := url.Values{}
+	params.Add("apply_markdown", "false")
+
+	var ret zulipMessageReturn
+	_, err := c.makeZulipRequest(ctx, params, fmt.Sprintf("messages/%d", messageID), GET, &ret)
+	if err != nil {
+		return "", err
+	}
+	// Older servers only send raw_content, and newer ones may stop sending it
+	if ret.RawContent != "" || ret.Message.IsHTML() {
+		return ret.RawContent, nil
+	}
+	return ret.Message.Content, nil
+}
+
+// GetMessageHistory retrieves every version of the message with the given ID,
+// oldest first
+func (c *Client) GetMessageHistory(ctx context.Context, messageID int64) ([]MessageSnapshot, error) {
+	var ret zulipMessageHistoryReturn
+	_, err := c.makeZulipRequest(ctx, url.Values{}, fmt.Sprintf("messages/%d/history", messageID), GET, &ret)
+	if err != nil {
+		return []MessageSnapshot{}, err
+	}
+	return ret.MessageHistory, nil
+}
 
 // GetEvents retreives those events from the specified queue on the Zulip server
 // which occurred after lastEventID. If doNotBlock is true then the server will
 // return as soon as possible (a non-blocking reply). Otherwise the server will
 // hold the request open (block) until a new event is available or a few minutes
 // have passed (at which point the server will send a heartbeat event).
-func GetEvents(context *Context,
+// If the queue has expired, the error will match ErrBadEventQueueID.
+func (c *Client) GetEvents(ctx context.Context,
 	queueID string,
 	lastEventID int64,
 	doNotBlock bool) (events []Event, err error) {
@@ -199,28 +220,12 @@ func GetEvents(context *Context,
 	params.Add("last_event_id", strconv.FormatInt(lastEventID, 10))
 	params.Add("dont_block", strconv.FormatBool(doNotBlock))
 
-	resp, done, err := makeZulipRequest(context, params, "events", GET)
-	if err != nil {
-		done <- true
-		return []Event{}, err
-	}
-	defer func() {
-		done <- true
-		resp.Body.Close()
-	}()
-
-	body := json.NewDecoder(resp.Body)
-
 	var ret zulipEventsReturn
-	err = body.Decode(&ret)
+	_, err = c.makeZulipRequest(ctx, params, "events", GET, &ret)
 	if err != nil {
 		return []Event{}, err
 	}
 
-	if ret.Result != zulipSuccessResult {
-		return []Event{}, fmt.Errorf("API call returned %s: %s", ret.Result, ret.Message)
-	}
-
 	return ret.Events, nil
 }
 
@@ -231,76 +236,200 @@ func GetEvents(context *Context,
 // is 0 then all events will be returned. If applyMarkdown is true then event
 // text will be returned in HTML, otherwise markdown will be returned (as the user
 // entered it).
-func Register(context *Context,
+//
+// If message events are requested, unread is the user's unread messages at the time
+// the queue was registered (servers which are too old to report this leave it empty).
+func (c *Client) Register(ctx context.Context,
 	eventTypes EventType,
-	applyMarkdown bool) (queueID string, lastEventID int64, err error) {
+	applyMarkdown bool) (queueID string, lastEventID int64, unread UnreadMessages, err error) {
 
 	if eventTypes == 0 {
-		eventTypes = MessageEvent | SubscriptionsEvent | RealmUserEvent | PointerEvent
+		eventTypes = AllEvents
 	}
 
 	params := url.Values{}
 	params.Add("apply_markdown", strconv.FormatBool(applyMarkdown))
 
 	jsonEventTypesArray := []string{}
-	if eventTypes&MessageEvent > 0 {
-		jsonEventTypesArray = append(jsonEventTypesArray, "message")
+	for _, n := range eventTypeNames {
+		if eventTypes&n.eventType > 0 {
+			jsonEventTypesArray = append(jsonEventTypesArray, n.name)
+		}
 	}
-	if eventTypes&SubscriptionsEvent > 0 {
-		jsonEventTypesArray = append(jsonEventTypesArray, "subscriptions")
+	jsonEventTypes, err := json.Marshal(jsonEventTypesArray)
+	if err != nil {
+		return "", 0, UnreadMessages{}, err
 	}
-	if eventTypes&RealmUserEvent > 0 {
-		jsonEventTypesArray = append(jsonEventTypesArray, "realm_user")
+	params.Add("event_types", string(jsonEventTypes[:]))
+
+	var ret zulipRegisterReturn
+	_, err = c.makeZulipRequest(ctx, params, "register", POST, &ret)
+	if err != nil {
+		return "", 0, UnreadMessages{}, err
+	}
+
+	return ret.QueueID, ret.LastEventID, ret.UnreadMsgs, nil
+}
+
+// CanReachServer returns nil iff the Client's server can be reached successfully
+// Uses the generate_204 Zuplip API endpoint
+func (c *Client) CanReachServer(ctx context.Context) error {
+	resp, err := c.makeZulipRequest(ctx, url.Values{}, "generate_204", GET, nil)
+	if err != nil {
+		return err
 	}
-	if eventTypes&PointerEvent > 0 {
-		jsonEventTypesArray = append(jsonEventTypesArray, "pointer")
+	if resp.StatusCode != 204 {
+		return fmt.Errorf("%s", resp.Status)
 	}
-	jsonEventTypes, err := json.Marshal(jsonEventTypesArray)
+	return nil
+}
+
+// GetStreams retrieves every stream the user can see
+func (c *Client) GetStreams(ctx context.Context) ([]Stream, error) {
+	var ret zulipStreamsReturn
+	_, err := c.makeZulipRequest(ctx, url.Values{}, "streams", GET, &ret)
 	if err != nil {
-		return "", 0, err
+		return []Stream{}, err
 	}
-	params.Add("event_types", string(jsonEventTypes[:]))
+	return ret.Streams, nil
+}
 
-	resp, done, err := makeZulipRequest(context, params, "register", POST)
+// ListSubscriptions retrieves the streams the user is subscribed to. If
+// includeSubscribers is true, each Subscription's Subscribers is filled in.
+func (c *Client) ListSubscriptions(ctx context.Context, includeSubscribers bool) ([]Subscription, error) {
+	params := url.Values{}
+	params.Add("include_subscribers", strconv.FormatBool(includeSubscribers))
+
+	var ret zulipSubscriptionsReturn
+	_, err := c.makeZulipRequest(ctx, params, "users/me/subscriptions", GET, &ret)
 	if err != nil {
-		return "", 0, err
+		return []Subscription{}, err
 	}
-	defer func() {
-		done <- true
-		resp.Body.Close()
-	}()
+	return ret.Subscriptions, nil
+}
 
-	body := json.NewDecoder(resp.Body)
+// AddSubscriptions subscribes the user to the named streams, creating any which do
+// not exist. Returns the names of the streams the user has been subscribed to and of
+// those they were already subscribed to.
+func (c *Client) AddSubscriptions(ctx context.Context, streams []string) (subscribed []string, alreadySubscribed []string, err error) {
+	subscriptions := make([]map[string]string, len(streams))
+	for i := range streams {
+		subscriptions[i] = map[string]string{"name": streams[i]}
+	}
+	jsonSubscriptions, err := json.Marshal(subscriptions)
+	if err != nil {
+		return []string{}, []string{}, err
+	}
+	params := url.Values{}
+	params.Add("subscriptions", string(jsonSubscriptions))
 
-	var ret zulipRegisterReturn
-	err = body.Decode(&ret)
+	var ret zulipAddSubscriptionsReturn
+	_, err = c.makeZulipRequest(ctx, params, "users/me/subscriptions", POST, &ret)
 	if err != nil {
-		return "", 0, err
+		return []string{}, []string{}, err
+	}
+	subscribed, alreadySubscribed = []string{}, []string{}
+	// Both are keyed by the email address of the user subscribed, which is us
+	for _, names := range ret.Subscribed {
+		subscribed = append(subscribed, names...)
 	}
+	for _, names := range ret.AlreadySubscribed {
+		alreadySubscribed = append(alreadySubscribed, names...)
+	}
+	return subscribed, alreadySubscribed, nil
+}
 
-	if ret.Result != zulipSuccessResult {
-		return "", 0, fmt.Errorf("API call returned %s: %s", ret.Result, ret.Message)
+// RemoveSubscriptions unsubscribes the user from the named streams. Returns the names
+// of the streams the user has been unsubscribed from and of those they were not
+// subscribed to.
+func (c *Client) RemoveSubscriptions(ctx context.Context, streams []string) (removed []string, notSubscribed []string, err error) {
+	jsonStreams, err := json.Marshal(streams)
+	if err != nil {
+		return []string{}, []string{}, err
 	}
+	params := url.Values{}
+	params.Add("subscriptions", string(jsonStreams))
 
-	return ret.QueueID, ret.LastEventID, nil
+	var ret zulipRemoveSubscriptionsReturn
+	_, err = c.makeZulipRequest(ctx, params, "users/me/subscriptions", DELETE, &ret)
+	if err != nil {
+		return []string{}, []string{}, err
+	}
+	return ret.Removed, ret.NotSubscribed, nil
 }
 
-// CanReachServer returns true iff the context represents a server which can be reached successfully
-// Uses the generate_204 Zuplip API endpoint
-func CanReachServer(context *Context) error {
-	resp, done, err := makeZulipRequest(context, url.Values{}, "generate_204", GET)
+// GetStreamID retrieves the ID of the named stream
+func (c *Client) GetStreamID(ctx context.Context, stream string) (int64, error) {
+	params := url.Values{}
+	params.Add("stream", stream)
+
+	var ret zulipStreamIDReturn
+	_, err := c.makeZulipRequest(ctx, params, "get_stream_id", GET, &ret)
 	if err != nil {
-		done <- true
-		return err
+		return 0, err
 	}
-	defer func() {
-		done <- true
-		resp.Body.Close()
-	}()
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("%s", resp.Status)
+	return ret.StreamID, nil
+}
+
+// GetSubscribers retrieves the user IDs of everyone subscribed to the stream with the
+// given ID
+func (c *Client) GetSubscribers(ctx context.Context, streamID int64) ([]int64, error) {
+	var ret zulipSubscribersReturn
+	_, err := c.makeZulipRequest(ctx, url.Values{}, "streams/"+strconv.FormatInt(streamID, 10)+"/members", GET, &ret)
+	if err != nil {
+		return []int64{}, err
 	}
-	return nil
+	return ret.Subscribers, nil
+}
+
+// GetMembers retrieves every user in the realm, including deactivated users and bots
+func (c *Client) GetMembers(ctx context.Context) ([]Person, error) {
+	var ret zulipMembersReturn
+	_, err := c.makeZulipRequest(ctx, url.Values{}, "users", GET, &ret)
+	if err != nil {
+		return []Person{}, err
+	}
+	return ret.Members, nil
+}
+
+// GetProfile retrieves the details of the user the Client is authenticated as
+func (c *Client) GetProfile(ctx context.Context) (Person, error) {
+	var ret zulipProfileReturn
+	_, err := c.makeZulipRequest(ctx, url.Values{}, "users/me", GET, &ret)
+	if err != nil {
+		return Person{}, err
+	}
+	return ret.Person, nil
+}
+
+// GetRealmPresence retrieves the presence of every user in the realm who has been
+// seen recently, by email address and then by client name
+func (c *Client) GetRealmPresence(ctx context.Context) (map[string]map[string]ClientPresence, error) {
+	var ret zulipPresenceReturn
+	_, err := c.makeZulipRequest(ctx, url.Values{}, "realm/presence", GET, &ret)
+	if err != nil {
+		return map[string]map[string]ClientPresence{}, err
+	}
+	return ret.Presences, nil
+}
+
+// UpdatePresence reports the user's presence to the server. newUserInput should be
+// true if the user has done something since the last update. Returns the presence of
+// every user in the realm, as GetRealmPresence does.
+func (c *Client) UpdatePresence(ctx context.Context,
+	status PresenceStatus,
+	newUserInput bool) (map[string]map[string]ClientPresence, error) {
+
+	params := url.Values{}
+	params.Add("status", string(status))
+	params.Add("new_user_input", strconv.FormatBool(newUserInput))
+
+	var ret zulipPresenceReturn
+	_, err := c.makeZulipRequest(ctx, params, "users/me/presence", POST, &ret)
+	if err != nil {
+		return map[string]map[string]ClientPresence{}, err
+	}
+	return ret.Presences, nil
 }
 
 //
@@ -312,34 +441,6 @@ func CanReachServer(context *Context) error {
 //
 // }
 //
-// func GetProfile() {
-//
-// }
-//
-// func GetStreams() {
-//
-// }
-//
-// func GetMembers() {
-//
-// }
-//
-// func ListSubscriptions() {
-//
-// }
-//
-// func AddSubscriptions() {
-//
-// }
-//
-// func RemoveSubscriptions() {
-//
-// }
-//
-// func GetSubscribers() {
-//
-// }
-//
 // func RenderMessage() {
 //
 // }
@@ -0,0 +1,182 @@
+package zulip
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client makes requests to a Zulip server on behalf of a single user. Each Client has
+// its own HTTP transport, credentials and set of open requests, so several Clients
+// (e.g. for different accounts) can be used at once.
+type Client struct {
+	context    Context
+	httpClient *http.Client
+
+	// openRequests contains the cancel functions of all open requests, by request number
+	openRequests      map[int64]context.CancelFunc
+	nextRequestNumber int64
+	// A mutex to prevent multiple routines attempting to modify openRequests at once
+	openRequestsMutex sync.Mutex
+
+	// rateLimit is the rate limit last reported by the server
+	rateLimit      RateLimit
+	rateLimitMutex sync.Mutex
+}
+
+// NewClient returns a Client which makes requests using the authentication details
+// and settings in zulipContext. Later changes to those details require a new Client.
+func NewClient(zulipContext Context) *Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if zulipContext.Secure == false {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &Client{
+		context: zulipContext,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(60 * time.Second),
+		},
+		openRequests: make(map[int64]context.CancelFunc),
+	}
+}
+
+// APIBase returns the base URL of the Zulip API this Client makes requests to
+func (c *Client) APIBase() string {
+	return c.context.APIBase
+}
+
+// CancelAllRequests cancels all currently open requests made by this Client
+func (c *Client) CancelAllRequests() {
+	c.openRequestsMutex.Lock()
+	for i := range c.openRequests {
+		c.openRequests[i]()
+	}
+	c.openRequests = make(map[int64]context.CancelFunc)
+	c.openRequestsMutex.Unlock()
+}
+
+// A helper function to handle HTTP requests to the Zulip server. The request is
+// cancelled if ctx is done or CancelAllRequests() is called. Requests are delayed as
+// needed to stay within the server's rate limit, and retried if they hit it anyway.
+// If ret is not nil, the JSON response body is decoded into it, and if ret embeds
+// zulipReturn then an *APIError is returned if the server reports an error. The
+// response body is always closed.
+func (c *Client) makeZulipRequest(ctx context.Context,
+	params url.Values,
+	url string,
+	method HTTPMethod,
+	ret interface{}) (resp *http.Response, err error) {
+	var methodString string
+	switch method {
+	case POST:
+		methodString = "POST"
+	case PUT:
+		methodString = "PUT"
+	case GET:
+		methodString = "GET"
+	case HEAD:
+		methodString = "HEAD"
+	case PATCH:
+		methodString = "PATCH"
+	case DELETE:
+		methodString = "DELETE"
+	default:
+		log.Panic("Valid HTTPMethod not accepted by makeZulipRequest()!")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.openRequestsMutex.Lock()
+	requestNumber := c.nextRequestNumber
+	c.nextRequestNumber++
+	c.openRequests[requestNumber] = cancel
+	c.openRequestsMutex.Unlock()
+	defer func() {
+		c.openRequestsMutex.Lock()
+		delete(c.openRequests, requestNumber)
+		c.openRequestsMutex.Unlock()
+		cancel()
+	}()
+
+	for attempt := 0; ; attempt++ {
+		if err = c.waitForRateLimit(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = c.doZulipRequest(ctx, params, url, methodString, ret)
+		// A rate limited request was not acted on, so it is always safe to retry
+		if attempt < maxRateLimitRetries && errors.Is(err, ErrRateLimitHit) {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// doZulipRequest makes a single attempt at a request for makeZulipRequest()
+func (c *Client) doZulipRequest(ctx context.Context,
+	params url.Values,
+	url string,
+	methodString string,
+	ret interface{}) (resp *http.Response, err error) {
+	req, err := http.NewRequest(methodString, c.context.APIBase+"/"+url, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.context.Email, c.context.APIKey)
+	switch methodString {
+	case "POST", "PATCH":
+		req.Header.Add("Content-type", "application/x-www-form-urlencoded")
+	case "GET", "DELETE":
+		req.URL.RawQuery = params.Encode()
+	}
+
+	resp, err = c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var limited zulipRateLimitReturn
+		json.NewDecoder(resp.Body).Decode(&limited)
+		c.updateRateLimit(resp, time.Duration(limited.RetryAfter*float64(time.Second)))
+		if limited.Message == "" {
+			limited.Message = resp.Status
+		}
+		return resp, &APIError{HTTPStatus: resp.StatusCode, Code: RateLimitHitCode, Message: limited.Message}
+	}
+	c.updateRateLimit(resp, 0)
+
+	if ret == nil {
+		return resp, nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		if resp.StatusCode >= 400 {
+			// e.g. an HTML error page from a proxy
+			return resp, &APIError{HTTPStatus: resp.StatusCode, Message: resp.Status}
+		}
+		return resp, err
+	}
+	if r, ok := ret.(interface {
+		common() *zulipReturn
+	}); ok && r.common().Result != zulipSuccessResult {
+		return resp, newAPIError(resp.StatusCode, r.common())
+	}
+	return resp, nil
+}
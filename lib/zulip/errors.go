@@ -0,0 +1,89 @@
+package zulip
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorCode is the machine readable code the Zulip server sends with an error
+type ErrorCode string
+
+// ErrorCode constants for the codes sent by the Zulip server
+const (
+	BadRequestCode             ErrorCode = "BAD_REQUEST"
+	RequestVariableMissingCode ErrorCode = "REQUEST_VARIABLE_MISSING"
+	RequestVariableInvalidCode ErrorCode = "REQUEST_VARIABLE_INVALID"
+	BadEventQueueIDCode        ErrorCode = "BAD_EVENT_QUEUE_ID"
+	BadNarrowCode              ErrorCode = "BAD_NARROW"
+	RateLimitHitCode           ErrorCode = "RATE_LIMIT_HIT"
+	StreamDoesNotExistCode     ErrorCode = "STREAM_DOES_NOT_EXIST"
+	UnauthorizedCode           ErrorCode = "UNAUTHORIZED"
+	InvalidAPIKeyCode          ErrorCode = "INVALID_API_KEY"
+	UserDeactivatedCode        ErrorCode = "USER_DEACTIVATED"
+)
+
+// APIError is returned when the Zulip server responds to a request with an error.
+// Code may be empty, as older servers do not send one.
+type APIError struct {
+	HTTPStatus int       // e.g. 400
+	Code       ErrorCode // e.g. BAD_EVENT_QUEUE_ID
+	Message    string    // e.g. 'Bad event queue id: 1375801870:2942'
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("API call returned %d %s: %s", e.HTTPStatus, e.Code, e.Message)
+	}
+	return fmt.Sprintf("API call returned %d: %s", e.HTTPStatus, e.Message)
+}
+
+// Is enables errors.Is() to compare an error with the Err... variables in this
+// package. An APIError matches target if they have the same Code, or if target has
+// an HTTPStatus and they have the same HTTPStatus.
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	if !ok {
+		return false
+	}
+	if t.Code != "" && t.Code == e.Code {
+		return true
+	}
+	return t.HTTPStatus != 0 && t.HTTPStatus == e.HTTPStatus
+}
+
+// Errors to compare against with errors.Is()
+var (
+	// ErrBadEventQueueID means the event queue does not exist on the server, normally
+	// because it expired. Call Register to get a new queue.
+	ErrBadEventQueueID = &APIError{Code: BadEventQueueIDCode}
+	// ErrRateLimitHit means too many requests have been made recently
+	ErrRateLimitHit = &APIError{Code: RateLimitHitCode, HTTPStatus: http.StatusTooManyRequests}
+	// ErrStreamDoesNotExist means a stream named in the request does not exist
+	ErrStreamDoesNotExist = &APIError{Code: StreamDoesNotExistCode}
+	// ErrUnauthorized means the email address or API key was not accepted
+	ErrUnauthorized = &APIError{Code: UnauthorizedCode, HTTPStatus: http.StatusUnauthorized}
+	// ErrBadNarrow means a narrow passed to GetMessages was invalid
+	ErrBadNarrow = &APIError{Code: BadNarrowCode}
+)
+
+// newAPIError returns an APIError for an unsuccessful response, filling in the Code
+// for older servers which do not send one where it can be worked out from the message.
+func newAPIError(httpStatus int, ret *zulipReturn) *APIError {
+	e := &APIError{
+		HTTPStatus: httpStatus,
+		Code:       ErrorCode(ret.Code),
+		Message:    ret.Message,
+	}
+	if e.Code == "" {
+		switch {
+		case strings.HasPrefix(ret.Message, "Bad event queue id"):
+			e.Code = BadEventQueueIDCode
+		case strings.HasPrefix(ret.Message, "Invalid stream name"):
+			e.Code = StreamDoesNotExistCode
+		case strings.HasPrefix(ret.Message, "Invalid API key"):
+			e.Code = InvalidAPIKeyCode
+		}
+	}
+	return e
+}
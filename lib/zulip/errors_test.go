@@ -0,0 +1,90 @@
+package zulip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		status int
+		ret    zulipReturn
+		want   APIError
+	}{
+		{400, zulipReturn{Code: "BAD_EVENT_QUEUE_ID", Message: "Bad event queue id: 1:2"},
+			APIError{400, BadEventQueueIDCode, "Bad event queue id: 1:2"}},
+		// Older servers send no code, so it is worked out from the message
+		{400, zulipReturn{Message: "Bad event queue id: 1:2"},
+			APIError{400, BadEventQueueIDCode, "Bad event queue id: 1:2"}},
+		{400, zulipReturn{Message: "Invalid stream name 'x'"},
+			APIError{400, StreamDoesNotExistCode, "Invalid stream name 'x'"}},
+		{401, zulipReturn{Message: "Invalid API key"},
+			APIError{401, InvalidAPIKeyCode, "Invalid API key"}},
+		{400, zulipReturn{Message: "Something else"},
+			APIError{400, "", "Something else"}},
+	}
+	for _, tt := range tests {
+		if got := newAPIError(tt.status, &tt.ret); *got != tt.want {
+			t.Errorf("newAPIError(%d, %+v) = %+v, want %+v", tt.status, tt.ret, *got, tt.want)
+		}
+	}
+}
+
+func TestAPIErrorIs(t *testing.T) {
+	queue := &APIError{HTTPStatus: 400, Code: BadEventQueueIDCode}
+	limited := &APIError{HTTPStatus: 429, Message: "Too Many Requests"} // no code, as from a proxy
+	wrapped := fmt.Errorf("polling: %w", queue)
+
+	if !errors.Is(queue, ErrBadEventQueueID) || !errors.Is(wrapped, ErrBadEventQueueID) {
+		t.Error("a BAD_EVENT_QUEUE_ID error is not ErrBadEventQueueID")
+	}
+	if errors.Is(queue, ErrStreamDoesNotExist) {
+		t.Error("a BAD_EVENT_QUEUE_ID error is ErrStreamDoesNotExist")
+	}
+	if !errors.Is(limited, ErrRateLimitHit) {
+		t.Error("a 429 without a code is not ErrRateLimitHit")
+	}
+	if errors.Is(queue, ErrBadNarrow) || errors.Is(errors.New("Bad event queue id"), ErrBadEventQueueID) {
+		t.Error("an error matched the wrong code")
+	}
+}
+
+// Errors reach the caller as *APIError however the server reports them
+func TestRequestErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   APIError
+	}{
+		{400, `{"result":"error","msg":"Invalid narrow","code":"BAD_NARROW"}`,
+			APIError{400, BadNarrowCode, "Invalid narrow"}},
+		{401, `{"result":"error","msg":"Invalid API key"}`,
+			APIError{401, InvalidAPIKeyCode, "Invalid API key"}},
+		{502, `<html>Bad Gateway</html>`,
+			APIError{502, "", "502 Bad Gateway"}},
+		// A successful status does not make an error a success
+		{200, `{"result":"error","msg":"Odd"}`,
+			APIError{200, "", "Odd"}},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		_, err := NewClient(Context{APIBase: server.URL}).GetStreams(context.Background())
+		server.Close()
+
+		var got *APIError
+		if !errors.As(err, &got) {
+			t.Errorf("%d %s: got error %v, want an *APIError", tt.status, tt.body, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%d %s: got %+v, want %+v", tt.status, tt.body, *got, tt.want)
+		}
+	}
+}
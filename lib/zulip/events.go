@@ -0,0 +1,474 @@
+package zulip
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EventType is the type of Zulip API event
+type EventType int
+
+// EventType constants, can be bitwise or'd
+const (
+	MessageEvent            EventType = 1 << iota // MessageEvent is a new message
+	SubscriptionsEvent      EventType = 1 << iota // SubscriptionsEvent is a change to the user's subscriptions
+	RealmUserEvent          EventType = 1 << iota // RealmUserEvent is a user joining, leaving or changing their details
+	PointerEvent            EventType = 1 << iota // PointerEvent is a move of the user's pointer
+	HeartbeatEvent          EventType = 1 << iota // HeartbeatEvent is sent when nothing else has happened for a while
+	UpdateMessageEvent      EventType = 1 << iota // UpdateMessageEvent is an edit to a message
+	DeleteMessageEvent      EventType = 1 << iota // DeleteMessageEvent is the deletion of a message
+	ReactionEvent           EventType = 1 << iota // ReactionEvent is an emoji reaction being added or removed
+	TypingEvent             EventType = 1 << iota // TypingEvent is someone starting or stopping typing
+	PresenceEvent           EventType = 1 << iota // PresenceEvent is a change in a user's presence
+	StreamEvent             EventType = 1 << iota // StreamEvent is a stream being created, deleted or changed
+	UpdateMessageFlagsEvent EventType = 1 << iota // UpdateMessageFlagsEvent is a change to flags such as read or starred
+	RestartEvent            EventType = 1 << iota // RestartEvent is sent when the server has restarted
+	UnknownEvent            EventType = 1 << iota // UnknownEvent is an event this package cannot decode; see Event.Raw
+)
+
+// AllEvents is every type of event which can be requested from Register()
+const AllEvents = MessageEvent | SubscriptionsEvent | RealmUserEvent | PointerEvent |
+	UpdateMessageEvent | DeleteMessageEvent | ReactionEvent | TypingEvent | PresenceEvent |
+	StreamEvent | UpdateMessageFlagsEvent
+
+// eventTypeNames are the names the Zulip API uses for each EventType
+var eventTypeNames = []struct {
+	eventType EventType
+	name      string
+}{
+	{MessageEvent, "message"},
+	{SubscriptionsEvent, "subscription"},
+	{RealmUserEvent, "realm_user"},
+	{PointerEvent, "pointer"},
+	{HeartbeatEvent, "heartbeat"},
+	{UpdateMessageEvent, "update_message"},
+	{DeleteMessageEvent, "delete_message"},
+	{ReactionEvent, "reaction"},
+	{TypingEvent, "typing"},
+	{PresenceEvent, "presence"},
+	{StreamEvent, "stream"},
+	{UpdateMessageFlagsEvent, "update_message_flags"},
+	{RestartEvent, "restart"},
+}
+
+func (t EventType) String() string {
+	for _, n := range eventTypeNames {
+		if n.eventType == t {
+			return n.name
+		}
+	}
+	return "unknown"
+}
+
+// EventOp is the operation an event describes, for those event types which have one
+type EventOp string
+
+// EventOp constants
+const (
+	AddOp        EventOp = "add"         // e.g. a reaction, subscription or user was added
+	RemoveOp     EventOp = "remove"      // e.g. a reaction, subscription or user was removed
+	UpdateOp     EventOp = "update"      // e.g. a property of a subscription or user changed
+	PeerAddOp    EventOp = "peer_add"    // another user subscribed to a stream
+	PeerRemoveOp EventOp = "peer_remove" // another user unsubscribed from a stream
+	CreateOp     EventOp = "create"      // a stream was created
+	DeleteOp     EventOp = "delete"      // a stream was deleted
+	OccupyOp     EventOp = "occupy"      // a stream gained its first subscriber
+	VacateOp     EventOp = "vacate"      // a stream lost its last subscriber
+	StartOp      EventOp = "start"       // someone started typing
+	StopOp       EventOp = "stop"        // someone stopped typing
+)
+
+// Event is a structure for generic events. Only the field for the event's Type is set.
+type Event struct {
+	ID                 int64               `json:"id"`
+	Type               EventType           `json:"type"`
+	Message            Message             `json:"message,omitempty"`
+	Flags              []string            `json:"flags,omitempty"`
+	Pointer            int64               `json:"pointer,omitempty"`
+	UpdateMessage      *MessageUpdate      `json:"-"`
+	DeleteMessage      *MessageDeletion    `json:"-"`
+	Reaction           *ReactionUpdate     `json:"-"`
+	Typing             *TypingNotification `json:"-"`
+	Presence           *PresenceUpdate     `json:"-"`
+	Subscription       *SubscriptionUpdate `json:"-"`
+	RealmUser          *RealmUserUpdate    `json:"-"`
+	Stream             *StreamUpdate       `json:"-"`
+	UpdateMessageFlags *MessageFlagsUpdate `json:"-"`
+	Restart            *ServerRestart      `json:"-"`
+	Raw                json.RawMessage     `json:"-"` // the event as sent by the server, if Type is UnknownEvent
+}
+
+// UnmarshalJSON enables Event to be decoded from JSON. An event which is of an
+// unknown type, or which cannot be decoded, becomes an UnknownEvent rather than an
+// error, so that it does not prevent the other events in a batch from being handled.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var header struct {
+		ID   int64  `json:"id"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	*e = Event{ID: header.ID, Type: UnknownEvent}
+
+	var err error
+	switch header.Type {
+	case "message":
+		e.Type = MessageEvent
+		var aux struct {
+			Message Message  `json:"message"`
+			Flags   []string `json:"flags"`
+		}
+		err = json.Unmarshal(data, &aux)
+		e.Message, e.Flags = aux.Message, aux.Flags
+	case "heartbeat":
+		e.Type = HeartbeatEvent
+	case "pointer":
+		e.Type = PointerEvent
+		var aux struct {
+			Pointer int64 `json:"pointer"`
+		}
+		err = json.Unmarshal(data, &aux)
+		e.Pointer = aux.Pointer
+	case "update_message":
+		e.Type = UpdateMessageEvent
+		e.UpdateMessage = &MessageUpdate{}
+		err = json.Unmarshal(data, e.UpdateMessage)
+	case "delete_message":
+		e.Type = DeleteMessageEvent
+		e.DeleteMessage = &MessageDeletion{}
+		err = json.Unmarshal(data, e.DeleteMessage)
+	case "reaction":
+		e.Type = ReactionEvent
+		e.Reaction = &ReactionUpdate{}
+		err = json.Unmarshal(data, e.Reaction)
+	case "typing":
+		e.Type = TypingEvent
+		e.Typing = &TypingNotification{}
+		err = json.Unmarshal(data, e.Typing)
+	case "presence":
+		e.Type = PresenceEvent
+		e.Presence = &PresenceUpdate{}
+		err = json.Unmarshal(data, e.Presence)
+	case "subscription":
+		e.Type = SubscriptionsEvent
+		e.Subscription = &SubscriptionUpdate{}
+		err = json.Unmarshal(data, e.Subscription)
+	case "realm_user":
+		e.Type = RealmUserEvent
+		e.RealmUser = &RealmUserUpdate{}
+		err = json.Unmarshal(data, e.RealmUser)
+	case "stream":
+		e.Type = StreamEvent
+		e.Stream = &StreamUpdate{}
+		err = json.Unmarshal(data, e.Stream)
+	case "update_message_flags":
+		e.Type = UpdateMessageFlagsEvent
+		e.UpdateMessageFlags = &MessageFlagsUpdate{}
+		err = json.Unmarshal(data, e.UpdateMessageFlags)
+	case "restart":
+		e.Type = RestartEvent
+		e.Restart = &ServerRestart{}
+		err = json.Unmarshal(data, e.Restart)
+	}
+
+	if err != nil || e.Type == UnknownEvent {
+		*e = Event{ID: header.ID, Type: UnknownEvent}
+		e.Raw = append(json.RawMessage{}, data...)
+	}
+	return nil
+}
+
+// UserRef identifies a user in an event
+type UserRef struct {
+	UserID   int64  `json:"user_id"`             // e.g. 13215
+	Email    string `json:"email"`               // e.g. 'hamlet@example.com'
+	FullName string `json:"full_name,omitempty"` // e.g. 'Hamlet of Denmark'
+}
+
+// UnmarshalJSON enables UserRef to be decoded from JSON. Some objects, such as the
+// users in a message's reactions, give the user's ID as 'id'.
+func (u *UserRef) UnmarshalJSON(data []byte) error {
+	type Alias UserRef
+	aux := &struct {
+		ID int64 `json:"id"`
+		*Alias
+	}{
+		Alias: (*Alias)(u),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if u.UserID == 0 {
+		u.UserID = aux.ID
+	}
+	return nil
+}
+
+// MessageUpdate is the detail of an UpdateMessageEvent. Fields which did not change
+// are left empty.
+type MessageUpdate struct {
+	MessageID       int64   `json:"message_id"`       // e.g. 12345678
+	MessageIDs      []int64 `json:"message_ids"`      // every message changed, if the topic was changed for several
+	UserID          int64   `json:"user_id"`          // who made the change
+	EditTimestamp   int64   `json:"edit_timestamp"`   // e.g. 1375978403
+	StreamID        int64   `json:"stream_id"`        // e.g. 15
+	OrigSubject     string  `json:"orig_subject"`     // the topic before the change, if it changed
+	Subject         string  `json:"subject"`          // the topic after the change, if it changed
+	OrigContent     string  `json:"orig_content"`     // the content before the change, if it changed
+	Content         string  `json:"content"`          // the content after the change, if it changed
+	RenderedContent string  `json:"rendered_content"` // the content after the change as HTML
+	PropagateMode   string  `json:"propagate_mode"`   // e.g. 'change_one', 'change_later' or 'change_all'
+	RenderingOnly   bool    `json:"rendering_only"`   // true if the server only re-rendered the content, e.g. to add a link preview
+}
+
+// Apply makes the change described by u to m, which should be one of the messages
+// it affects. A message which was only re-rendered is not marked as edited.
+func (u *MessageUpdate) Apply(m *Message) {
+	if m.ID == u.MessageID {
+		switch {
+		case m.IsHTML() && u.RenderedContent != "":
+			m.Content = u.RenderedContent
+		case u.Content != "":
+			m.Content = u.Content
+			m.ContentType = MarkdownContent
+		}
+	}
+	if u.Subject != "" {
+		m.Subject = u.Subject
+	}
+	if u.EditTimestamp != 0 && !u.RenderingOnly {
+		m.LastEditTimestamp = u.EditTimestamp
+	}
+}
+
+// AffectedIDs returns the IDs of every message changed by u
+func (u *MessageUpdate) AffectedIDs() []int64 {
+	if len(u.MessageIDs) > 0 {
+		return u.MessageIDs
+	}
+	return []int64{u.MessageID}
+}
+
+// MessageDeletion is the detail of a DeleteMessageEvent
+type MessageDeletion struct {
+	MessageID   int64   `json:"message_id"`   // e.g. 12345678
+	MessageIDs  []int64 `json:"message_ids"`  // used instead of MessageID when several are deleted at once
+	MessageType string  `json:"message_type"` // 'stream' or 'private'
+	StreamID    int64   `json:"stream_id"`    // e.g. 15
+	Topic       string  `json:"topic"`        // e.g. 'Castle'
+}
+
+// AffectedIDs returns the IDs of every message deleted
+func (d *MessageDeletion) AffectedIDs() []int64 {
+	if len(d.MessageIDs) > 0 {
+		return d.MessageIDs
+	}
+	return []int64{d.MessageID}
+}
+
+// ReactionUpdate is the detail of a ReactionEvent
+type ReactionUpdate struct {
+	Op           EventOp `json:"op"`            // AddOp or RemoveOp
+	MessageID    int64   `json:"message_id"`    // e.g. 12345678
+	UserID       int64   `json:"user_id"`       // e.g. 13215
+	User         UserRef `json:"user"`          // the user who reacted
+	EmojiName    string  `json:"emoji_name"`    // e.g. 'octopus'
+	EmojiCode    string  `json:"emoji_code"`    // e.g. '1f419'
+	ReactionType string  `json:"reaction_type"` // e.g. 'unicode_emoji' or 'realm_emoji'
+}
+
+// Apply adds the reaction to, or removes it from, m
+func (r *ReactionUpdate) Apply(m *Message) {
+	if m.ID != r.MessageID {
+		return
+	}
+	userID := r.UserID
+	if userID == 0 {
+		userID = r.User.UserID
+	}
+	switch r.Op {
+	case AddOp:
+		for _, existing := range m.Reactions {
+			if existing.reactorID() == userID && existing.EmojiName == r.EmojiName {
+				return
+			}
+		}
+		m.Reactions = append(m.Reactions, Reaction{
+			EmojiName:    r.EmojiName,
+			EmojiCode:    r.EmojiCode,
+			ReactionType: r.ReactionType,
+			UserID:       userID,
+			User:         r.User,
+		})
+	case RemoveOp:
+		kept := []Reaction{}
+		for _, existing := range m.Reactions {
+			if existing.reactorID() != userID || existing.EmojiName != r.EmojiName {
+				kept = append(kept, existing)
+			}
+		}
+		m.Reactions = kept
+	}
+}
+
+// TypingNotification is the detail of a TypingEvent
+type TypingNotification struct {
+	Op         EventOp   `json:"op"`         // StartOp or StopOp
+	Sender     UserRef   `json:"sender"`     // who is typing
+	Recipients []UserRef `json:"recipients"` // who they are typing to, for private messages
+	StreamID   int64     `json:"stream_id"`  // the stream they are typing in, for stream messages
+	Topic      string    `json:"topic"`      // the topic they are typing in, for stream messages
+}
+
+// PresenceStatus is whether a user is active or idle
+type PresenceStatus string
+
+// PresenceStatus constants
+const (
+	ActivePresence  PresenceStatus = "active"  // ActivePresence means the user is using Zulip
+	IdlePresence    PresenceStatus = "idle"    // IdlePresence means the user has Zulip open but is not using it
+	OfflinePresence PresenceStatus = "offline" // OfflinePresence is never sent by the server; see AggregatePresence
+)
+
+// PresenceTimeout is how long after a client last reported its presence it is
+// considered to be offline
+const PresenceTimeout = 140 * time.Second
+
+// ClientPresence is a user's presence as reported by one of their clients
+type ClientPresence struct {
+	Client    string         `json:"client"`    // e.g. 'website'
+	Status    PresenceStatus `json:"status"`    // e.g. 'active'
+	Timestamp int64          `json:"timestamp"` // e.g. 1375978403
+	Pushable  bool           `json:"pushable"`
+}
+
+// AggregatePresence returns the overall status of a user whose clients have reported
+// the given presence, and when they were last seen. A user is offline if none of
+// their clients has reported within PresenceTimeout of now.
+func AggregatePresence(presence map[string]ClientPresence, now time.Time) (status PresenceStatus, lastSeen time.Time) {
+	status = OfflinePresence
+	for _, p := range presence {
+		if p.Timestamp == 0 {
+			continue
+		}
+		seen := time.Unix(p.Timestamp, 0)
+		if seen.After(lastSeen) {
+			lastSeen = seen
+		}
+		if now.Sub(seen) > PresenceTimeout {
+			continue
+		}
+		if p.Status == ActivePresence {
+			status = ActivePresence
+		} else if status == OfflinePresence {
+			status = IdlePresence
+		}
+	}
+	return status, lastSeen
+}
+
+// PresenceUpdate is the detail of a PresenceEvent
+type PresenceUpdate struct {
+	UserID          int64                     `json:"user_id"`          // e.g. 13215
+	Email           string                    `json:"email"`            // e.g. 'hamlet@example.com'
+	ServerTimestamp float64                   `json:"server_timestamp"` // e.g. 1375978403.5
+	Presence        map[string]ClientPresence `json:"presence"`         // by client name
+}
+
+// Subscription is a stream the user is subscribed to
+type Subscription struct {
+	StreamID    int64         `json:"stream_id"`             // e.g. 15
+	Name        string        `json:"name"`                  // e.g. 'Denmark'
+	Description string        `json:"description"`           // e.g. 'Discussion of Danish affairs'
+	Color       string        `json:"color"`                 // e.g. '#76ce90'
+	InviteOnly  bool          `json:"invite_only"`           // true if the stream is private
+	InHomeView  bool          `json:"in_home_view"`          // false if the stream is muted
+	Subscribers []interface{} `json:"subscribers,omitempty"` // user IDs (or emails from older servers), if requested
+}
+
+// SubscriptionUpdate is the detail of a SubscriptionsEvent
+type SubscriptionUpdate struct {
+	Op            EventOp        `json:"op"`            // e.g. AddOp or PeerAddOp
+	Subscriptions []Subscription `json:"subscriptions"` // for AddOp and RemoveOp
+	StreamID      int64          `json:"stream_id"`     // for UpdateOp
+	Name          string         `json:"name"`          // for UpdateOp
+	Property      string         `json:"property"`      // for UpdateOp, e.g. 'color'
+	Value         interface{}    `json:"value"`         // for UpdateOp, e.g. '#76ce90'
+	StreamIDs     []int64        `json:"stream_ids"`    // for PeerAddOp and PeerRemoveOp
+	UserIDs       []int64        `json:"user_ids"`      // for PeerAddOp and PeerRemoveOp
+}
+
+// Person is a user in the realm. In a RealmUserEvent which updates a user, fields
+// which did not change are left empty.
+type Person struct {
+	UserID   int64  `json:"user_id"`   // e.g. 13215
+	Email    string `json:"email"`     // e.g. 'hamlet@example.com'
+	FullName string `json:"full_name"` // e.g. 'Hamlet of Denmark'
+	IsAdmin  bool   `json:"is_admin"`
+	IsBot    bool   `json:"is_bot"`
+	IsActive bool   `json:"is_active"` // false if the user has been deactivated
+	Timezone string `json:"timezone"`  // e.g. 'Europe/Copenhagen'
+}
+
+// RealmUserUpdate is the detail of a RealmUserEvent
+type RealmUserUpdate struct {
+	Op     EventOp `json:"op"` // AddOp, RemoveOp or UpdateOp
+	Person Person  `json:"person"`
+}
+
+// Stream is a stream in the realm
+type Stream struct {
+	StreamID    int64  `json:"stream_id"`   // e.g. 15
+	Name        string `json:"name"`        // e.g. 'Denmark'
+	Description string `json:"description"` // e.g. 'Discussion of Danish affairs'
+	InviteOnly  bool   `json:"invite_only"` // true if the stream is private
+}
+
+// StreamUpdate is the detail of a StreamEvent
+type StreamUpdate struct {
+	Op       EventOp     `json:"op"`        // e.g. CreateOp or UpdateOp
+	Streams  []Stream    `json:"streams"`   // for CreateOp, DeleteOp, OccupyOp and VacateOp
+	StreamID int64       `json:"stream_id"` // for UpdateOp
+	Name     string      `json:"name"`      // for UpdateOp
+	Property string      `json:"property"`  // for UpdateOp, e.g. 'description'
+	Value    interface{} `json:"value"`     // for UpdateOp
+}
+
+// MessageFlagsUpdate is the detail of an UpdateMessageFlagsEvent
+type MessageFlagsUpdate struct {
+	Op       EventOp `json:"op"`       // AddOp or RemoveOp
+	Flag     string  `json:"flag"`     // e.g. 'read' or 'starred'
+	Messages []int64 `json:"messages"` // the IDs of the messages changed
+	All      bool    `json:"all"`      // true if the flag was changed on every message
+}
+
+// UnmarshalJSON enables MessageFlagsUpdate to be decoded from JSON. Newer servers
+// send the operation as 'op', older ones as 'operation'.
+func (u *MessageFlagsUpdate) UnmarshalJSON(data []byte) error {
+	type Alias MessageFlagsUpdate
+	aux := &struct {
+		Operation EventOp `json:"operation"`
+		*Alias
+	}{
+		Alias: (*Alias)(u),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if u.Op == "" {
+		u.Op = aux.Operation
+	}
+	if u.Op != AddOp && u.Op != RemoveOp {
+		return fmt.Errorf("Unknown flag operation '%s' when attempting to decode from JSON", u.Op)
+	}
+	return nil
+}
+
+// ServerRestart is the detail of a RestartEvent
+type ServerRestart struct {
+	ServerGeneration int64  `json:"server_generation"`
+	Immediate        bool   `json:"immediate"`     // true if clients should reload at once
+	ZulipVersion     string `json:"zulip_version"` // e.g. '2.1.0'
+}
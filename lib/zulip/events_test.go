@@ -0,0 +1,64 @@
+package zulip
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// A batch of events as the server might send it, one of each kind of oddity
+const eventBatch = `[
+	{"id": 0, "type": "message", "flags": ["read"], "message": {"id": 10, "type": "stream", "display_recipient": "general", "content": "hi"}},
+	{"id": 1, "type": "reaction", "op": "add", "message_id": 10, "user": {"id": 5, "email": "a@example.com"}, "emoji_name": "octopus"},
+	{"id": 2, "type": "update_message", "message_id": 10, "rendered_content": "<p>hi</p>", "rendering_only": true},
+	{"id": 3, "type": "update_message_flags", "operation": "remove", "flag": "starred", "messages": [10]},
+	{"id": 4, "type": "custom_profile_fields", "fields": []},
+	{"id": 5, "type": "update_message_flags", "op": "toggle", "flag": "read", "messages": [10]},
+	{"id": 6, "type": "reaction", "message_id": "ten"},
+	{"id": 7, "type": "heartbeat"}
+]`
+
+func TestDecodeEvents(t *testing.T) {
+	var events []Event
+	if err := json.Unmarshal([]byte(eventBatch), &events); err != nil {
+		t.Fatalf("decoding the batch failed: %v", err)
+	}
+	if len(events) != 8 {
+		t.Fatalf("decoded %d events, want 8", len(events))
+	}
+	for i, e := range events {
+		if e.ID != int64(i) {
+			t.Errorf("event %d has ID %d", i, e.ID)
+		}
+	}
+
+	if e := events[0]; e.Type != MessageEvent || e.Message.ID != 10 || len(e.Flags) != 1 {
+		t.Errorf("message event decoded as %+v", e)
+	}
+	if r := events[1].Reaction; events[1].Type != ReactionEvent || r.Op != AddOp || r.User.UserID != 5 || r.EmojiName != "octopus" {
+		t.Errorf("reaction event decoded as %+v", events[1])
+	}
+	if u := events[2].UpdateMessage; events[2].Type != UpdateMessageEvent || !u.RenderingOnly || u.RenderedContent != "<p>hi</p>" {
+		t.Errorf("update_message event decoded as %+v", events[2])
+	}
+	if u := events[3].UpdateMessageFlags; events[3].Type != UpdateMessageFlagsEvent || u.Op != RemoveOp || u.Flag != "starred" {
+		t.Errorf("update_message_flags event with 'operation' decoded as %+v", events[3])
+	}
+	if events[7].Type != HeartbeatEvent {
+		t.Errorf("heartbeat event decoded as %+v", events[7])
+	}
+
+	// Events which are unknown or malformed are kept as they were sent
+	for _, i := range []int{4, 5, 6} {
+		e := events[i]
+		if e.Type != UnknownEvent || e.Reaction != nil || e.UpdateMessageFlags != nil {
+			t.Errorf("event %d decoded as %+v, want an UnknownEvent", i, e)
+			continue
+		}
+		var raw struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal(e.Raw, &raw); err != nil || raw.ID != int64(i) {
+			t.Errorf("event %d has Raw %s", i, e.Raw)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package zulip
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimit is the limit on requests to the Zulip server, as last reported by it
+type RateLimit struct {
+	Known     bool      // false until the server has reported a limit
+	Limit     int       // the number of requests allowed in each period
+	Remaining int       // the number of requests left in this period
+	Reset     time.Time // when Remaining goes back up to Limit
+}
+
+// Waiting returns true if requests are being held back until Reset
+func (r RateLimit) Waiting() bool {
+	return r.Known && r.Remaining <= 0 && time.Now().Before(r.Reset)
+}
+
+// Low returns true if most of the requests allowed in this period have been used
+func (r RateLimit) Low() bool {
+	return r.Known && r.Remaining <= r.Limit/rateLimitPacingFraction && time.Now().Before(r.Reset)
+}
+
+// Once fewer than 1/rateLimitPacingFraction of the allowed requests are left, the
+// remaining requests are spread out evenly until the limit resets
+const rateLimitPacingFraction = 10
+
+// maxRateLimitRetries is the number of times a request which hit the rate limit is
+// retried (after waiting as long as the server asks) before giving up
+const maxRateLimitRetries = 3
+
+// delay returns how long to wait before the next request so as not to hit the limit
+func (r RateLimit) delay(now time.Time) time.Duration {
+	if !r.Known || !now.Before(r.Reset) {
+		return 0
+	}
+	if r.Remaining <= 0 {
+		return r.Reset.Sub(now)
+	}
+	if r.Remaining > r.Limit/rateLimitPacingFraction {
+		return 0
+	}
+	return r.Reset.Sub(now) / time.Duration(r.Remaining+1)
+}
+
+// RateLimit returns the current rate limit on requests made by this Client
+func (c *Client) RateLimit() RateLimit {
+	c.rateLimitMutex.Lock()
+	defer c.rateLimitMutex.Unlock()
+	return c.rateLimit
+}
+
+// waitForRateLimit blocks until a request may be made without exceeding the rate
+// limit, then counts the request against it. Returns an error only if ctx is done.
+func (c *Client) waitForRateLimit(ctx context.Context) error {
+	c.rateLimitMutex.Lock()
+	d := c.rateLimit.delay(time.Now())
+	if c.rateLimit.Known && c.rateLimit.Remaining > 0 {
+		// So that requests made at the same time do not all think there is room
+		c.rateLimit.Remaining--
+	}
+	c.rateLimitMutex.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// updateRateLimit records the rate limit reported in the headers of resp. If the
+// limit was hit, retryAfter is how long the server asked us to wait (if it said).
+func (c *Client) updateRateLimit(resp *http.Response, retryAfter time.Duration) {
+	c.rateLimitMutex.Lock()
+	defer c.rateLimitMutex.Unlock()
+
+	if limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit")); err == nil {
+		c.rateLimit.Limit = limit
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		c.rateLimit.Known = true
+		c.rateLimit.Remaining = remaining
+	}
+	if reset, err := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Reset"), 64); err == nil {
+		c.rateLimit.Reset = time.Unix(0, int64(reset*float64(time.Second)))
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	if retryAfter <= 0 {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	c.rateLimit.Known = true
+	c.rateLimit.Remaining = 0
+	if reset := time.Now().Add(retryAfter); reset.After(c.rateLimit.Reset) {
+		c.rateLimit.Reset = reset
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds
+// or an HTTP date. If it is missing or invalid, 1 second is assumed.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Sub(time.Now())
+	}
+	return time.Second
+}
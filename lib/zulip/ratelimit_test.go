@@ -0,0 +1,95 @@
+package zulip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitDelay(t *testing.T) {
+	now := time.Now()
+	reset := now.Add(10 * time.Second)
+	tests := []struct {
+		limit RateLimit
+		want  time.Duration
+	}{
+		{RateLimit{}, 0},
+		{RateLimit{Known: true, Limit: 200, Remaining: 150, Reset: reset}, 0},
+		// At a tenth of the limit, the rest are spread out until the reset
+		{RateLimit{Known: true, Limit: 200, Remaining: 20, Reset: reset}, 10 * time.Second / 21},
+		{RateLimit{Known: true, Limit: 200, Remaining: 1, Reset: reset}, 5 * time.Second},
+		{RateLimit{Known: true, Limit: 200, Remaining: 0, Reset: reset}, 10 * time.Second},
+		// Once the limit has reset there is nothing to wait for
+		{RateLimit{Known: true, Limit: 200, Remaining: 0, Reset: now}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.limit.delay(now); got != tt.want {
+			t.Errorf("%+v.delay() = %v, want %v", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("2.5"); got != 2500*time.Millisecond {
+		t.Errorf("parseRetryAfter(2.5) = %v", got)
+	}
+	for _, value := range []string{"", "soon", "-1"} {
+		if got := parseRetryAfter(value); got != time.Second {
+			t.Errorf("parseRetryAfter(%q) = %v, want 1s", value, got)
+		}
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, want about a minute", date, got)
+	}
+}
+
+// rateLimitedServer responds to the first limited requests with 429, then succeeds
+func rateLimitedServer(limited int) (*httptest.Server, *int) {
+	requests := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-RateLimit-Limit", "200")
+		if requests <= limited {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"result":"error","msg":"API usage exceeded rate limit","code":"RATE_LIMIT_HIT","retry-after":0.01}`)
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "199")
+		fmt.Fprint(w, `{"result":"success","msg":"","streams":[]}`)
+	})), &requests
+}
+
+func TestRateLimitedRequestsAreRetried(t *testing.T) {
+	server, requests := rateLimitedServer(2)
+	defer server.Close()
+	c := NewClient(Context{APIBase: server.URL})
+
+	if _, err := c.GetStreams(context.Background()); err != nil {
+		t.Fatalf("GetStreams() = %v after being rate limited twice", err)
+	}
+	if *requests != 3 {
+		t.Errorf("made %d requests, want 3", *requests)
+	}
+	if limit := c.RateLimit(); !limit.Known || limit.Limit != 200 || limit.Remaining != 199 {
+		t.Errorf("RateLimit() = %+v, want 199 of 200 remaining", limit)
+	}
+}
+
+func TestRateLimitedRequestsGiveUp(t *testing.T) {
+	server, requests := rateLimitedServer(maxRateLimitRetries + 1)
+	defer server.Close()
+
+	_, err := NewClient(Context{APIBase: server.URL}).GetStreams(context.Background())
+	if !errors.Is(err, ErrRateLimitHit) {
+		t.Errorf("GetStreams() = %v, want ErrRateLimitHit", err)
+	}
+	if *requests != maxRateLimitRetries+1 {
+		t.Errorf("made %d requests, want %d", *requests, maxRateLimitRetries+1)
+	}
+}
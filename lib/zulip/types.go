@@ -3,6 +3,8 @@ package zulip
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // HTTPMethod is a type representing various HTTP verbs
@@ -10,13 +12,15 @@ type HTTPMethod int
 
 // Each constatnt represents a HTTP verb
 const (
-	POST HTTPMethod = iota
-	GET  HTTPMethod = iota
-	PUT  HTTPMethod = iota
-	HEAD HTTPMethod = iota
+	POST   HTTPMethod = iota
+	GET    HTTPMethod = iota
+	PUT    HTTPMethod = iota
+	HEAD   HTTPMethod = iota
+	PATCH  HTTPMethod = iota
+	DELETE HTTPMethod = iota
 )
 
-// Context is a Zupli API context (authentication details)
+// Context is a Zupli API context (authentication details), used to create a Client
 type Context struct {
 	Email   string
 	APIKey  string
@@ -24,18 +28,6 @@ type Context struct {
 	Secure  bool
 }
 
-// EventType is the type of Zulip API event
-type EventType int
-
-// EventType constants, can be bitwise or'd
-const (
-	MessageEvent       EventType = 1 << iota
-	SubscriptionsEvent EventType = 1 << iota
-	RealmUserEvent     EventType = 1 << iota
-	PointerEvent       EventType = 1 << iota
-	HeartbeatEvent     EventType = 1 << iota
-)
-
 // MessageType is either StreamMessage or PrivateMessage
 type MessageType int
 
@@ -45,40 +37,92 @@ const (
 	PrivateMessage MessageType = iota // PrivateMessage is a message to one or more individual users
 )
 
-// Event is a structure for generic events
-type Event struct {
-	ID            int64       `json:"id"`
-	Type          EventType   `json:"type"`
-	Message       Message     `json:"message,omitempty"`
-	Flags         []string    `json:"flags,omitempty"`
-	Subscriptions interface{} `json:"subscriptions,omitempty"`
-	RealmUser     interface{} `json:"realm_user,omitempty"`
-	Pointer       interface{} `json:"pointer,omitempty"`
-}
+// PropagateMode says which messages a change of topic applies to
+type PropagateMode int
 
-// UnmarshalJSON enables Event to be decoded from JSON
-func (e *Event) UnmarshalJSON(data []byte) error {
-	type Alias Event
-	aux := &struct {
-		Type string `json:"type"`
-		*Alias
-	}{
-		Alias: (*Alias)(e),
-	}
-	if err := json.Unmarshal(data, &aux); err != nil {
-		return err
+// PropagateMode constants
+const (
+	ChangeOne   PropagateMode = iota // ChangeOne changes the topic of just the one message
+	ChangeLater PropagateMode = iota // ChangeLater also changes later messages in the same topic
+	ChangeAll   PropagateMode = iota // ChangeAll changes every message in the same topic
+)
+
+func (m PropagateMode) String() string {
+	switch m {
+	case ChangeLater:
+		return "change_later"
+	case ChangeAll:
+		return "change_all"
 	}
-	switch aux.Type {
-	case "message":
-		e.Type = MessageEvent
-	case "heartbeat":
-		e.Type = HeartbeatEvent
+	return "change_one"
+}
+
+// NarrowOperator is the type of filter applied by a NarrowTerm
+type NarrowOperator int
+
+// NarrowOperator constants
+const (
+	StreamNarrow NarrowOperator = iota // StreamNarrow matches messages to the stream named by the operand
+	TopicNarrow  NarrowOperator = iota // TopicNarrow matches messages with the topic given by the operand
+	PMWithNarrow NarrowOperator = iota // PMWithNarrow matches private messages with the comma separated emails in the operand
+	SenderNarrow NarrowOperator = iota // SenderNarrow matches messages sent by the email in the operand
+	SearchNarrow NarrowOperator = iota // SearchNarrow matches messages containing the search terms in the operand
+	IsNarrow     NarrowOperator = iota // IsNarrow matches messages with a property such as "starred" or "mentioned"
+	InNarrow     NarrowOperator = iota // InNarrow matches messages in a view such as "home" or "all"
+)
+
+// NarrowTerm is a single filter in a Narrow, e.g. stream:Denmark
+type NarrowTerm struct {
+	Operator NarrowOperator
+	Operand  string
+	Negated  bool
+}
+
+// MarshalJSON enables NarrowTerm to be encoded as JSON
+func (t NarrowTerm) MarshalJSON() ([]byte, error) {
+	var operator string
+	switch t.Operator {
+	case StreamNarrow:
+		operator = "stream"
+	case TopicNarrow:
+		operator = "topic"
+	case PMWithNarrow:
+		operator = "pm-with"
+	case SenderNarrow:
+		operator = "sender"
+	case SearchNarrow:
+		operator = "search"
+	case IsNarrow:
+		operator = "is"
+	case InNarrow:
+		operator = "in"
 	default:
-		return fmt.Errorf("Unknown event type '%s' when attempting to decode from JSON", aux.Type)
+		return nil, fmt.Errorf("Unknown narrow operator %d when attempting to encode to JSON", t.Operator)
 	}
-	return nil
+	return json.Marshal(struct {
+		Operator string `json:"operator"`
+		Operand  string `json:"operand"`
+		Negated  bool   `json:"negated,omitempty"`
+	}{operator, t.Operand, t.Negated})
 }
 
+// Narrow is a set of NarrowTerms, all of which a message must match.
+// An empty Narrow matches every message.
+type Narrow []NarrowTerm
+
+// Narrows for commonly used message properties
+var (
+	HomeNarrow      = Narrow{{Operator: InNarrow, Operand: "home"}}      // HomeNarrow matches messages in the user's home view
+	StarredNarrow   = Narrow{{Operator: IsNarrow, Operand: "starred"}}   // StarredNarrow matches starred messages
+	MentionedNarrow = Narrow{{Operator: IsNarrow, Operand: "mentioned"}} // MentionedNarrow matches messages mentioning the user
+)
+
+// Anchor values for GetMessages which do not refer to a real message ID
+const (
+	AnchorOldest int64 = 0                 // AnchorOldest anchors at the oldest message
+	AnchorNewest int64 = 10000000000000000 // AnchorNewest anchors at the newest message
+)
+
 // User is a structure for Zulip users
 type User struct {
 	ID            int64  `json:"id"`
@@ -91,23 +135,158 @@ type User struct {
 
 // Message is the main message object that is retreived from Zulip
 type Message struct {
-	ID               int64            `json:"id"`                // e.g. 12345678
-	ContentType      string           `json:"content_type"`      // e.g. 'text/x-markdown'
-	AvatarURL        string           `json:"avatar_url"`        // e.g. 'https://url/for/othello-bots/avatar'
-	Timestamp        int64            `json:"timestamp"`         // e.g. 1375978403
-	DisplayRecipient DisplayRecipient `json:"display_recipient"` // string or []User, see DisplayRecipient
-	SenderID         int64            `json:"sender_id"`         // e.g. 13215
-	SenderFullName   string           `json:"sender_full_name"`  // e.g. 'Othello Bot'
-	SenderEmail      string           `json:"sender_email"`      // e.g. 'othello-bot@example.com'
-	SenderShortName  string           `json:"sender_short_name"` // e.g. 'othello-bot'
-	SenderDomain     string           `json:"sender_domain"`     // e.g. 'example.com'
-	Content          string           `json:"content"`           // e.g. 'Something is rotten in the state of Denmark.'
-	GravatarHash     string           `json:"gravatar_hash"`     // e.g. '17d93357cca1e793739836ecbc7a9bf7'
-	RecipientID      int64            `json:"recipient_id"`      // e.g. 12314
-	Client           string           `json:"client"`            // e.g. 'website'
-	SubjectLinks     []interface{}    `json:"subject_links"`     // e.g. []
-	Subject          string           `json:"subject"`           // e.g. 'Castle'
-	Type             MessageType      `json:"type"`              // e.g. 'stream'
+	ID                int64            `json:"id"`                            // e.g. 12345678
+	ContentType       string           `json:"content_type"`                  // e.g. 'text/x-markdown'
+	AvatarURL         string           `json:"avatar_url"`                    // e.g. 'https://url/for/othello-bots/avatar'
+	Timestamp         int64            `json:"timestamp"`                     // e.g. 1375978403
+	DisplayRecipient  DisplayRecipient `json:"display_recipient"`             // string or []User, see DisplayRecipient
+	SenderID          int64            `json:"sender_id"`                     // e.g. 13215
+	SenderFullName    string           `json:"sender_full_name"`              // e.g. 'Othello Bot'
+	SenderEmail       string           `json:"sender_email"`                  // e.g. 'othello-bot@example.com'
+	SenderShortName   string           `json:"sender_short_name"`             // e.g. 'othello-bot'
+	SenderDomain      string           `json:"sender_domain"`                 // e.g. 'example.com'
+	Content           string           `json:"content"`                       // e.g. 'Something is rotten in the state of Denmark.'
+	GravatarHash      string           `json:"gravatar_hash"`                 // e.g. '17d93357cca1e793739836ecbc7a9bf7'
+	RecipientID       int64            `json:"recipient_id"`                  // e.g. 12314
+	StreamID          int64            `json:"stream_id,omitempty"`           // e.g. 15, for stream messages
+	Client            string           `json:"client"`                        // e.g. 'website'
+	SubjectLinks      []interface{}    `json:"subject_links"`                 // e.g. []
+	Subject           string           `json:"subject"`                       // e.g. 'Castle'
+	Type              MessageType      `json:"type"`                          // e.g. 'stream'
+	LastEditTimestamp int64            `json:"last_edit_timestamp,omitempty"` // e.g. 1375978403, or 0 if never edited
+	Reactions         []Reaction       `json:"reactions,omitempty"`           // in the order they were made
+}
+
+// Content types of a Message
+const (
+	MarkdownContent = "text/x-markdown" // MarkdownContent is markdown as the sender wrote it
+	HTMLContent     = "text/html"       // HTMLContent is HTML rendered from the markdown by the server
+)
+
+// IsHTML returns true if m's content is HTML rather than markdown
+func (m Message) IsHTML() bool {
+	return m.ContentType == HTMLContent
+}
+
+// Message flags which can be added or removed with AddMessageFlag and RemoveMessageFlag
+const (
+	ReadFlag    = "read"    // ReadFlag is set on messages the user has read
+	StarredFlag = "starred" // StarredFlag is set on messages the user has starred
+)
+
+// UnreadMessages is the user's unread messages when an event queue was registered,
+// grouped by conversation
+type UnreadMessages struct {
+	Count    int            `json:"count"`    // the total number of unread messages
+	PMs      []UnreadPM     `json:"pms"`      // one-to-one private messages
+	Streams  []UnreadStream `json:"streams"`  // stream messages, by stream and topic
+	Huddles  []UnreadHuddle `json:"huddles"`  // group private messages
+	Mentions []int64        `json:"mentions"` // the IDs of unread messages which mention the user
+}
+
+// UnreadPM is the unread messages in a one-to-one private message conversation
+type UnreadPM struct {
+	OtherUserID      int64   `json:"other_user_id"`      // the other participant, on newer servers
+	SenderID         int64   `json:"sender_id"`          // the other participant, on older servers
+	UnreadMessageIDs []int64 `json:"unread_message_ids"` // oldest first
+}
+
+// UserID returns the ID of the other participant in the conversation
+func (u UnreadPM) UserID() int64 {
+	if u.OtherUserID != 0 {
+		return u.OtherUserID
+	}
+	return u.SenderID
+}
+
+// UnreadStream is the unread messages in one topic of a stream
+type UnreadStream struct {
+	StreamID         int64   `json:"stream_id"`          // e.g. 15
+	Topic            string  `json:"topic"`              // e.g. 'Castle'
+	UnreadMessageIDs []int64 `json:"unread_message_ids"` // oldest first
+}
+
+// UnreadHuddle is the unread messages in a group private message conversation
+type UnreadHuddle struct {
+	UserIDsString    string  `json:"user_ids_string"`    // e.g. '4,13,15', including the user
+	UnreadMessageIDs []int64 `json:"unread_message_ids"` // oldest first
+}
+
+// UserIDs returns the IDs of everyone in the conversation, including the user
+func (u UnreadHuddle) UserIDs() []int64 {
+	ids := []int64{}
+	for _, s := range strings.Split(u.UserIDsString, ",") {
+		if id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Reaction is an emoji reaction to a message by one user
+type Reaction struct {
+	EmojiName    string  `json:"emoji_name"`    // e.g. 'octopus'
+	EmojiCode    string  `json:"emoji_code"`    // e.g. '1f419'
+	ReactionType string  `json:"reaction_type"` // e.g. 'unicode_emoji' or 'realm_emoji'
+	UserID       int64   `json:"user_id"`       // e.g. 13215
+	User         UserRef `json:"user"`          // the user who reacted
+}
+
+// reactorID returns the ID of the user who reacted, which older servers only give in User
+func (r Reaction) reactorID() int64 {
+	if r.UserID != 0 {
+		return r.UserID
+	}
+	return r.User.UserID
+}
+
+// ReactionCount is the number of users who reacted to a message with one emoji
+type ReactionCount struct {
+	EmojiName    string
+	EmojiCode    string
+	ReactionType string
+	Count        int
+}
+
+// ReactionCounts returns the number of reactions to m with each emoji, in the order
+// each emoji was first used
+func (m *Message) ReactionCounts() []ReactionCount {
+	counts := []ReactionCount{}
+	index := make(map[string]int)
+	for _, r := range m.Reactions {
+		i, ok := index[r.EmojiName]
+		if !ok {
+			i = len(counts)
+			index[r.EmojiName] = i
+			counts = append(counts, ReactionCount{EmojiName: r.EmojiName, EmojiCode: r.EmojiCode, ReactionType: r.ReactionType})
+		}
+		counts[i].Count++
+	}
+	return counts
+}
+
+// HasReaction returns true if the user with the given ID has reacted to m with the
+// emoji called emojiName
+func (m *Message) HasReaction(userID int64, emojiName string) bool {
+	for _, r := range m.Reactions {
+		if r.EmojiName == emojiName && r.reactorID() == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// MessageSnapshot is one version of a message, from its edit history
+type MessageSnapshot struct {
+	UserID              int64  `json:"user_id"`               // who made this version, e.g. 13215
+	Timestamp           int64  `json:"timestamp"`             // e.g. 1375978403
+	Topic               string `json:"topic"`                 // e.g. 'Castle'
+	PrevTopic           string `json:"prev_topic"`            // the topic before this version, if it changed
+	Content             string `json:"content"`               // e.g. 'Something is rotten in the state of Denmark.'
+	RenderedContent     string `json:"rendered_content"`      // Content as HTML
+	PrevContent         string `json:"prev_content"`          // the content before this version, if it changed
+	PrevRenderedContent string `json:"prev_rendered_content"` // PrevContent as HTML
+	ContentHTMLDiff     string `json:"content_html_diff"`     // the change to the content, as HTML
 }
 
 // UnmarshalJSON enables Message to be decoded from JSON
@@ -133,6 +312,27 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON enables Message to be encoded as JSON, in the form it is received from Zulip
+func (m Message) MarshalJSON() ([]byte, error) {
+	type Alias Message
+	var messageType string
+	switch m.Type {
+	case StreamMessage:
+		messageType = "stream"
+	case PrivateMessage:
+		messageType = "private"
+	default:
+		return nil, fmt.Errorf("Unknown message type %d when attempting to encode to JSON", m.Type)
+	}
+	return json.Marshal(&struct {
+		Type string `json:"type"`
+		*Alias
+	}{
+		Type:  messageType,
+		Alias: (*Alias)(&m),
+	})
+}
+
 // OutgoingStreamMessage is a container for outgoing messages to a stream
 type OutgoingStreamMessage struct {
 	Content string
@@ -168,23 +368,113 @@ func (d *DisplayRecipient) UnmarshalJSON(b []byte) (err error) {
 	return nil
 }
 
-type zulipSendMessageReturn struct {
-	ID      int64  `json:"id,omitempty"`
+// MarshalJSON enables DisplayRecipient to be encoded as JSON, in the form it is received from Zulip
+func (d DisplayRecipient) MarshalJSON() ([]byte, error) {
+	if d.Users != nil {
+		return json.Marshal(d.Users)
+	}
+	return json.Marshal(d.Stream)
+}
+
+// zulipReturn holds the fields common to every response from the Zulip API.
+// It is embedded in the types responses are decoded into, so that makeZulipRequest()
+// can check for errors.
+type zulipReturn struct {
 	Message string `json:"msg"`
 	Result  string `json:"result"`
+	Code    string `json:"code,omitempty"`
+}
+
+func (r *zulipReturn) common() *zulipReturn {
+	return r
+}
+
+// zulipRateLimitReturn is the response to a request which hit the rate limit
+type zulipRateLimitReturn struct {
+	zulipReturn
+	RetryAfter float64 `json:"retry-after,omitempty"` // seconds
+}
+
+type zulipSendMessageReturn struct {
+	zulipReturn
+	ID int64 `json:"id,omitempty"`
 }
 
 type zulipRegisterReturn struct {
-	QueueID     string `json:"queue_id,omitempty"`
-	LastEventID int64  `json:"last_event_id,omitempty"`
-	Message     string `json:"msg"`
-	Result      string `json:"result"`
+	zulipReturn
+	QueueID     string         `json:"queue_id,omitempty"`
+	LastEventID int64          `json:"last_event_id,omitempty"`
+	UnreadMsgs  UnreadMessages `json:"unread_msgs,omitempty"`
+}
+
+type zulipMessagesReturn struct {
+	zulipReturn
+	Messages    []Message `json:"messages,omitempty"`
+	FoundOldest bool      `json:"found_oldest"`
+	FoundNewest bool      `json:"found_newest"`
+}
+
+type zulipMessageReturn struct {
+	zulipReturn
+	RawContent string  `json:"raw_content"`
+	Message    Message `json:"message"`
+}
+
+type zulipMessageHistoryReturn struct {
+	zulipReturn
+	MessageHistory []MessageSnapshot `json:"message_history,omitempty"`
+}
+
+type zulipStreamsReturn struct {
+	zulipReturn
+	Streams []Stream `json:"streams,omitempty"`
+}
+
+type zulipSubscriptionsReturn struct {
+	zulipReturn
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+}
+
+type zulipAddSubscriptionsReturn struct {
+	zulipReturn
+	Subscribed        map[string][]string `json:"subscribed,omitempty"`
+	AlreadySubscribed map[string][]string `json:"already_subscribed,omitempty"`
+}
+
+type zulipRemoveSubscriptionsReturn struct {
+	zulipReturn
+	Removed       []string `json:"removed,omitempty"`
+	NotSubscribed []string `json:"not_subscribed,omitempty"`
+}
+
+type zulipStreamIDReturn struct {
+	zulipReturn
+	StreamID int64 `json:"stream_id,omitempty"`
+}
+
+type zulipSubscribersReturn struct {
+	zulipReturn
+	Subscribers []int64 `json:"subscribers,omitempty"`
+}
+
+type zulipMembersReturn struct {
+	zulipReturn
+	Members []Person `json:"members,omitempty"`
+}
+
+type zulipProfileReturn struct {
+	zulipReturn
+	Person
+}
+
+type zulipPresenceReturn struct {
+	zulipReturn
+	Presences map[string]map[string]ClientPresence `json:"presences,omitempty"`
 }
 
 type zulipEventsReturn struct {
-	Message string  `json:"msg"`
-	Result  string  `json:"result"`
-	Events  []Event `json:"events,omitempty"`
+	zulipReturn
+	Events []Event `json:"events,omitempty"`
 }
 
 const zulipSuccessResult = "success"
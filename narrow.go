@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/cache"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// narrowing is what the main view is showing: every message, every topic of a stream,
+// one topic of a stream or a private message conversation, optionally only those
+// messages which match a search. The zero narrowing is every message.
+type narrowing struct {
+	stream string // as displayed
+	topic  string // as displayed; only if stream is set
+	pmWith string // in the form returned by cache.PMWith
+	search string // the search terms, as given to the server
+}
+
+// isAll returns true if n is every message
+func (n narrowing) isAll() bool {
+	return n == narrowing{}
+}
+
+// matches returns true if m should be shown in the main view when it is narrowed to n.
+// The server's search is cleverer (e.g. about word stems), so a new message matches a
+// search if it contains each of the search terms.
+func (n narrowing) matches(m zulip.Message) bool {
+	if n.search != "" {
+		text := strings.ToLower(m.Subject + " " + plainContent(m))
+		for _, term := range strings.Fields(strings.ToLower(n.search)) {
+			if !strings.Contains(text, term) {
+				return false
+			}
+		}
+	}
+	switch {
+	case n.pmWith != "":
+		return m.Type == zulip.PrivateMessage && cache.PMWith(m) == n.pmWith
+	case n.stream != "":
+		return m.Type == zulip.StreamMessage &&
+			strings.EqualFold(m.DisplayRecipient.Stream, n.stream) &&
+			(n.topic == "" || strings.EqualFold(m.Subject, n.topic))
+	}
+	return true
+}
+
+// zulipNarrow returns the narrow to request n's history from the server with
+func (n narrowing) zulipNarrow() zulip.Narrow {
+	// Not the home view, so that history matches the cache and the event queue, which
+	// include muted streams
+	narrow := zulip.Narrow{}
+	switch {
+	case n.pmWith != "":
+		narrow = append(narrow, zulip.NarrowTerm{Operator: zulip.PMWithNarrow, Operand: strings.Join(pmWithOthers(n.pmWith), ",")})
+	case n.stream != "":
+		narrow = append(narrow, zulip.NarrowTerm{Operator: zulip.StreamNarrow, Operand: n.stream})
+		if n.topic != "" {
+			narrow = append(narrow, zulip.NarrowTerm{Operator: zulip.TopicNarrow, Operand: n.topic})
+		}
+	}
+	if n.search != "" {
+		narrow = append(narrow, zulip.NarrowTerm{Operator: zulip.SearchNarrow, Operand: n.search})
+	}
+	return narrow
+}
+
+// cached returns true if n's history can be read from the cache. The cache cannot
+// search, so the history of a search only comes from the server.
+func (n narrowing) cached() bool {
+	return config.cache != nil && n.search == ""
+}
+
+// cacheFilter returns the filter to retrieve n's history from the cache with
+func (n narrowing) cacheFilter() cache.Filter {
+	return cache.Filter{Stream: n.stream, Topic: n.topic, PMWith: n.pmWith}
+}
+
+// String returns a short description of n, e.g. "#Denmark > Castle"
+func (n narrowing) String() string {
+	if n.search != "" {
+		conversation := narrowing{stream: n.stream, topic: n.topic, pmWith: n.pmWith}
+		if conversation.isAll() {
+			return fmt.Sprintf("messages matching '%s'", n.search)
+		}
+		return fmt.Sprintf("%s matching '%s'", conversation, n.search)
+	}
+	switch {
+	case n.pmWith != "":
+		names := []string{}
+		for _, email := range pmWithOthers(n.pmWith) {
+			names = append(names, config.roster.fullName(email))
+		}
+		return "PMs with " + strings.Join(names, ", ")
+	case n.topic != "":
+		return fmt.Sprintf("#%s > %s", n.stream, n.topic)
+	case n.stream != "":
+		return "#" + n.stream
+	}
+	return "all messages"
+}
+
+// pmWithOthers returns the email addresses in pmWith other than the user's own, unless
+// the conversation is only with themselves
+func pmWithOthers(pmWith string) []string {
+	others := []string{}
+	for _, email := range strings.Split(pmWith, ",") {
+		if !strings.EqualFold(email, config.Email) {
+			others = append(others, email)
+		}
+	}
+	if len(others) == 0 {
+		return []string{strings.ToLower(config.Email)}
+	}
+	return others
+}
+
+// narrowDescription returns a short description of what the main view is narrowed to
+// for the status view, or "" if it is showing every message
+func narrowDescription() string {
+	if config.feed.narrow.isAll() {
+		return ""
+	}
+	return config.feed.narrow.String()
+}
+
+// setNarrow replaces the contents of the main view with the history of n, and from
+// then on only shows new messages which match it. It must be called from the gocui
+// main loop.
+func setNarrow(g *gocui.Gui, n narrowing) error {
+	main, err := g.View("main")
+	if err != nil {
+		return err
+	}
+	config.feed.narrowTo(main, n)
+	config.feed.fetchingHistory = true
+	go loadNarrowHistory(n)
+	return nil
+}
+
+// loadNarrowHistory shows the newest page of n's history in the main view: first
+// whatever is in the cache, then whatever else the server has
+func loadNarrowHistory(n narrowing) {
+	state, _, _, _ := currentConnectionState()
+	if n.cached() {
+		cached, err := config.cache.BeforeMatching(zulip.AnchorNewest, config.Backfill, n.cacheFilter())
+		if err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot read message cache: %v", err)},
+			}
+		}
+		if state != Closed {
+			// The server's page will be the newest messages, so older cached messages
+			// would leave a gap before it which scrolling back would never fill
+			cached = contiguousWithNewest(cached)
+		}
+		// Shown straight away, because the server may take a while
+		config.ui.Execute(makeMainViewHistoryInserter(windowMessagesFromZulipMessages(cached), n, false))
+	}
+	if state == Closed {
+		// There is no more history to be had until we connect
+		config.ui.Execute(makeMainViewHistoryInserter([]WindowMessage{}, n, false))
+		return
+	}
+	messages, foundOldest, _, err := config.zulipClient.GetMessages(context.Background(), n.zulipNarrow(), zulip.AnchorNewest, config.Backfill, 0, requestHTML())
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot load the history of %s: %v", n, err)},
+		}
+		config.ui.Execute(makeMainViewHistoryInserter([]WindowMessage{}, n, false))
+		return
+	}
+	storeMessages(messages...)
+	config.ui.Execute(makeMainViewHistoryInserter(windowMessagesFromZulipMessages(messages), n, foundOldest))
+}
+
+// contiguousWithNewest returns those of cached (oldest first) which the cache holds
+// every message after, up to the newest message it has
+func contiguousWithNewest(cached []zulip.Message) []zulip.Message {
+	newest, err := config.cache.NewestID()
+	if err != nil {
+		return []zulip.Message{}
+	}
+	start := sort.Search(len(cached), func(i int) bool {
+		covered, err := config.cache.Covers(cached[i].ID, newest)
+		return err == nil && covered
+	})
+	return cached[start:]
+}
+
+// parseNarrow parses the arguments to the narrow command, e.g. "stream:Denmark
+// topic:Castle", "pm:hamlet@example.com,ophelia@example.com" or "stream:Denmark
+// search:rotten state". Words without an operator are part of the previous operand, so
+// that topics and searches may contain spaces.
+// "off" or "all" is every message.
+func parseNarrow(args []string) (narrowing, error) {
+	if len(args) == 1 && (strings.EqualFold(args[0], "off") || strings.EqualFold(args[0], "all")) {
+		return narrowing{}, nil
+	}
+	operands := make(map[string]string)
+	operator := ""
+	for _, arg := range args {
+		if arg == "" {
+			continue
+		}
+		if i := strings.Index(arg, ":"); i > 0 {
+			switch op := strings.ToLower(arg[:i]); op {
+			case "stream", "topic", "pm", "search":
+				operator = op
+				operands[operator] = arg[i+1:]
+				continue
+			case "pm-with":
+				operator = "pm"
+				operands[operator] = arg[i+1:]
+				continue
+			}
+		}
+		if operator == "" {
+			return narrowing{}, fmt.Errorf("'%s' is not stream:, topic:, pm: or search:", arg)
+		}
+		operands[operator] += " " + arg
+	}
+
+	stream, topic := strings.TrimSpace(operands["stream"]), strings.TrimSpace(operands["topic"])
+	pm, search := strings.TrimSpace(operands["pm"]), strings.TrimSpace(operands["search"])
+	switch {
+	case pm != "" && (stream != "" || topic != ""):
+		return narrowing{}, fmt.Errorf("cannot narrow to a stream and private messages at once")
+	case topic != "" && stream == "":
+		return narrowing{}, fmt.Errorf("a topic needs a stream")
+	case pm != "":
+		emails := []string{config.Email}
+		for _, recipient := range parseRecipients(pm) {
+			email, err := recipientEmail(recipient)
+			if err != nil {
+				return narrowing{}, err
+			}
+			emails = append(emails, email)
+		}
+		return narrowing{pmWith: cache.PMWithEmails(emails), search: search}, nil
+	case stream != "":
+		// Use the stream's own capitalisation if we know it
+		for _, s := range config.sidebar.streams {
+			if strings.EqualFold(s, stream) {
+				stream = s
+			}
+		}
+		return narrowing{stream: stream, topic: topic, search: search}, nil
+	case search != "":
+		return narrowing{search: search}, nil
+	}
+	return narrowing{}, fmt.Errorf("nothing to narrow to")
+}
+
+// recipientEmail returns the email address of recipient, which is either an email
+// address or part of the name of exactly one user
+func recipientEmail(recipient string) (string, error) {
+	if strings.Contains(recipient, "@") {
+		return recipient, nil
+	}
+	found := config.roster.find(recipient)
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no user matches %s", recipient)
+	case 1:
+		return found[0].person.Email, nil
+	}
+	return "", fmt.Errorf("%d users match %s; use their email address", len(found), recipient)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// presenceInterval is how often our presence is reported to the server. It must be
+// less than zulip.PresenceTimeout or we will look offline between reports.
+const presenceInterval = 60 * time.Second
+
+// presenceStatus is what we know about the user's own presence
+var presenceStatus struct {
+	sync.Mutex
+	lastInput time.Time            // when the user last pressed a key
+	newInput  bool                 // true if there has been input since the last report
+	away      bool                 // true if the user has said they are away
+	reported  zulip.PresenceStatus // the status in the last report
+}
+
+// presenceReportNow is signalled when our presence should be reported without
+// waiting for the next presenceInterval
+var presenceReportNow = make(chan struct{}, 1)
+
+// requestPresenceReport asks for our presence to be reported as soon as possible
+func requestPresenceReport() {
+	select {
+	case presenceReportNow <- struct{}{}:
+	default:
+		// A report has already been requested
+	}
+}
+
+// noteUserInput records that the user has pressed a key. If they were shown as idle,
+// they are reported as active again at once.
+func noteUserInput() {
+	presenceStatus.Lock()
+	presenceStatus.lastInput = time.Now()
+	presenceStatus.newInput = true
+	wasIdle := presenceStatus.reported == zulip.IdlePresence && !presenceStatus.away
+	presenceStatus.Unlock()
+	if wasIdle {
+		requestPresenceReport()
+	}
+}
+
+// currentPresenceStatus returns the status to report to the server, and whether
+// there has been input since the last report
+func currentPresenceStatus() (zulip.PresenceStatus, bool) {
+	presenceStatus.Lock()
+	defer presenceStatus.Unlock()
+	status := zulip.ActivePresence
+	if presenceStatus.away || idleSince(presenceStatus.lastInput) {
+		status = zulip.IdlePresence
+	}
+	newInput := presenceStatus.newInput
+	presenceStatus.newInput = false
+	presenceStatus.reported = status
+	return status, newInput
+}
+
+// idleSince returns true if lastInput was long enough ago for the user to be idle
+func idleSince(lastInput time.Time) bool {
+	return time.Since(lastInput) > time.Duration(config.IdleAfter)*time.Minute
+}
+
+// userIsIdle returns true if the user is away or has not pressed a key for a while
+func userIsIdle() bool {
+	presenceStatus.Lock()
+	defer presenceStatus.Unlock()
+	return presenceStatus.away || idleSince(presenceStatus.lastInput)
+}
+
+// setAway sets or clears the user's away state and reports it to the server
+func setAway(away bool) {
+	presenceStatus.Lock()
+	presenceStatus.away = away
+	if !away {
+		presenceStatus.lastInput = time.Now()
+	}
+	presenceStatus.Unlock()
+	requestPresenceReport()
+	// Redraw so that the status view is updated
+	config.ui.Execute(func(g *gocui.Gui) error { return nil })
+}
+
+// isAway returns true if the user has said they are away
+func isAway() bool {
+	presenceStatus.Lock()
+	defer presenceStatus.Unlock()
+	return presenceStatus.away
+}
+
+// reportPresence reports our presence to the server every presenceInterval, or
+// sooner if asked, until ctx is done. The presence of everyone else which comes back
+// is used to update the roster.
+func reportPresence(ctx context.Context, client *zulip.Client) {
+	presenceStatus.Lock()
+	if presenceStatus.lastInput.IsZero() {
+		// Starting the client counts as input
+		presenceStatus.lastInput = time.Now()
+	}
+	presenceStatus.Unlock()
+
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+	for {
+		status, newInput := currentPresenceStatus()
+		presences, err := client.UpdatePresence(ctx, status, newInput)
+		if err != nil && ctx.Err() == nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    DebugMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot report presence: %v", err)},
+			}
+		}
+		for email, presence := range presences {
+			config.roster.applyPresence(&zulip.PresenceUpdate{Email: email, Presence: presence})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-presenceReportNow:
+		}
+	}
+}
+
+// inputRecordingEditor is a gocui.Editor which notes user input before passing keys
+// on to another Editor
+type inputRecordingEditor struct {
+	editor gocui.Editor
+}
+
+func (e inputRecordingEditor) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	noteUserInput()
+	e.editor.Edit(v, key, ch, mod)
+}
+
+// recordingInput returns a keybinding handler which notes user input before calling h
+func recordingInput(h gocui.KeybindingHandler) gocui.KeybindingHandler {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		noteUserInput()
+		return h(g, v)
+	}
+}
+
+// presenceDescription returns a short description of the user's own presence for the
+// status view, or "" if there is nothing unusual to show
+func presenceDescription() string {
+	if isAway() {
+		return "away"
+	}
+	return ""
+}
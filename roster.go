@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// rosterEntry is a user in the roster, along with their presence on each client
+type rosterEntry struct {
+	person   zulip.Person
+	presence map[string]zulip.ClientPresence // by client name
+}
+
+// status returns the user's overall presence status and when they were last seen
+func (e *rosterEntry) status(now time.Time) (zulip.PresenceStatus, time.Time) {
+	return zulip.AggregatePresence(e.presence, now)
+}
+
+// roster is the directory of users in the realm and their presence, kept up to date
+// from realm_user and presence events. It is safe to use from any goroutine.
+type roster struct {
+	sync.Mutex
+	people  map[int64]*rosterEntry // by user ID
+	byEmail map[string]int64       // lowercase email to user ID
+}
+
+func newRoster() *roster {
+	return &roster{
+		people:  make(map[int64]*rosterEntry),
+		byEmail: make(map[string]int64),
+	}
+}
+
+// load replaces the contents of the roster with the realm's users and their presence
+func (r *roster) load(members []zulip.Person, presences map[string]map[string]zulip.ClientPresence) {
+	r.Lock()
+	defer r.Unlock()
+	r.people = make(map[int64]*rosterEntry)
+	r.byEmail = make(map[string]int64)
+	for _, p := range members {
+		r.people[p.UserID] = &rosterEntry{person: p, presence: make(map[string]zulip.ClientPresence)}
+		r.byEmail[strings.ToLower(p.Email)] = p.UserID
+	}
+	for email, presence := range presences {
+		if id, ok := r.byEmail[strings.ToLower(email)]; ok {
+			r.people[id].presence = presence
+		}
+	}
+}
+
+// applyRealmUser updates the roster for a user being added, removed or changed
+func (r *roster) applyRealmUser(u *zulip.RealmUserUpdate) {
+	r.Lock()
+	defer r.Unlock()
+	entry, known := r.people[u.Person.UserID]
+	switch u.Op {
+	case zulip.AddOp:
+		if !known {
+			entry = &rosterEntry{presence: make(map[string]zulip.ClientPresence)}
+			r.people[u.Person.UserID] = entry
+		}
+		entry.person = u.Person
+		entry.person.IsActive = true
+		r.byEmail[strings.ToLower(u.Person.Email)] = u.Person.UserID
+	case zulip.RemoveOp:
+		if known {
+			entry.person.IsActive = false
+		}
+	case zulip.UpdateOp:
+		if !known {
+			return
+		}
+		// Only the fields which changed are sent
+		if u.Person.FullName != "" {
+			entry.person.FullName = u.Person.FullName
+		}
+		if u.Person.Timezone != "" {
+			entry.person.Timezone = u.Person.Timezone
+		}
+		if u.Person.Email != "" {
+			delete(r.byEmail, strings.ToLower(entry.person.Email))
+			entry.person.Email = u.Person.Email
+			r.byEmail[strings.ToLower(u.Person.Email)] = u.Person.UserID
+		}
+	}
+}
+
+// applyPresence updates the roster for a change in a user's presence
+func (r *roster) applyPresence(p *zulip.PresenceUpdate) {
+	r.Lock()
+	defer r.Unlock()
+	id := p.UserID
+	if id == 0 {
+		id = r.byEmail[strings.ToLower(p.Email)]
+	}
+	entry, ok := r.people[id]
+	if !ok {
+		return
+	}
+	for client, presence := range p.Presence {
+		entry.presence[client] = presence
+	}
+}
+
+// email returns the email address of the user with the given ID, if they are known
+func (r *roster) email(id int64) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	entry, ok := r.people[id]
+	if !ok {
+		return "", false
+	}
+	return entry.person.Email, true
+}
+
+// userID returns the ID of the user with the given email address, if they are known
+func (r *roster) userID(email string) (int64, bool) {
+	r.Lock()
+	defer r.Unlock()
+	id, ok := r.byEmail[strings.ToLower(email)]
+	return id, ok
+}
+
+// fullName returns the full name of the user with the given email address, or the
+// email address if they are not known
+func (r *roster) fullName(email string) string {
+	r.Lock()
+	defer r.Unlock()
+	if id, ok := r.byEmail[strings.ToLower(email)]; ok {
+		return r.people[id].person.FullName
+	}
+	return email
+}
+
+// find returns the users whose email address is query or whose full name contains
+// it, ignoring case, sorted by full name
+func (r *roster) find(query string) []rosterEntry {
+	r.Lock()
+	defer r.Unlock()
+	query = strings.ToLower(strings.TrimSpace(query))
+	if id, ok := r.byEmail[query]; ok {
+		return []rosterEntry{r.copyOf(id)}
+	}
+	found := []rosterEntry{}
+	for id, entry := range r.people {
+		if strings.Contains(strings.ToLower(entry.person.FullName), query) {
+			found = append(found, r.copyOf(id))
+		}
+	}
+	sortRosterEntries(found)
+	return found
+}
+
+// all returns every active user, sorted by full name
+func (r *roster) all() []rosterEntry {
+	r.Lock()
+	defer r.Unlock()
+	entries := []rosterEntry{}
+	for id, entry := range r.people {
+		if entry.person.IsActive {
+			entries = append(entries, r.copyOf(id))
+		}
+	}
+	sortRosterEntries(entries)
+	return entries
+}
+
+// copyOf returns a copy of the entry for the user with the given ID, so that it can
+// be used without holding the lock. The lock must be held.
+func (r *roster) copyOf(id int64) rosterEntry {
+	entry := *r.people[id]
+	entry.presence = make(map[string]zulip.ClientPresence, len(r.people[id].presence))
+	for client, presence := range r.people[id].presence {
+		entry.presence[client] = presence
+	}
+	return entry
+}
+
+func sortRosterEntries(entries []rosterEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].person.FullName) < strings.ToLower(entries[j].person.FullName)
+	})
+}
+
+// loadRoster fills the roster with the realm's users and their presence
+func loadRoster(ctx context.Context, client *zulip.Client) {
+	members, err := client.GetMembers(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot load the list of users: %v", err)},
+			}
+		}
+		return
+	}
+	presences, err := client.GetRealmPresence(ctx)
+	if err != nil && ctx.Err() == nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot load presence: %v", err)},
+		}
+	}
+	config.roster.load(members, presences)
+}
+
+// describeRosterEntry returns a line describing a user's presence, e.g.
+// "Hamlet of Denmark <hamlet@example.com>: idle"
+func describeRosterEntry(entry rosterEntry, now time.Time) string {
+	status, lastSeen := entry.status(now)
+	str := fmt.Sprintf("%s <%s>: %s", entry.person.FullName, entry.person.Email, status)
+	if status == zulip.OfflinePresence && !lastSeen.IsZero() {
+		str += fmt.Sprintf(" (last seen %s)", lastSeen.Format("2006-01-02 15:04"))
+	}
+	return str
+}
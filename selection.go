@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/cache"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// enterSelectionMode moves the focus to the main view so that a message can be
+// selected, selecting the newest message if none is selected
+func enterSelectionMode(g *gocui.Gui, v *gocui.View) error {
+	main, err := g.View("main")
+	if err != nil {
+		return err
+	}
+	if config.feed.selected == 0 {
+		if err := config.feed.moveSelection(main, 1); err != nil {
+			return err
+		}
+	}
+	return g.SetCurrentView("main")
+}
+
+// leaveSelectionMode moves the focus back to the command line. The selected message
+// stays selected, so that commands typed there act on it.
+func leaveSelectionMode(g *gocui.Gui, v *gocui.View) error {
+	// Once the key has been handled, or gocui would also type it into the command line
+	g.Execute(func(g *gocui.Gui) error {
+		return g.SetCurrentView("cmd")
+	})
+	return nil
+}
+
+// cancelSelection deselects the selected message and leaves selection mode
+func cancelSelection(g *gocui.Gui, v *gocui.View) error {
+	clearSelection()
+	return leaveSelectionMode(g, v)
+}
+
+// clearSelection deselects the selected message, if there is one
+func clearSelection() {
+	config.feed.selected = 0
+}
+
+func selectionUp(g *gocui.Gui, v *gocui.View) error {
+	return config.feed.moveSelection(v, -1)
+}
+
+func selectionDown(g *gocui.Gui, v *gocui.View) error {
+	return config.feed.moveSelection(v, 1)
+}
+
+func replyToSelection(g *gocui.Gui, v *gocui.View) error {
+	handleCommandReply([]string{"reply"})
+	return nil
+}
+
+func quoteSelection(g *gocui.Gui, v *gocui.View) error {
+	handleCommandQuote([]string{"quote"})
+	return nil
+}
+
+func editSelection(g *gocui.Gui, v *gocui.View) error {
+	handleCommandEdit([]string{"edit"})
+	return nil
+}
+
+func copySelectionLink(g *gocui.Gui, v *gocui.View) error {
+	handleCommandLink([]string{"link"})
+	return nil
+}
+
+// composeInConversation opens the composer for a new message in the conversation m
+// is part of, starting with content
+func composeInConversation(m zulip.Message, content string) {
+	if m.Type == zulip.PrivateMessage {
+		showNewPrivateMessagePrompt(config.ui, zulip.OutgoingPrivateMessage{
+			To:      pmWithOthers(cache.PMWith(m)),
+			Content: content,
+		})
+		return
+	}
+	showNewStreamMessagePrompt(config.ui, zulip.OutgoingStreamMessage{
+		Stream:  m.DisplayRecipient.Stream,
+		Topic:   m.Subject,
+		Content: content,
+	})
+}
+
+// quotation returns m, whose markdown is content, quoted in the form the Zulip web app
+// uses, ready for a reply to be written below it
+func quotation(m zulip.Message, content string) string {
+	return fmt.Sprintf("@_**%s|%d** [said](%s):\n```quote\n%s\n```\n", m.SenderFullName, m.SenderID, messageLink(m), content)
+}
+
+// realmURL returns the URL of the Zulip web app
+func realmURL() string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(config.APIBase, "/"), "/v1"), "/api")
+}
+
+// messageLink returns the URL of m in the Zulip web app
+func messageLink(m zulip.Message) string {
+	realm := realmURL()
+	if m.Type == zulip.PrivateMessage {
+		ids := make([]string, len(m.DisplayRecipient.Users))
+		for i, u := range m.DisplayRecipient.Users {
+			ids[i] = strconv.FormatInt(u.ID, 10)
+		}
+		return fmt.Sprintf("%s/#narrow/pm-with/%s-pm/near/%d", realm, strings.Join(ids, ","), m.ID)
+	}
+	stream := hashEncode(m.DisplayRecipient.Stream)
+	if m.StreamID != 0 {
+		stream = fmt.Sprintf("%d-%s", m.StreamID, stream)
+	}
+	return fmt.Sprintf("%s/#narrow/stream/%s/topic/%s/near/%d", realm, stream, hashEncode(m.Subject), m.ID)
+}
+
+// hashEncode encodes s for use in the fragment of a Zulip web app URL, as the web app
+// does: like JavaScript's encodeURIComponent, but with . instead of %
+func hashEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			strings.IndexByte("-_!~*'()", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, ".%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// copyToClipboard asks the terminal to put text on the clipboard, using the OSC 52
+// escape sequence. Terminals which do not support it ignore it.
+func copyToClipboard(text string) {
+	fmt.Fprintf(os.Stdout, "\x1b]52;c;%s\x07", base64.StdEncoding.EncodeToString([]byte(text)))
+}
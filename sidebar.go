@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+const (
+	sidebarWidth         = 30  // columns, including the frame
+	sidebarTopics        = 5   // the number of recent topics shown under each stream
+	sidebarPMs           = 10  // the number of recent private message conversations shown
+	sidebarCachedHistory = 200 // the number of conversations to read from the cache at startup
+)
+
+// recentConversation is a conversation shown in the sidebar, with the ID of its
+// newest message (or 0 if it is only shown because it has unread messages)
+type recentConversation struct {
+	narrow   narrowing
+	newestID int64
+}
+
+// sidebarRow is a line in the sidebar
+type sidebarRow struct {
+	label  string
+	indent int
+	target narrowing // what selecting the row narrows to
+	unread int
+	header bool // true for a heading, which cannot be selected
+}
+
+// sidebar holds the state of the sidebar, which lists subscribed streams, their recent
+// topics and recent private message conversations. Its fields must only be accessed
+// from the gocui main loop (i.e. in a Handler).
+type sidebar struct {
+	hidden      bool
+	streams     []string                            // subscribed streams, sorted by name
+	subscribed  bool                                // true once streams has been loaded
+	recent      map[conversation]recentConversation // by conversation
+	rows        []sidebarRow                        // as last drawn
+	cursor      narrowing                           // the target of the row under the cursor
+	cursorValid bool                                // false until the cursor has been placed
+}
+
+func newSidebar(hidden bool) *sidebar {
+	return &sidebar{hidden: hidden, recent: make(map[conversation]recentConversation)}
+}
+
+// noteMessages records that ms were received, so that their conversations are shown
+func (s *sidebar) noteMessages(ms ...zulip.Message) {
+	for _, m := range ms {
+		n := narrowing{stream: m.DisplayRecipient.Stream, topic: m.Subject}
+		if m.Type == zulip.PrivateMessage {
+			n = narrowing{pmWith: conversationOf(m).pmWith}
+		}
+		s.noteConversation(conversationOf(m), n, m.ID)
+	}
+}
+
+// noteConversation records that the conversation c (displayed as n) has a message
+// with the given ID
+func (s *sidebar) noteConversation(c conversation, n narrowing, id int64) {
+	if existing, ok := s.recent[c]; ok && existing.newestID >= id {
+		return
+	}
+	s.recent[c] = recentConversation{narrow: n, newestID: id}
+}
+
+// setSubscriptions replaces the list of subscribed streams
+func (s *sidebar) setSubscriptions(names []string) {
+	s.streams = []string{}
+	s.subscribed = true
+	s.addSubscriptions(names)
+}
+
+// addSubscriptions adds streams to the list of subscribed streams
+func (s *sidebar) addSubscriptions(names []string) {
+	for _, name := range names {
+		if !containsFold(s.streams, name) {
+			s.streams = append(s.streams, name)
+		}
+	}
+	sort.Slice(s.streams, func(i, j int) bool {
+		return strings.ToLower(s.streams[i]) < strings.ToLower(s.streams[j])
+	})
+}
+
+// removeSubscriptions removes streams from the list of subscribed streams
+func (s *sidebar) removeSubscriptions(names []string) {
+	kept := s.streams[:0]
+	for _, stream := range s.streams {
+		if !containsFold(names, stream) {
+			kept = append(kept, stream)
+		}
+	}
+	s.streams = kept
+}
+
+// buildRows works out what the sidebar should show
+func (s *sidebar) buildRows() []sidebarRow {
+	unreadTopics, unreadPMs := config.unread.conversations()
+	for c := range unreadTopics {
+		if _, ok := s.recent[c]; !ok {
+			s.recent[c] = recentConversation{narrow: narrowing{stream: c.stream, topic: c.topic}}
+		}
+	}
+	for c := range unreadPMs {
+		if _, ok := s.recent[c]; !ok {
+			s.recent[c] = recentConversation{narrow: narrowing{pmWith: c.pmWith}}
+		}
+	}
+
+	topics := make(map[string][]recentConversation) // by lowercase stream name
+	pms := []recentConversation{}
+	streams := append([]string{}, s.streams...)
+	for c, r := range s.recent {
+		if c.pmWith != "" {
+			pms = append(pms, r)
+			continue
+		}
+		topics[c.stream] = append(topics[c.stream], r)
+		if !s.subscribed && !containsFold(streams, r.narrow.stream) {
+			// Until we know what the user is subscribed to, show what they have seen
+			streams = append(streams, r.narrow.stream)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return strings.ToLower(streams[i]) < strings.ToLower(streams[j])
+	})
+
+	rows := []sidebarRow{{label: "All messages", unread: config.unread.total()}}
+	if len(streams) > 0 {
+		rows = append(rows, sidebarRow{label: "Streams", header: true})
+	}
+	for _, stream := range streams {
+		rows = append(rows, sidebarRow{
+			label:  "#" + stream,
+			indent: 1,
+			target: narrowing{stream: stream},
+			unread: config.unread.streamCount(stream),
+		})
+		for i, r := range newestFirst(topics[strings.ToLower(stream)]) {
+			unread := config.unread.topicCount(stream, r.narrow.topic)
+			if i >= sidebarTopics && unread == 0 {
+				continue
+			}
+			rows = append(rows, sidebarRow{
+				label:  r.narrow.topic,
+				indent: 2,
+				target: narrowing{stream: stream, topic: r.narrow.topic},
+				unread: unread,
+			})
+		}
+	}
+	if len(pms) > 0 {
+		rows = append(rows, sidebarRow{label: "Private messages", header: true})
+	}
+	for i, r := range newestFirst(pms) {
+		unread := config.unread.pmCount(r.narrow.pmWith)
+		if i >= sidebarPMs && unread == 0 {
+			continue
+		}
+		names := []string{}
+		for _, email := range pmWithOthers(r.narrow.pmWith) {
+			names = append(names, config.roster.fullName(email))
+		}
+		rows = append(rows, sidebarRow{
+			label:  strings.Join(names, ", "),
+			indent: 1,
+			target: r.narrow,
+			unread: unread,
+		})
+	}
+	return rows
+}
+
+// newestFirst sorts conversations so that the one with the newest message is first
+func newestFirst(conversations []recentConversation) []recentConversation {
+	sort.SliceStable(conversations, func(i, j int) bool {
+		return conversations[i].newestID > conversations[j].newestID
+	})
+	return conversations
+}
+
+// layoutSidebar creates, updates or removes the sidebar view. Returns the width it
+// takes up, which is 0 if it is hidden.
+func layoutSidebar(g *gocui.Gui) (int, error) {
+	maxX, maxY := g.Size()
+	if config.sidebar.hidden || maxX < 2*sidebarWidth {
+		if err := g.DeleteView("sidebar"); err != nil && err != gocui.ErrUnknownView {
+			return 0, err
+		}
+		return 0, nil
+	}
+	v, err := g.SetView("sidebar", -1, -1, sidebarWidth-1, maxY-3)
+	if err != nil && err != gocui.ErrUnknownView {
+		return 0, err
+	}
+	current := g.CurrentView()
+	v.Highlight = current != nil && current.Name() == "sidebar"
+	v.SelBgColor = gocui.ColorGreen
+	v.SelFgColor = gocui.ColorBlack
+	drawSidebar(v)
+	return sidebarWidth, nil
+}
+
+// drawSidebar writes the rows of the sidebar to v and places the cursor
+func drawSidebar(v *gocui.View) {
+	s := config.sidebar
+	s.rows = s.buildRows()
+	width, height := v.Size()
+	v.Clear()
+	cursor := -1
+	for i, row := range s.rows {
+		// The current narrow is marked in the first column
+		marker := " "
+		if !row.header && row.target == config.feed.narrow {
+			marker = ">"
+		}
+		label := marker + strings.Repeat(" ", row.indent) + row.label
+		count := ""
+		if row.unread > 0 {
+			count = fmt.Sprintf(" %d", row.unread)
+		}
+		label = truncate(label, width-utf8.RuneCountInString(count))
+		padding := width - utf8.RuneCountInString(label) - utf8.RuneCountInString(count)
+		if padding < 0 {
+			padding = 0
+		}
+		fmt.Fprintf(v, "%s%s%s\n", label, strings.Repeat(" ", padding), count)
+		if !row.header && s.cursorValid && row.target == s.cursor {
+			cursor = i
+		}
+	}
+	if cursor < 0 {
+		cursor = 0
+		s.cursor, s.cursorValid = narrowing{}, true
+	}
+	_, oy := v.Origin()
+	switch {
+	case cursor < oy:
+		oy = cursor
+	case cursor >= oy+height:
+		oy = cursor - height + 1
+	}
+	v.SetOrigin(0, oy)
+	v.SetCursor(0, cursor-oy)
+}
+
+// truncate shortens s to at most width runes, marking that it has been shortened
+func truncate(s string, width int) string {
+	if width < 1 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
+
+// moveSidebarCursor moves the cursor in the sidebar by dy selectable rows
+func moveSidebarCursor(dy int) {
+	s := config.sidebar
+	current := 0
+	for i, row := range s.rows {
+		if !row.header && row.target == s.cursor {
+			current = i
+		}
+	}
+	step := 1
+	if dy < 0 {
+		step, dy = -1, -dy
+	}
+	for i := current + step; i >= 0 && i < len(s.rows) && dy > 0; i += step {
+		if s.rows[i].header {
+			continue
+		}
+		s.cursor = s.rows[i].target
+		dy--
+	}
+}
+
+// toggleSidebar shows the sidebar if it is hidden, and hides it otherwise
+func toggleSidebar(g *gocui.Gui, v *gocui.View) error {
+	config.sidebar.hidden = !config.sidebar.hidden
+	if config.sidebar.hidden && v != nil && v.Name() == "sidebar" {
+		return unfocusSidebar(g, v)
+	}
+	return nil
+}
+
+// focusSidebar moves the focus to the sidebar, showing it if it is hidden
+func focusSidebar(g *gocui.Gui, v *gocui.View) error {
+	config.sidebar.hidden = false
+	if _, err := layoutSidebar(g); err != nil {
+		return err
+	}
+	return g.SetCurrentView("sidebar")
+}
+
+// unfocusSidebar moves the focus from the sidebar back to the command line once the
+// key which did so has been handled, or gocui would also type it into the command line
+func unfocusSidebar(g *gocui.Gui, v *gocui.View) error {
+	g.Execute(func(g *gocui.Gui) error {
+		return g.SetCurrentView("cmd")
+	})
+	return nil
+}
+
+func sidebarCursorUp(g *gocui.Gui, v *gocui.View) error {
+	moveSidebarCursor(-1)
+	return nil
+}
+
+func sidebarCursorDown(g *gocui.Gui, v *gocui.View) error {
+	moveSidebarCursor(1)
+	return nil
+}
+
+// selectSidebarRow narrows the main view to the conversation under the cursor in the
+// sidebar, and moves the focus back to the command line
+func selectSidebarRow(g *gocui.Gui, v *gocui.View) error {
+	if err := setNarrow(g, config.sidebar.cursor); err != nil {
+		return err
+	}
+	return unfocusSidebar(g, v)
+}
+
+// loadRecentConversations shows the conversations with the newest messages in the
+// cache in the sidebar
+func loadRecentConversations() {
+	if config.cache == nil {
+		return
+	}
+	recent, err := config.cache.RecentConversations(sidebarCachedHistory)
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot read message cache: %v", err)},
+		}
+		return
+	}
+	config.ui.Execute(func(g *gocui.Gui) error {
+		for _, r := range recent {
+			c := conversation{stream: strings.ToLower(r.Stream), topic: strings.ToLower(r.Topic), pmWith: r.PMWith}
+			n := narrowing{stream: r.Stream, topic: r.Topic, pmWith: r.PMWith}
+			config.sidebar.noteConversation(c, n, r.NewestID)
+		}
+		return nil
+	})
+}
+
+// loadSubscriptions retrieves the streams the user is subscribed to and shows them in
+// the sidebar. Returns nil if they could not be retrieved.
+func loadSubscriptions(ctx context.Context, client *zulip.Client) []zulip.Subscription {
+	subscriptions, err := client.ListSubscriptions(ctx, false)
+	if err != nil {
+		if ctx.Err() == nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot load subscriptions: %v", err)},
+			}
+		}
+		return nil
+	}
+	names := subscriptionNames(subscriptions)
+	config.ui.Execute(func(g *gocui.Gui) error {
+		config.sidebar.setSubscriptions(names)
+		return nil
+	})
+	return subscriptions
+}
+
+// applySubscriptionUpdate adds streams to or removes them from the sidebar as the
+// user subscribes to or unsubscribes from them
+func applySubscriptionUpdate(u *zulip.SubscriptionUpdate) {
+	names := subscriptionNames(u.Subscriptions)
+	switch u.Op {
+	case zulip.AddOp:
+		config.ui.Execute(func(g *gocui.Gui) error {
+			config.sidebar.addSubscriptions(names)
+			return nil
+		})
+	case zulip.RemoveOp:
+		config.ui.Execute(func(g *gocui.Gui) error {
+			config.sidebar.removeSubscriptions(names)
+			return nil
+		})
+	}
+}
+
+// subscriptionNames returns the names of the streams in subscriptions
+func subscriptionNames(subscriptions []zulip.Subscription) []string {
+	names := make([]string, len(subscriptions))
+	for i := range subscriptions {
+		names[i] = subscriptions[i].Name
+	}
+	return names
+}
+
+// containsFold returns true if names contains name, ignoring case
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// streamListRow is a stream shown in the stream list view
+type streamListRow struct {
+	stream      zulip.Stream
+	subscribed  bool
+	subscribers int // -1 until known
+}
+
+// streamList holds the state of the stream list view. Its fields must only be
+// accessed from the gocui main loop (i.e. in a Handler).
+type streamList struct {
+	rows   []streamListRow // sorted by name
+	cancel context.CancelFunc
+}
+
+// showStreamList retrieves every stream and opens the stream list view to browse
+// them. Subscriber counts are filled in as they arrive.
+func showStreamList() {
+	ctx, cancel := context.WithCancel(context.Background())
+	streams, err := config.zulipClient.GetStreams(ctx)
+	if err != nil {
+		cancel()
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Unable to list streams: %v", err)},
+		}
+		return
+	}
+	subscriptions, err := config.zulipClient.ListSubscriptions(ctx, true)
+	if err != nil {
+		cancel()
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Unable to list subscriptions: %v", err)},
+		}
+		return
+	}
+
+	subscribers := make(map[int64]int)
+	for _, s := range subscriptions {
+		subscribers[s.StreamID] = len(s.Subscribers)
+	}
+	list := &streamList{cancel: cancel}
+	for _, s := range streams {
+		row := streamListRow{stream: s, subscribers: -1}
+		if n, ok := subscribers[s.StreamID]; ok {
+			row.subscribed = true
+			row.subscribers = n
+		}
+		list.rows = append(list.rows, row)
+	}
+	sort.Slice(list.rows, func(i, j int) bool {
+		return strings.ToLower(list.rows[i].stream.Name) < strings.ToLower(list.rows[j].stream.Name)
+	})
+	// Once the list is handed to the main loop its rows are no longer ours to read
+	var unsubscribed []zulip.Stream
+	for _, row := range list.rows {
+		if !row.subscribed {
+			unsubscribed = append(unsubscribed, row.stream)
+		}
+	}
+
+	config.ui.Execute(func(g *gocui.Gui) error {
+		if config.streamList != nil {
+			config.streamList.cancel()
+		}
+		config.streamList = list
+		maxX, maxY := g.Size()
+		v, err := g.SetView("streams-list", maxX/10, maxY/10, maxX-maxX/10, maxY-maxY/10)
+		if err != nil && err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = "Streams (Enter: subscribe/unsubscribe, m: members, Esc: close)"
+		v.Highlight = true
+		v.SelBgColor = gocui.ColorGreen
+		v.SelFgColor = gocui.ColorBlack
+		drawStreamList(v)
+		return g.SetCurrentView("streams-list")
+	})
+
+	// Counts for streams we are not subscribed to need a request each, so make a few
+	// at a time rather than waiting for each in turn
+	pending := make(chan zulip.Stream)
+	go func() {
+		defer close(pending)
+		for _, stream := range unsubscribed {
+			select {
+			case pending <- stream:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < streamListFetches; i++ {
+		go fetchSubscriberCounts(ctx, list, pending)
+	}
+}
+
+// streamListFetches is the number of subscriber counts fetched at once for the stream
+// list
+const streamListFetches = 4
+
+// fetchSubscriberCounts fills in the subscriber count of each stream received from
+// streams in the rows of list, until streams is closed or ctx is cancelled
+func fetchSubscriberCounts(ctx context.Context, list *streamList, streams <-chan zulip.Stream) {
+	for stream := range streams {
+		subscribers, err := config.zulipClient.GetSubscribers(ctx, stream.StreamID)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		streamID, count := stream.StreamID, len(subscribers)
+		config.ui.Execute(func(g *gocui.Gui) error {
+			if config.streamList != list {
+				return nil
+			}
+			for i := range list.rows {
+				if list.rows[i].stream.StreamID == streamID {
+					list.rows[i].subscribers = count
+				}
+			}
+			return redrawStreamList(g)
+		})
+	}
+}
+
+// drawStreamList writes the rows of the stream list to v
+func drawStreamList(v *gocui.View) {
+	v.Clear()
+	for _, row := range config.streamList.rows {
+		mark := "[ ]"
+		if row.subscribed {
+			mark = "[x]"
+		}
+		count := "?"
+		if row.subscribers >= 0 {
+			count = fmt.Sprintf("%d", row.subscribers)
+		}
+		fmt.Fprintf(v, "%s %-24s %5s  %s\n", mark, row.stream.Name, count, row.stream.Description)
+	}
+}
+
+// redrawStreamList redraws the stream list view, if it is open
+func redrawStreamList(g *gocui.Gui) error {
+	v, err := g.View("streams-list")
+	if err != nil {
+		return nil
+	}
+	drawStreamList(v)
+	return nil
+}
+
+// selectedStreamListRow returns the row under the cursor in the stream list view
+func selectedStreamListRow(v *gocui.View) (*streamListRow, bool) {
+	if config.streamList == nil {
+		return nil, false
+	}
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+	i := cy + oy
+	if i < 0 || i >= len(config.streamList.rows) {
+		return nil, false
+	}
+	return &config.streamList.rows[i], true
+}
+
+// closeStreamList closes the stream list view and stops retrieving subscriber counts
+func closeStreamList(g *gocui.Gui, v *gocui.View) error {
+	if config.streamList != nil {
+		config.streamList.cancel()
+		config.streamList = nil
+	}
+	if err := g.DeleteView("streams-list"); err != nil {
+		return err
+	}
+	// Once the key has been handled, or gocui would also type it into the command line
+	g.Execute(func(g *gocui.Gui) error {
+		return g.SetCurrentView("cmd")
+	})
+	return nil
+}
+
+// moveStreamListCursor moves the cursor in the stream list view by dy rows
+func moveStreamListCursor(v *gocui.View, dy int) error {
+	if config.streamList == nil {
+		return nil
+	}
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+	_, height := v.Size()
+	i := cy + oy + dy
+	if i < 0 || i >= len(config.streamList.rows) {
+		return nil
+	}
+	switch {
+	case i < oy:
+		oy = i
+	case i >= oy+height:
+		oy = i - height + 1
+	}
+	if err := v.SetOrigin(0, oy); err != nil {
+		return err
+	}
+	return v.SetCursor(0, i-oy)
+}
+
+// toggleStreamListSubscription subscribes to or unsubscribes from the selected stream
+func toggleStreamListSubscription(g *gocui.Gui, v *gocui.View) error {
+	row, ok := selectedStreamListRow(v)
+	if !ok {
+		return nil
+	}
+	name, subscribe := row.stream.Name, !row.subscribed
+	go func() {
+		var err error
+		if subscribe {
+			err = subscribeToStream(name)
+		} else {
+			err = unsubscribeFromStream(name)
+		}
+		if err != nil {
+			return
+		}
+		config.ui.Execute(func(g *gocui.Gui) error {
+			if config.streamList == nil {
+				return nil
+			}
+			for i := range config.streamList.rows {
+				if config.streamList.rows[i].stream.Name == name {
+					config.streamList.rows[i].subscribed = subscribe
+					if config.streamList.rows[i].subscribers >= 0 && subscribe {
+						config.streamList.rows[i].subscribers++
+					} else if config.streamList.rows[i].subscribers > 0 {
+						config.streamList.rows[i].subscribers--
+					}
+				}
+			}
+			return redrawStreamList(g)
+		})
+	}()
+	return nil
+}
+
+// showStreamListMembers closes the stream list view and shows the members of the
+// selected stream
+func showStreamListMembers(g *gocui.Gui, v *gocui.View) error {
+	row, ok := selectedStreamListRow(v)
+	if !ok {
+		return nil
+	}
+	stream := row.stream
+	go showStreamMembers(stream.Name, stream.StreamID)
+	return closeStreamList(g, v)
+}
+
+// subscribeToStream subscribes the user to the named stream (creating it if it does
+// not exist), reporting the outcome in the main view
+func subscribeToStream(name string) error {
+	subscribed, _, err := config.zulipClient.AddSubscriptions(context.Background(), []string{name})
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Unable to subscribe to %s: %v", name, err)},
+		}
+		return err
+	}
+	ret := fmt.Sprintf("Subscribed to %s", name)
+	if len(subscribed) == 0 {
+		ret = fmt.Sprintf("Already subscribed to %s", name)
+	}
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: ret},
+	}
+	return nil
+}
+
+// unsubscribeFromStream unsubscribes the user from the named stream, reporting the
+// outcome in the main view
+func unsubscribeFromStream(name string) error {
+	removed, _, err := config.zulipClient.RemoveSubscriptions(context.Background(), []string{name})
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Unable to unsubscribe from %s: %v", name, err)},
+		}
+		return err
+	}
+	ret := fmt.Sprintf("Unsubscribed from %s", name)
+	if len(removed) == 0 {
+		ret = fmt.Sprintf("Not subscribed to %s", name)
+	}
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: ret},
+	}
+	return nil
+}
+
+// showStreamMembers shows the email addresses of everyone subscribed to the named
+// stream in the main view. If streamID is 0 the stream's ID is looked up by its name.
+func showStreamMembers(name string, streamID int64) {
+	ctx := context.Background()
+	if streamID == 0 {
+		var err error
+		if streamID, err = config.zulipClient.GetStreamID(ctx, name); err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Unable to find the stream %s: %v", name, err)},
+			}
+			return
+		}
+	}
+	subscribers, err := config.zulipClient.GetSubscribers(ctx, streamID)
+	if err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Unable to list the members of %s: %v", name, err)},
+		}
+		return
+	}
+	emails := make([]string, len(subscribers))
+	for i, id := range subscribers {
+		email, ok := config.roster.email(id)
+		if !ok {
+			email = fmt.Sprintf("user %d", id)
+		}
+		emails[i] = email
+	}
+	sort.Strings(emails)
+	config.mainTextChannel <- WindowMessage{
+		Type:    CommandFeedbackMessage,
+		Message: zulip.Message{Content: fmt.Sprintf("%d members of %s:\n%s", len(emails), name, strings.Join(emails, "\n"))},
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/codegangsta/cli"
 	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/cache"
+	"github.com/mjec/clisiana/lib/emoji"
+	"github.com/mjec/clisiana/lib/markdown"
+	"github.com/mjec/clisiana/lib/messagelog"
 	"github.com/mjec/clisiana/lib/notifications"
 	"github.com/mjec/clisiana/lib/zulip"
 )
@@ -39,8 +46,21 @@ func run(c *cli.Context) error {
 	// Make directories for files if necessary
 	os.MkdirAll(path.Dir(config.CacheFile), 0755)
 
+	messageCache, cacheErr := cache.Open(config.CacheFile)
+	if cacheErr == nil {
+		config.cache = messageCache
+		defer config.cache.Close()
+	}
+
+	var logErr error
 	if config.Logging {
 		os.MkdirAll(path.Dir(config.LogFile), 0755)
+		var messageLog *messagelog.Log
+		messageLog, logErr = messagelog.Open(config.LogFile)
+		if logErr == nil {
+			config.messageLog = messageLog
+			defer config.messageLog.Close()
+		}
 	}
 
 	if config.NotificationsEnabled {
@@ -50,6 +70,7 @@ func run(c *cli.Context) error {
 	}
 
 	// Set up interface
+	config.sidebar = newSidebar(!config.Sidebar)
 	config.ui = gocui.NewGui()
 	if err := config.ui.Init(); err != nil {
 		log.Panicln(err)
@@ -62,6 +83,18 @@ func run(c *cli.Context) error {
 	if err := setGlobalKeybindings(config.ui); err != nil {
 		log.Panicln(err)
 	}
+	if err := setCmdViewKeybindings(config.ui, "cmd"); err != nil {
+		log.Panicln(err)
+	}
+	if err := setStreamListKeybindings(config.ui, "streams-list"); err != nil {
+		log.Panicln(err)
+	}
+	if err := setSidebarKeybindings(config.ui, "sidebar"); err != nil {
+		log.Panicln(err)
+	}
+	if err := setMainViewKeybindings(config.ui, "main"); err != nil {
+		log.Panicln(err)
+	}
 
 	// We can't guarantee this will run FIFO, but it should only matter
 	// when things are added very quickly one after the other because
@@ -75,15 +108,31 @@ func run(c *cli.Context) error {
 		}
 	}(config.mainTextChannel, config.ui)
 
+	if cacheErr != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot open message cache %s: %v", config.CacheFile, cacheErr)},
+		}
+	}
+	if logErr != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: fmt.Sprintf("Cannot open message log %s: %v", config.LogFile, logErr)},
+		}
+	}
+	loadCachedHistory()
+	loadRecentConversations()
+
 	go func(messages <-chan zulip.OutgoingStreamMessage, channel chan<- WindowMessage) {
 		for msg := range messages {
-			msgid, err := zulip.SendStreamMessage(config.zulipContext, msg)
+			msgid, err := config.zulipClient.SendStreamMessage(context.Background(), msg)
 			if err != nil {
 				channel <- WindowMessage{
 					Type:    ErrorMessage,
-					Message: zulip.Message{Content: err.Error()},
+					Message: zulip.Message{Content: streamMessageSendError(msg, err)},
 				}
 			} else {
+				logMessages(messagelog.OutgoingStreamEntry(msgid, config.Email, msg))
 				channel <- WindowMessage{
 					Type:    DebugMessage,
 					Message: zulip.Message{Content: fmt.Sprintf("Stream message sent: got message ID %d", msgid)},
@@ -94,13 +143,14 @@ func run(c *cli.Context) error {
 
 	go func(messages <-chan zulip.OutgoingPrivateMessage, channel chan<- WindowMessage) {
 		for msg := range messages {
-			msgid, err := zulip.SendPrivateMessage(config.zulipContext, msg)
+			msgid, err := config.zulipClient.SendPrivateMessage(context.Background(), msg)
 			if err != nil {
 				channel <- WindowMessage{
 					Type:    ErrorMessage,
 					Message: zulip.Message{Content: err.Error()},
 				}
 			} else {
+				logMessages(messagelog.OutgoingPrivateEntry(msgid, config.Email, msg))
 				channel <- WindowMessage{
 					Type:    DebugMessage,
 					Message: zulip.Message{Content: fmt.Sprintf("Private message sent: got message ID %d", msgid)},
@@ -109,6 +159,8 @@ func run(c *cli.Context) error {
 		}
 	}(config.outgoingPrivateMessagesChannel, config.mainTextChannel)
 
+	go redrawWhileCountingDown(config.ui)
+
 	config.ui.Execute(func(g *gocui.Gui) error {
 		return g.SetCurrentView("cmd")
 	})
@@ -120,57 +172,230 @@ func run(c *cli.Context) error {
 	return nil
 }
 
+// streamMessageSendError describes why msg could not be sent
+func streamMessageSendError(msg zulip.OutgoingStreamMessage, err error) string {
+	if errors.Is(err, zulip.ErrStreamDoesNotExist) {
+		return fmt.Sprintf("Stream %s does not exist; use 'subscribe %s' to create it", msg.Stream, msg.Stream)
+	}
+	return err.Error()
+}
+
 // makeMainViewUpdater returns a function which can be passed to gocui.Gui.Execute()
 // which will update the main view to display the WindowMessage.
 func makeMainViewUpdater(m WindowMessage) gocui.Handler {
+	return func(g *gocui.Gui) error {
+		main, err := g.View("main")
+		if err != nil {
+			return err
+		}
+		if m.Message.ID != 0 {
+			config.sidebar.noteMessages(m.Message)
+		}
+		config.feed.add(main, m)
+		return nil
+	}
+}
+
+// makeMainViewHistoryInserter returns a function which can be passed to gocui.Gui.Execute()
+// which will insert older messages matching n into the main view. foundOldest should be
+// true if there is no history older than these messages. If the main view is no longer
+// narrowed to n, only those messages which match its narrow are inserted.
+func makeMainViewHistoryInserter(ms []WindowMessage, n narrowing, foundOldest bool) gocui.Handler {
+	return func(g *gocui.Gui) error {
+		if n == config.feed.narrow {
+			config.feed.fetchingHistory = false
+			if foundOldest {
+				config.feed.foundOldest = true
+			}
+		}
+		for _, m := range ms {
+			if m.Message.ID != 0 {
+				config.sidebar.noteMessages(m.Message)
+			}
+		}
+		main, err := g.View("main")
+		if err != nil {
+			return err
+		}
+		config.feed.insert(main, ms)
+		return nil
+	}
+}
+
+// formatWindowMessage returns the text to write to a main view of the given width to
+// display the WindowMessage (which is empty if it should not be displayed).
+func formatWindowMessage(m WindowMessage, width int) string {
 	str := m.Message.Content
+	if m.Type == PrivateMessage || m.Type == StreamMessage {
+		str = renderContent(m.Message, width)
+	}
 	switch m.Type {
 	case CommandFeedbackMessage:
 		str = fmt.Sprintf("CMD: %s\n", str)
 	case DebugMessage:
 		if !DEBUG {
-			return func(g *gocui.Gui) error { return nil }
+			return ""
 		}
 		str = fmt.Sprintf("DEBUG: %s\n", str)
 	case ErrorMessage:
 		str = fmt.Sprintf("ERROR: %s\n", str)
 	case PrivateMessage:
-		str = fmt.Sprintf("\n%s Private messge from %s\n%s\n\n", config.Prompt, m.Message.SenderFullName, str)
+		str = fmt.Sprintf("\n%s Private messge from %s%s\n%s\n%s\n", config.Prompt, m.Message.SenderFullName, editedMarker(m.Message), str, formatReactions(m.Message))
 	case StreamMessage:
-		str = fmt.Sprintf("\n%s Stream messge to %s from %s\n%s\n\n", config.Prompt, m.Message.DisplayRecipient.Stream, m.Message.SenderFullName, str)
+		str = fmt.Sprintf("\n%s Stream messge to %s from %s%s\n%s\n%s\n", config.Prompt, m.Message.DisplayRecipient.Stream, m.Message.SenderFullName, editedMarker(m.Message), str, formatReactions(m.Message))
 	default:
 		str = fmt.Sprintf("%s\n", str)
 	}
+	return str
+}
 
-	return func(g *gocui.Gui) error {
-		main, err := g.View("main")
-		if err != nil {
-			return err
-		}
-		fmt.Fprint(main, str)
+// renderedContentKey identifies the content of a zulip message
+type renderedContentKey struct {
+	html    bool
+	content string
+}
+
+// renderedContent caches the content rendered by renderContent, because the main
+// view's lines are counted (so its messages formatted) whenever it scrolls. It is
+// emptied when the renderer's settings change. It must only be used from the gocui
+// main loop.
+var renderedContent = struct {
+	renderer  markdown.Renderer
+	byContent map[renderedContentKey]string
+}{}
+
+// maxRenderedContent is the number of renderings to cache before starting afresh
+const maxRenderedContent = 5000
+
+// renderContent returns the content of m, which is markdown or HTML, styled for
+// display in a view of the given width
+func renderContent(m zulip.Message, width int) string {
+	renderer := markdown.Renderer{Width: width, Highlighting: codeColorScheme(), BaseURL: realmURL()}
+	if renderer != renderedContent.renderer || len(renderedContent.byContent) >= maxRenderedContent {
+		renderedContent.renderer = renderer
+		renderedContent.byContent = make(map[renderedContentKey]string)
+	}
+	key := renderedContentKey{m.IsHTML(), m.Content}
+	if rendered, ok := renderedContent.byContent[key]; ok {
+		return rendered
+	}
+	var rendered string
+	if m.IsHTML() {
+		rendered = renderer.RenderHTML(m.Content)
+	} else {
+		rendered = renderer.Render(m.Content)
+	}
+	renderedContent.byContent[key] = rendered
+	return rendered
+}
+
+// plainContent returns the content of m as plain text, for where it cannot be styled
+// such as desktop notifications. Markdown is left as it is, apart from emoji.
+func plainContent(m zulip.Message) string {
+	if !m.IsHTML() {
+		return emoji.Replace(m.Content)
+	}
+	return markdown.Strip(markdown.Renderer{BaseURL: realmURL()}.RenderHTML(m.Content))
+}
+
+// requestHTML returns true if messages should be fetched as HTML rendered by the
+// server, rather than as markdown
+func requestHTML() bool {
+	return strings.EqualFold(strings.TrimSpace(config.MessageFormat), "html")
+}
+
+// codeColorScheme returns the colour scheme to highlight code with, or nil if it
+// should not be highlighted. config.CodeColors is checked by checkCodeColors when it
+// is set, so the dark scheme is only a last resort.
+func codeColorScheme() *markdown.Scheme {
+	name := strings.ToLower(strings.TrimSpace(config.CodeColors))
+	if name == "none" || name == "off" {
+		return nil
+	}
+	if scheme, ok := markdown.Schemes[name]; ok {
+		return scheme
+	}
+	return markdown.Schemes["dark"]
+}
+
+// checkCodeColors returns an error if name is not a colour scheme to highlight code with
+func checkCodeColors(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, ok := markdown.Schemes[name]; ok || name == "none" || name == "off" {
 		return nil
 	}
+	return fmt.Errorf("Unknown code colour scheme '%s': use one of dark, light, bold or none", name)
+}
+
+// editedMarker returns the text to show after the header of a message which has been edited
+func editedMarker(m zulip.Message) string {
+	if m.LastEditTimestamp != 0 {
+		return " (edited)"
+	}
+	return ""
+}
+
+// formatReactions returns a line summarising the reactions to m, e.g. "👍 3  🎉 1", or
+// "" if there are none. Realm custom emoji are shown by name, e.g. ":zulip: 2".
+func formatReactions(m zulip.Message) string {
+	counts := m.ReactionCounts()
+	if len(counts) == 0 {
+		return ""
+	}
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		name := ":" + c.EmojiName + ":"
+		if c.ReactionType == "unicode_emoji" || c.ReactionType == "" {
+			if glyph, ok := emoji.FromCode(c.EmojiCode); ok {
+				name = emoji.Padded(glyph)
+			}
+		}
+		parts[i] = fmt.Sprintf("%s %d", name, c.Count)
+	}
+	return strings.Join(parts, "  ") + "\n"
 }
 
 func layout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
 
-	main, err := g.SetView("main", -1, -1, maxX, maxY-3)
+	left, err := layoutSidebar(g)
+	if err != nil {
+		return err
+	}
+	main, err := g.SetView("main", left-1, -1, maxX, maxY-3)
 	if err != nil && err != gocui.ErrUnknownView {
 		return err
 	}
-	main.Autoscroll = true
+	if err == gocui.ErrUnknownView {
+		// Only when first created, as scrolling turns this off
+		main.Autoscroll = true
+	}
 	main.Wrap = true
+	config.feed.resize(main)
+	main.SelBgColor = gocui.ColorGreen
+	main.SelFgColor = gocui.ColorBlack
+	config.feed.placeSelectionCursor(main)
+	markVisibleMessagesRead(g, main)
 
 	sizeOfPrompt := utf8.RuneCountInString(config.Prompt)
+	statusText := statusDescription()
+	sizeOfStatus := utf8.RuneCountInString(statusText) + 1
 
-	cmd, err := g.SetView("cmd", sizeOfPrompt, maxY-3, maxX, maxY)
+	cmd, err := g.SetView("cmd", sizeOfPrompt, maxY-3, maxX-sizeOfStatus, maxY)
 	cmd.Frame = false
 	if err != nil && err != gocui.ErrUnknownView {
 		return err
 	}
 	cmd.Editable = true
 
+	statusView, err := g.SetView("status", maxX-sizeOfStatus-1, maxY-3, maxX, maxY)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	statusView.Frame = false
+	statusView.Clear()
+	fmt.Fprint(statusView, statusText)
+
 	promptView, err := g.SetView("prompt", -1, maxY-3, sizeOfPrompt, maxY)
 	if err != nil && err != gocui.ErrUnknownView {
 		return err
@@ -210,37 +435,21 @@ func layout(g *gocui.Gui) error {
 			g.Editor = gocui.EditorFunc(cuiStreamMessageTopicEditor)
 		case "stream-view-content":
 			g.Editor = gocui.EditorFunc(cuiStreamMessageContentEditor)
-		// case "private-view-content":
+		case "private-view-recipients":
+			g.Editor = gocui.EditorFunc(cuiPrivateMessageRecipientsEditor)
+		case "private-view-content":
+			g.Editor = gocui.EditorFunc(cuiPrivateMessageContentEditor)
 		default:
 			g.Editor = gocui.DefaultEditor
 		}
 	} else {
 		g.Editor = gocui.DefaultEditor
 	}
+	g.Editor = inputRecordingEditor{g.Editor}
 
 	return nil
 }
 
-// TODO: implement
-func showNewPrivateMessagePrompt(g *gocui.Gui, initialMessage zulip.OutgoingPrivateMessage) chan struct {
-	zulip.OutgoingPrivateMessage
-	error
-} {
-	nullMsg := zulip.OutgoingPrivateMessage{} // returned if this function errors before launching goroutine
-	privateMessageSendResultChannel := make(chan struct {
-		zulip.OutgoingPrivateMessage
-		error
-	})
-	g.Execute(func(g *gocui.Gui) error {
-		privateMessageSendResultChannel <- struct {
-			zulip.OutgoingPrivateMessage
-			error
-		}{nullMsg, fmt.Errorf("Not implemented")}
-		return nil
-	})
-	return privateMessageSendResultChannel
-}
-
 func sendStreamMessageFromPrompt() {
 	// TODO: improve error handling
 	var streamView, topicView, contentView *gocui.View
@@ -274,6 +483,11 @@ func sendStreamMessageFromPrompt() {
 	}
 	content = contentView.Buffer()
 
+	if config.editing != nil {
+		go editMessage(*config.editing, stream, topic, content)
+		return
+	}
+
 	if stream == "" {
 		config.mainTextChannel <- WindowMessage{
 			Type:    CommandFeedbackMessage,
@@ -299,6 +513,7 @@ func sendStreamMessageFromPrompt() {
 
 func destroyStreamMessagePrompt() {
 	config.ui.Execute(func(g *gocui.Gui) error {
+		config.editing = nil
 		var err error
 		if err = g.DeleteView("stream-view-stream"); err != nil {
 			log.Panic(err)
@@ -316,50 +531,26 @@ func destroyStreamMessagePrompt() {
 	})
 }
 
-func showNewStreamMessagePrompt(g *gocui.Gui, initialMessage zulip.OutgoingStreamMessage) chan struct {
-	zulip.OutgoingStreamMessage
-	error
-} {
-	nullMsg := zulip.OutgoingStreamMessage{} // returned if this function errors before launching goroutine
-	streamMessageSendResultChannel := make(chan struct {
-		zulip.OutgoingStreamMessage
-		error
-	})
-
+// showNewStreamMessagePrompt opens the stream message composer. The message is sent
+// by sendStreamMessageFromPrompt when the composer is submitted.
+func showNewStreamMessagePrompt(g *gocui.Gui, initialMessage zulip.OutgoingStreamMessage) {
 	g.Execute(func(g *gocui.Gui) error {
 		maxX, maxY := g.Size()
 		var streamView, topicView, contentView *gocui.View
 		var err error
 		if streamView, err = g.SetView("stream-view-stream", maxX/2-30, maxY/2-1, maxX/2, maxY/2+1); err != nil {
 			if err != gocui.ErrUnknownView {
-				streamMessageSendResultChannel <- struct {
-					zulip.OutgoingStreamMessage
-					error
-				}{nullMsg, err}
 				return err
 			}
 		}
 		if topicView, err = g.SetView("stream-view-topic", maxX/2, maxY/2-1, maxX/2+30, maxY/2+1); err != nil {
 			if err != gocui.ErrUnknownView {
-				if err != gocui.ErrUnknownView {
-					streamMessageSendResultChannel <- struct {
-						zulip.OutgoingStreamMessage
-						error
-					}{nullMsg, err}
-					return err
-				}
+				return err
 			}
 		}
 		if contentView, err = g.SetView("stream-view-content", maxX/2-30, maxY/2+2, maxX/2+30, maxY/2+10); err != nil {
 			if err != gocui.ErrUnknownView {
-				if err != gocui.ErrUnknownView {
-					streamMessageSendResultChannel <- struct {
-						zulip.OutgoingStreamMessage
-						error
-					}{nullMsg, err}
-					return err
-
-				}
+				return err
 			}
 		}
 		streamView.Editable = true
@@ -376,22 +567,128 @@ func showNewStreamMessagePrompt(g *gocui.Gui, initialMessage zulip.OutgoingStrea
 		contentView.Autoscroll = true
 		contentView.Wrap = true
 		contentView.Title = "Message"
+		if config.editing != nil {
+			contentView.Title = fmt.Sprintf("Edit message %d", config.editing.original.ID)
+		}
 		contentView.Write([]byte(initialMessage.Content))
 
-		if err := g.SetCurrentView("stream-view-content"); err != nil {
-			streamMessageSendResultChannel <- struct {
-				zulip.OutgoingStreamMessage
-				error
-			}{nullMsg, err}
-			return err
+		return g.SetCurrentView("stream-view-content")
+	})
+}
+
+func sendPrivateMessageFromPrompt() {
+	var recipientsView, contentView *gocui.View
+	var err error
+	var content string
+	recipientsView, err = config.ui.View("private-view-recipients")
+	if recipientsView == nil || err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: "Problem with private-view-recipients"},
 		}
-		return nil
+		return
+	}
+	recipients := parseRecipients(recipientsView.Buffer())
+	contentView, err = config.ui.View("private-view-content")
+	if contentView == nil || err != nil {
+		config.mainTextChannel <- WindowMessage{
+			Type:    ErrorMessage,
+			Message: zulip.Message{Content: "Problem with private-view-content"},
+		}
+		return
+	}
+	content = contentView.Buffer()
+
+	if config.editing != nil {
+		go editMessage(*config.editing, "", "", content)
+		return
+	}
+
+	if len(recipients) == 0 {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: "You must specify at least one recipient!"},
+		}
+		return
+	}
+
+	if strings.TrimSpace(content) == "" {
+		config.mainTextChannel <- WindowMessage{
+			Type:    CommandFeedbackMessage,
+			Message: zulip.Message{Content: "You must specify some content!"},
+		}
+		return
+	}
+
+	config.outgoingPrivateMessagesChannel <- zulip.OutgoingPrivateMessage{
+		To:      recipients,
+		Content: content,
+	}
+}
+
+// parseRecipients splits a list of email addresses separated by commas, semicolons
+// or whitespace (as typed into the recipients field) into its parts.
+func parseRecipients(recipients string) []string {
+	return strings.FieldsFunc(recipients, func(r rune) bool {
+		return r == ',' || r == ';' || unicode.IsSpace(r)
 	})
+}
 
-	return streamMessageSendResultChannel
+func destroyPrivateMessagePrompt() {
+	config.ui.Execute(func(g *gocui.Gui) error {
+		config.editing = nil
+		var err error
+		if err = g.DeleteView("private-view-recipients"); err != nil {
+			log.Panic(err)
+		}
+		if err = g.DeleteView("private-view-content"); err != nil {
+			log.Panic(err)
+		}
+		if err = g.SetCurrentView("cmd"); err != nil {
+			log.Panic(err)
+		}
+		return nil
+	})
 }
 
-// TODO: private message version of showNewStreamMessagePrompt
+// showNewPrivateMessagePrompt opens the private message composer. The message is sent
+// by sendPrivateMessageFromPrompt when the composer is submitted.
+func showNewPrivateMessagePrompt(g *gocui.Gui, initialMessage zulip.OutgoingPrivateMessage) {
+	g.Execute(func(g *gocui.Gui) error {
+		maxX, maxY := g.Size()
+		var recipientsView, contentView *gocui.View
+		var err error
+		if recipientsView, err = g.SetView("private-view-recipients", maxX/2-30, maxY/2-1, maxX/2+30, maxY/2+1); err != nil {
+			if err != gocui.ErrUnknownView {
+				return err
+			}
+		}
+		if contentView, err = g.SetView("private-view-content", maxX/2-30, maxY/2+2, maxX/2+30, maxY/2+10); err != nil {
+			if err != gocui.ErrUnknownView {
+				return err
+			}
+		}
+		recipientsView.Editable = true
+		recipientsView.Autoscroll = true
+		recipientsView.Title = "To (comma separated emails)"
+		recipientsView.Write([]byte(strings.Join(initialMessage.To, ", ")))
+
+		contentView.Editable = true
+		contentView.Autoscroll = true
+		contentView.Wrap = true
+		contentView.Title = "Message"
+		if config.editing != nil {
+			contentView.Title = fmt.Sprintf("Edit message %d", config.editing.original.ID)
+		}
+		contentView.Write([]byte(initialMessage.Content))
+
+		initialView := "private-view-content"
+		if len(initialMessage.To) == 0 {
+			initialView = "private-view-recipients"
+		}
+		return g.SetCurrentView(initialView)
+	})
+}
 
 func showHelp(g *gocui.Gui, v *gocui.View) error {
 	parseCmdLine("help")
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jroimartin/gocui"
+	"github.com/mjec/clisiana/lib/cache"
+	"github.com/mjec/clisiana/lib/zulip"
+)
+
+// conversation identifies a topic of a stream or a private message conversation
+type conversation struct {
+	stream string // lowercase, or empty for private messages
+	topic  string // lowercase, or empty for private messages
+	pmWith string // as returned by cache.PMWith, or empty for stream messages
+}
+
+// conversationOf returns the conversation m is part of
+func conversationOf(m zulip.Message) conversation {
+	if m.Type == zulip.PrivateMessage {
+		return conversation{pmWith: cache.PMWith(m)}
+	}
+	return conversation{
+		stream: strings.ToLower(m.DisplayRecipient.Stream),
+		topic:  strings.ToLower(m.Subject),
+	}
+}
+
+// unreadMessages keeps track of the messages the user has not read, with a count for
+// each stream, topic and private message conversation. It is safe to use from any
+// goroutine.
+type unreadMessages struct {
+	sync.Mutex
+	messages map[int64]conversation // by message ID
+	streams  map[string]int         // by lowercase stream name
+	topics   map[conversation]int   // by stream and topic (pmWith is always empty)
+	pms      map[string]int         // by cache.PMWith
+	marking  map[int64]bool         // IDs being marked as read on the server
+}
+
+func newUnreadMessages() *unreadMessages {
+	u := &unreadMessages{marking: make(map[int64]bool)}
+	u.reset()
+	return u
+}
+
+// reset forgets every unread message
+func (u *unreadMessages) reset() {
+	u.messages = make(map[int64]conversation)
+	u.streams = make(map[string]int)
+	u.topics = make(map[conversation]int)
+	u.pms = make(map[string]int)
+}
+
+// clear forgets every unread message, e.g. when everything is marked as read
+func (u *unreadMessages) clear() {
+	u.Lock()
+	defer u.Unlock()
+	u.reset()
+}
+
+// add records the messages as unread
+func (u *unreadMessages) add(ms ...zulip.Message) {
+	u.Lock()
+	defer u.Unlock()
+	for _, m := range ms {
+		u.addLocked(m.ID, conversationOf(m))
+	}
+}
+
+// merge records the messages with the given IDs as unread in their conversations
+func (u *unreadMessages) merge(messages map[int64]conversation) {
+	u.Lock()
+	defer u.Unlock()
+	for id, c := range messages {
+		u.addLocked(id, c)
+	}
+}
+
+// addLocked records the message with the given ID as unread in c. The lock must be held.
+func (u *unreadMessages) addLocked(id int64, c conversation) {
+	if _, ok := u.messages[id]; ok {
+		return
+	}
+	u.messages[id] = c
+	u.count(c, 1)
+}
+
+// remove records the messages with the given IDs as read (or deleted)
+func (u *unreadMessages) remove(ids ...int64) {
+	u.Lock()
+	defer u.Unlock()
+	for _, id := range ids {
+		if c, ok := u.messages[id]; ok {
+			delete(u.messages, id)
+			u.count(c, -1)
+		}
+	}
+}
+
+// moveToTopic records that the messages with the given IDs now have a new topic
+func (u *unreadMessages) moveToTopic(ids []int64, topic string) {
+	u.Lock()
+	defer u.Unlock()
+	for _, id := range ids {
+		c, ok := u.messages[id]
+		if !ok || c.pmWith != "" {
+			continue
+		}
+		u.count(c, -1)
+		c.topic = strings.ToLower(topic)
+		u.messages[id] = c
+		u.count(c, 1)
+	}
+}
+
+// count adds delta to the counts for c. The lock must be held.
+func (u *unreadMessages) count(c conversation, delta int) {
+	if c.pmWith != "" {
+		u.pms[c.pmWith] += delta
+		if u.pms[c.pmWith] <= 0 {
+			delete(u.pms, c.pmWith)
+		}
+		return
+	}
+	u.streams[c.stream] += delta
+	if u.streams[c.stream] <= 0 {
+		delete(u.streams, c.stream)
+	}
+	u.topics[c] += delta
+	if u.topics[c] <= 0 {
+		delete(u.topics, c)
+	}
+}
+
+// total returns the number of unread messages
+func (u *unreadMessages) total() int {
+	u.Lock()
+	defer u.Unlock()
+	return len(u.messages)
+}
+
+// streamCount returns the number of unread messages in the named stream
+func (u *unreadMessages) streamCount(stream string) int {
+	u.Lock()
+	defer u.Unlock()
+	return u.streams[strings.ToLower(stream)]
+}
+
+// topicCount returns the number of unread messages in a topic of the named stream
+func (u *unreadMessages) topicCount(stream string, topic string) int {
+	u.Lock()
+	defer u.Unlock()
+	return u.topics[conversation{stream: strings.ToLower(stream), topic: strings.ToLower(topic)}]
+}
+
+// pmCount returns the number of unread messages in the private message conversation
+// pmWith, which is in the form returned by cache.PMWith
+func (u *unreadMessages) pmCount(pmWith string) int {
+	u.Lock()
+	defer u.Unlock()
+	return u.pms[pmWith]
+}
+
+// conversations returns the number of unread messages in each topic and each private
+// message conversation which has any
+func (u *unreadMessages) conversations() (topics map[conversation]int, pms map[conversation]int) {
+	u.Lock()
+	defer u.Unlock()
+	topics = make(map[conversation]int, len(u.topics))
+	for c, n := range u.topics {
+		topics[c] = n
+	}
+	pms = make(map[conversation]int, len(u.pms))
+	for pmWith, n := range u.pms {
+		pms[conversation{pmWith: pmWith}] = n
+	}
+	return topics, pms
+}
+
+// startMarking returns those of ids which are unread and not already being marked as
+// read, and notes that they are being marked as read
+func (u *unreadMessages) startMarking(ids []int64) []int64 {
+	u.Lock()
+	defer u.Unlock()
+	toMark := []int64{}
+	for _, id := range ids {
+		if _, unread := u.messages[id]; unread && !u.marking[id] {
+			u.marking[id] = true
+			toMark = append(toMark, id)
+		}
+	}
+	return toMark
+}
+
+// finishMarking notes that the messages with the given IDs are no longer being marked
+// as read, and records them as read if that succeeded
+func (u *unreadMessages) finishMarking(ids []int64, succeeded bool) {
+	u.Lock()
+	for _, id := range ids {
+		delete(u.marking, id)
+	}
+	u.Unlock()
+	if succeeded {
+		u.remove(ids...)
+	}
+}
+
+// loadUnread records the unread messages reported when the event queue was registered.
+// Stream IDs are looked up in subscriptions and user IDs in the roster, so it must
+// already be loaded.
+func loadUnread(unread zulip.UnreadMessages, subscriptions []zulip.Subscription) {
+	messages := make(map[int64]conversation)
+
+	streams := make(map[int64]string, len(subscriptions))
+	for _, s := range subscriptions {
+		streams[s.StreamID] = s.Name
+	}
+	for _, s := range unread.Streams {
+		name, ok := streams[s.StreamID]
+		if !ok {
+			continue
+		}
+		c := conversation{stream: strings.ToLower(name), topic: strings.ToLower(s.Topic)}
+		for _, id := range s.UnreadMessageIDs {
+			messages[id] = c
+		}
+	}
+
+	for _, pm := range unread.PMs {
+		if c, ok := pmConversation([]int64{pm.UserID()}); ok {
+			for _, id := range pm.UnreadMessageIDs {
+				messages[id] = c
+			}
+		}
+	}
+	for _, huddle := range unread.Huddles {
+		if c, ok := pmConversation(huddle.UserIDs()); ok {
+			for _, id := range huddle.UnreadMessageIDs {
+				messages[id] = c
+			}
+		}
+	}
+
+	config.unread.merge(messages)
+	// Redraw so that the counts are displayed
+	config.ui.Execute(func(g *gocui.Gui) error { return nil })
+}
+
+// pmConversation returns the private message conversation between the user and the
+// users with the given IDs, if they are all in the roster
+func pmConversation(userIDs []int64) (conversation, bool) {
+	emails := []string{config.Email}
+	for _, id := range userIDs {
+		email, ok := config.roster.email(id)
+		if !ok {
+			return conversation{}, false
+		}
+		emails = append(emails, email)
+	}
+	return conversation{pmWith: cache.PMWithEmails(emails)}, true
+}
+
+// applyMessageFlags records messages being marked as read or unread
+func applyMessageFlags(f *zulip.MessageFlagsUpdate) {
+	if f.Flag != zulip.ReadFlag {
+		return
+	}
+	switch {
+	case f.Op == zulip.AddOp && f.All:
+		config.unread.clear()
+	case f.Op == zulip.AddOp:
+		config.unread.remove(f.Messages...)
+	case f.Op == zulip.RemoveOp && config.cache != nil:
+		// We only know which conversation a message is in if it is in the cache
+		ms, err := config.cache.Get(f.Messages...)
+		if err != nil {
+			config.mainTextChannel <- WindowMessage{
+				Type:    ErrorMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot read message cache: %v", err)},
+			}
+		}
+		config.unread.add(ms...)
+	}
+	config.ui.Execute(func(g *gocui.Gui) error { return nil })
+}
+
+// markVisibleMessagesRead marks the unread messages which are visible in the main view
+// as read, provided the user is looking at it: the command line or the main view has
+// the focus and they are not idle. It must be called from the gocui main loop.
+func markVisibleMessagesRead(g *gocui.Gui, main *gocui.View) {
+	if state, _, _, _ := currentConnectionState(); state != Polling || userIsIdle() {
+		return
+	}
+	if current := g.CurrentView(); current == nil || (current.Name() != "cmd" && current.Name() != "main") {
+		return
+	}
+	ids := config.unread.startMarking(config.feed.visibleMessageIDs(main))
+	if len(ids) == 0 {
+		return
+	}
+	go func() {
+		err := config.zulipClient.AddMessageFlag(context.Background(), ids, zulip.ReadFlag)
+		config.unread.finishMarking(ids, err == nil)
+		if err != nil {
+			// They will be marked as read the next time they are displayed
+			config.mainTextChannel <- WindowMessage{
+				Type:    DebugMessage,
+				Message: zulip.Message{Content: fmt.Sprintf("Cannot mark messages as read: %v", err)},
+			}
+			return
+		}
+		// Redraw so that the new counts are displayed
+		config.ui.Execute(func(g *gocui.Gui) error { return nil })
+	}()
+}
+
+// unreadDescription returns a short description of the number of unread messages for
+// the status view, or "" if there are none
+func unreadDescription() string {
+	if n := config.unread.total(); n > 0 {
+		return fmt.Sprintf("%d unread", n)
+	}
+	return ""
+}
+
+// hasFlag returns true if flags includes flag
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}